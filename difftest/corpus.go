@@ -0,0 +1,196 @@
+package difftest
+
+import (
+	"encoding/hex"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// a tiny assembler for writing the snippets
+type asm struct {
+	code   []byte
+	labels map[string]int
+	fixups map[int]string // the position of a PUSH2's immediate -> label
+}
+
+func newAsm() *asm {
+	return &asm{labels: make(map[string]int), fixups: make(map[int]string)}
+}
+
+func (a *asm) op(ops ...int) *asm {
+	for _, op := range ops {
+		a.code = append(a.code, byte(op))
+	}
+	return a
+}
+
+// push a value with the shortest PUSH
+func (a *asm) push(v *big.Int) *asm {
+	bz := v.Bytes()
+	if len(bz) == 0 {
+		bz = []byte{0}
+	}
+	a.code = append(a.code, byte(maot.OP_PUSH1+len(bz)-1))
+	a.code = append(a.code, bz...)
+	return a
+}
+
+func (a *asm) pushN(v int64) *asm {
+	return a.push(big.NewInt(v))
+}
+
+// push the PC of a label with PUSH2
+func (a *asm) pushLabel(name string) *asm {
+	a.code = append(a.code, maot.OP_PUSH2, 0, 0)
+	a.fixups[len(a.code)-2] = name
+	return a
+}
+
+// define a label at a JUMPDEST
+func (a *asm) label(name string) *asm {
+	a.labels[name] = len(a.code)
+	return a.op(maot.OP_JUMPDEST)
+}
+
+func (a *asm) bytes() []byte {
+	for pos, name := range a.fixups {
+		pc := a.labels[name]
+		a.code[pos], a.code[pos+1] = byte(pc>>8), byte(pc)
+	}
+	return a.code
+}
+
+// SSTORE the top of the stack at slot
+func (a *asm) store(slot int64) *asm {
+	return a.pushN(slot).op(maot.OP_SSTORE)
+}
+
+// the i-th word of calldata
+func (a *asm) arg(i int64) *asm {
+	return a.pushN(32 * i).op(maot.OP_CALLDATALOAD)
+}
+
+func word(i int) []byte {
+	var w [32]byte
+	big.NewInt(int64(i)).FillBytes(w[:])
+	return w[:]
+}
+
+func words(ws ...int) []byte {
+	var res []byte
+	for _, w := range ws {
+		res = append(res, word(w)...)
+	}
+	return res
+}
+
+// the runtime code of a contract computing square roots by the Babylonian method, compiled by solc 0.8.13
+const babylonHex = "608060405234801561001057600080fd5b50600436106100365760003560e01c8063653721471461003b578063677342ce14610059575b600080fd5b610043610075565b6040516100509190610114565b60405180910390f35b610073600480360381019061006e9190610160565b61007b565b005b60005481565b600060038211156100e2578190506000600160028461009a91906101eb565b6100a4919061021c565b90505b818110156100dc5780915060028182856100c191906101eb565b6100cb919061021c565b6100d591906101eb565b90506100a7565b506100f0565b600082146100ef57600190505b5b806000819055505050565b6000819050919050565b61010e816100fb565b82525050565b60006020820190506101296000830184610105565b92915050565b600080fd5b61013d816100fb565b811461014857600080fd5b50565b60008135905061015a81610134565b92915050565b6000602082840312156101765761017561012f565b5b60006101848482850161014b565b91505092915050565b7f4e487b7100000000000000000000000000000000000000000000000000000000600052601260045260246000fd5b7f4e487b7100000000000000000000000000000000000000000000000000000000600052601160045260246000fd5b60006101f6826100fb565b9150610201836100fb565b9250826102115761021061018d565b5b828204905092915050565b6000610227826100fb565b9150610232836100fb565b9250827fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff03821115610267576102666101bc565b5b82820190509291505056fea26469706673582212200e03c4ad7c4f84434e5637f8f06d34c1debad3c67774e1a0ab6aa3354b5d2a3064736f6c634300080d0033"
+
+// Babylon returns the sample contract which the demo, jumpbench and difftest use
+func Babylon() []byte {
+	code, err := hex.DecodeString(babylonHex)
+	if err != nil {
+		panic(err)
+	}
+	return code
+}
+
+// Snippets are small contracts covering the semantics which the basic block analysis must
+// preserve: gas correction inside blocks, fused and dynamic jumps, memory expansion, calls.
+func Snippets(rev int) []Case {
+	var cases []Case
+	add := func(name string, a *asm, inputs ...[]byte) {
+		cases = append(cases, Case{Name: name, Rev: rev, Code: a.bytes(), Inputs: append(inputs, nil)})
+	}
+
+	// arithmetic on calldata, each result in its own slot
+	a := newAsm()
+	binOps := []int{maot.OP_ADD, maot.OP_MUL, maot.OP_SUB, maot.OP_DIV, maot.OP_SDIV, maot.OP_MOD,
+		maot.OP_SMOD, maot.OP_EXP, maot.OP_SIGNEXTEND, maot.OP_LT, maot.OP_SLT, maot.OP_BYTE}
+	if rev >= maot.EVMC_CONSTANTINOPLE {
+		binOps = append(binOps, maot.OP_SHL, maot.OP_SHR, maot.OP_SAR)
+	}
+	for i, op := range binOps {
+		a.arg(1).arg(0).op(op).store(int64(i))
+	}
+	a.arg(2).arg(1).arg(0).op(maot.OP_ADDMOD).store(100)
+	a.arg(2).arg(1).arg(0).op(maot.OP_MULMOD).store(101)
+	add("arith", a, words(7, 3, 5), words(-1&0xff, 2, 0))
+
+	// GAS and SSTORE in the middle of a basic block, which need the gas correction
+	a = newAsm()
+	a.op(maot.OP_GAS).store(0).pushN(1).arg(0).op(maot.OP_SSTORE).op(maot.OP_GAS).store(1)
+	a.op(maot.OP_GAS, maot.OP_PC, maot.OP_ADD).store(2)
+	add("gas", a, words(5), words(0))
+
+	// a subroutine called from two sites, so its return JUMP is resolved to two targets,
+	// and a jump to a calldata-given target, which must use the JUMPTABLE
+	a = newAsm()
+	a.pushLabel("ret1").arg(0).pushLabel("double").op(maot.OP_JUMP)
+	a.label("ret1").store(0)
+	a.pushLabel("ret2").arg(1).pushLabel("double").op(maot.OP_JUMP)
+	a.label("ret2").store(1)
+	a.arg(2).op(maot.OP_DUP1, maot.OP_ISZERO).pushLabel("end").op(maot.OP_JUMPI).op(maot.OP_JUMP)
+	a.label("double").op(maot.OP_DUP1, maot.OP_ADD, maot.OP_SWAP1, maot.OP_JUMP)
+	a.label("end").op(maot.OP_STOP)
+	a.label("other").pushN(42).store(2)
+	add("jumps", a, words(1, 2, 0), words(1, 2, 1), words(1, 2, a.labels["other"]))
+
+	// a loop which expands the memory and hashes it
+	a = newAsm()
+	a.arg(0).label("loop").op(maot.OP_DUP1, maot.OP_ISZERO).pushLabel("done").op(maot.OP_JUMPI)
+	a.op(maot.OP_DUP1, maot.OP_DUP1).pushN(32).op(maot.OP_MUL, maot.OP_MSTORE)
+	a.pushN(1).op(maot.OP_SWAP1, maot.OP_SUB).pushLabel("loop").op(maot.OP_JUMP)
+	a.label("done").op(maot.OP_MSIZE).pushN(0).op(maot.OP_KECCAK256).store(0)
+	a.op(maot.OP_MSIZE).pushN(0).op(maot.OP_RETURN)
+	add("memory", a, words(3), words(40))
+
+	// expand the memory twice, where the quadratic cost of the words before and after is rounded separately
+	a = newAsm()
+	a.arg(0).op(maot.OP_MLOAD, maot.OP_POP).arg(1).op(maot.OP_MLOAD, maot.OP_POP).op(maot.OP_MSIZE).store(0)
+	add("memory-cost", a, words(22*32-32, 23*32-32), words(700*32, 701*32+1))
+
+	// REVERT or RETURN with data, and LOG2
+	a = newAsm()
+	a.arg(1).pushN(0).op(maot.OP_MSTORE)
+	a.arg(1).arg(0).pushN(32).pushN(0).op(maot.OP_LOG2)
+	a.arg(0).pushLabel("ok").op(maot.OP_JUMPI)
+	a.pushN(32).pushN(0).op(maot.OP_REVERT)
+	a.label("ok").pushN(32).pushN(0).op(maot.OP_RETURN)
+	add("revert-log", a, words(0, 9), words(1, 9))
+
+	// call itself with the gas in calldata, and the callee stores GAS
+	a = newAsm()
+	a.op(maot.OP_CALLDATASIZE).pushLabel("outer").op(maot.OP_JUMPI)
+	a.op(maot.OP_GAS).store(1).op(maot.OP_STOP)
+	a.label("outer")
+	a.pushN(0).pushN(0).pushN(0).pushN(0).pushN(0).op(maot.OP_ADDRESS).arg(0).op(maot.OP_CALL).store(0)
+	a.op(maot.OP_RETURNDATASIZE).store(2)
+	add("call", a, words(100000), words(30000), words(2400))
+
+	// stack requirements checked per basic block
+	a = newAsm()
+	a.arg(0).pushLabel("deep").op(maot.OP_JUMPI)
+	a.op(maot.OP_POP).op(maot.OP_STOP) // underflow
+	a.label("deep")
+	for i := 0; i < 20; i++ {
+		a.pushN(int64(i))
+	}
+	a.op(maot.OP_DUP16, maot.OP_SWAP16, maot.OP_ADD).store(0)
+	add("stack", a, words(0), words(1))
+
+	// a jump to a JUMPDEST in the hash of a trailer like solc's {"ipfs": <34 bytes>}, which the
+	// EVM allows although no compiler generates it
+	a = newAsm()
+	a.arg(0).op(maot.OP_JUMP)
+	a.op(0xa1, 0x64).op([]int{'i', 'p', 'f', 's'}...).op(0x58, 34)
+	hashStart := len(a.code)
+	a.label("meta").pushN(42).store(0).op(maot.OP_STOP)
+	a.code = append(a.code, make([]byte, 34-(len(a.code)-hashStart))...)
+	a.op(0x00, 1+5+2+34) // the length suffix
+	add("metadata-jump", a, words(a.labels["meta"]), words(a.labels["meta"]+1))
+
+	return cases
+}
@@ -0,0 +1,410 @@
+// Package difftest runs contracts through a reference interpreter and through the AOT path with an
+// in-memory MockHost, and compares the outcomes. The reference is interp.Interpreter.ExecuteBytecode,
+// which implements the instructions and the gas schedule on its own. The AOT path is
+// interp.Interpreter.Execute, which executes an AdvancedCodeAnalysis with the semantics of the
+// generated C++ code, but in Go. NativeExecutor builds the generated C++ code itself into a shared
+// library and runs it, when the package is built with the evmaot tag.
+package difftest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"sort"
+
+	"github.com/smartbch/moeingaot/interp"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+var (
+	ContractAddr = interp.Address{19: 0xc0}
+	CallerAddr   = interp.Address{19: 0xca}
+)
+
+// Executor runs code for a message, calling back the host
+type Executor struct {
+	Name string
+	Run  func(host *MockHost, msg *interp.Message, code []byte) (interp.Result, error)
+}
+
+// ReferenceExecutor interprets the bytecode instruction by instruction, sharing no code with AOTExecutor
+func ReferenceExecutor() *Executor {
+	return &Executor{Name: "reference", Run: func(h *MockHost, msg *interp.Message, code []byte) (interp.Result, error) {
+		in := &interp.Interpreter{Host: h, Tracer: h.Tracer}
+		return in.ExecuteBytecode(h.Rev, msg, code), nil
+	}}
+}
+
+// AOTExecutor executes the analysis which the C++ code is generated from
+func AOTExecutor(opts maot.Options) *Executor {
+	cache := make(map[string]maot.AdvancedCodeAnalysis)
+	return &Executor{Name: "aot", Run: func(h *MockHost, msg *interp.Message, code []byte) (interp.Result, error) {
+		key := fmt.Sprintf("%d:%s", h.Rev, code)
+		analysis, ok := cache[key]
+		if !ok {
+			analysis = maot.Analyze(h.Rev, code, opts)
+			cache[key] = analysis
+		}
+		in := &interp.Interpreter{Host: h, Tracer: h.Tracer}
+		return in.Execute(analysis, msg, code)
+	}}
+}
+
+// NativeConfig controls how NativeExecutor generates and builds the library
+type NativeConfig struct {
+	Options maot.Options
+	Build   maot.BuildConfig // Build.Library is ignored
+	WorkDir string           // where the C++ files and the libraries are written, a temporary directory if empty
+}
+
+// A contract and the calldata to call it with
+type Case struct {
+	Name   string
+	Rev    int
+	Code   []byte
+	Inputs [][]byte
+	Gas    int64
+}
+
+type StorageWrite struct {
+	Addr  interp.Address
+	Key   interp.Bytes32
+	Value interp.Bytes32
+}
+
+// The observable results of a call
+type Outcome struct {
+	Status  interp.StatusCode
+	GasLeft int64
+	Output  []byte
+	Writes  []StorageWrite // sorted
+	Logs    []Log
+	Err     error // the executor found an inconsistency, such as an interp.AnalysisError
+	Steps   []interp.Step
+}
+
+func failed(s interp.StatusCode) bool {
+	return s != interp.Success && s != interp.Revert
+}
+
+// describe the first difference between two outcomes, or return "" if they are the same. The
+// different kinds of exceptional halts are not distinguished: the block-wise checks of the AOT
+// path may report OutOfGas where an instruction-wise interpreter reports StackUnderflow, and
+// both consume all the gas and revert all the state changes.
+func compare(a, b *Outcome) string {
+	switch {
+	case a.Err != nil || b.Err != nil:
+		return fmt.Sprintf("error: %v vs %v", a.Err, b.Err)
+	case a.Status != b.Status && !(failed(a.Status) && failed(b.Status)):
+		return fmt.Sprintf("status: %v vs %v", a.Status, b.Status)
+	case a.GasLeft != b.GasLeft:
+		return fmt.Sprintf("gas_left: %d vs %d", a.GasLeft, b.GasLeft)
+	case !bytes.Equal(a.Output, b.Output):
+		return fmt.Sprintf("output: %x vs %x", a.Output, b.Output)
+	case len(a.Writes) != len(b.Writes):
+		return fmt.Sprintf("storage: %d writes vs %d writes", len(a.Writes), len(b.Writes))
+	case len(a.Logs) != len(b.Logs):
+		return fmt.Sprintf("logs: %d vs %d", len(a.Logs), len(b.Logs))
+	}
+	for i := range a.Writes {
+		if a.Writes[i] != b.Writes[i] {
+			return fmt.Sprintf("storage: slot %x=%x vs slot %x=%x",
+				a.Writes[i].Key, a.Writes[i].Value, b.Writes[i].Key, b.Writes[i].Value)
+		}
+	}
+	for i, la := range a.Logs {
+		lb := b.Logs[i]
+		same := la.Addr == lb.Addr && bytes.Equal(la.Data, lb.Data) && len(la.Topics) == len(lb.Topics)
+		for j := 0; same && j < len(la.Topics); j++ {
+			same = la.Topics[j] == lb.Topics[j]
+		}
+		if !same {
+			return fmt.Sprintf("log #%d differs", i)
+		}
+	}
+	return ""
+}
+
+// the storage slots whose final values differ from the initial ones
+func storageWrites(before, after map[interp.Address]*Account) []StorageWrite {
+	var writes []StorageWrite
+	for addr, acc := range after {
+		var old map[interp.Bytes32]interp.Bytes32
+		if accBefore, ok := before[addr]; ok {
+			old = accBefore.Storage
+		}
+		for k, v := range acc.Storage {
+			if old[k] != v {
+				writes = append(writes, StorageWrite{addr, k, v})
+			}
+		}
+		for k := range old {
+			if _, ok := acc.Storage[k]; !ok {
+				writes = append(writes, StorageWrite{Addr: addr, Key: k})
+			}
+		}
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		if c := bytes.Compare(writes[i].Addr[:], writes[j].Addr[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(writes[i].Key[:], writes[j].Key[:]) < 0
+	})
+	return writes
+}
+
+// run a case with calldata in a fresh world state
+func runCase(exec *Executor, c *Case, input []byte, maxSteps int) *Outcome {
+	h := NewMockHost(c.Rev, exec)
+	h.SetCode(ContractAddr, c.Code)
+	h.account(CallerAddr).Balance.SetUint64(1e18)
+	h.Tx.Origin = CallerAddr
+	h.beginTx(CallerAddr, ContractAddr)
+	out := &Outcome{}
+	if maxSteps > 0 {
+		h.Tracer = func(step *interp.Step) {
+			if len(out.Steps) < maxSteps {
+				out.Steps = append(out.Steps, *step)
+			}
+		}
+	}
+	before := h.snapshot().accounts
+	res := h.Call(&interp.Message{Kind: interp.Call, Gas: c.Gas, Destination: ContractAddr, Sender: CallerAddr, Input: input})
+	out.Status, out.GasLeft, out.Output, out.Err = res.Status, res.GasLeft, res.Output, h.Err
+	out.Writes = storageWrites(before, h.Accounts)
+	out.Logs = h.Logs
+	return out
+}
+
+// Where the traces of two executions diverge
+type Divergence struct {
+	Index     int          // the index of the first different step
+	Reference *interp.Step // nil if the reference's trace ends earlier
+	Target    *interp.Step // nil if the target's trace ends earlier
+}
+
+func sameStep(a, b *interp.Step) bool {
+	if a.PC != b.PC || a.Op != b.Op || a.GasLeft != b.GasLeft || a.Depth != b.Depth || len(a.Stack) != len(b.Stack) {
+		return false
+	}
+	for i := range a.Stack {
+		if a.Stack[i] != b.Stack[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func diverge(ref, target []interp.Step) *Divergence {
+	for i := 0; i < len(ref) || i < len(target); i++ {
+		d := &Divergence{Index: i}
+		if i < len(ref) {
+			d.Reference = &ref[i]
+		}
+		if i < len(target) {
+			d.Target = &target[i]
+		}
+		if d.Reference == nil || d.Target == nil || !sameStep(d.Reference, d.Target) {
+			return d
+		}
+	}
+	return nil
+}
+
+type Mismatch struct {
+	Case          string
+	Input         []byte // the minimized calldata
+	OriginalInput []byte
+	Diff          string
+	Reference     *Outcome
+	Target        *Outcome
+	Divergence    *Divergence
+}
+
+func printStep(w io.Writer, name string, step *interp.Step) {
+	if step == nil {
+		fmt.Fprintf(w, "    %-9s (ended)\n", name)
+		return
+	}
+	top := "-"
+	if n := len(step.Stack); n != 0 {
+		top = "0x" + step.Stack[n-1].Big().Text(16)
+	}
+	fmt.Fprintf(w, "    %-9s pc=%d op=%s gas=%d depth=%d stack=%d items, top=%s\n",
+		name, step.PC, step.OpName(), step.GasLeft, step.Depth, len(step.Stack), top)
+}
+
+func (m *Mismatch) Print(w io.Writer, targetName string) {
+	fmt.Fprintf(w, "MISMATCH %s: %s\n", m.Case, m.Diff)
+	fmt.Fprintf(w, "  calldata:  0x%s\n", hex.EncodeToString(m.Input))
+	if !bytes.Equal(m.Input, m.OriginalInput) {
+		fmt.Fprintf(w, "  minimized from 0x%s\n", hex.EncodeToString(m.OriginalInput))
+	}
+	if d := m.Divergence; d != nil {
+		fmt.Fprintf(w, "  traces diverge at step %d:\n", d.Index)
+		printStep(w, "reference", d.Reference)
+		printStep(w, targetName, d.Target)
+	}
+}
+
+type Harness struct {
+	Reference *Executor
+	Target    *Executor
+	Fuzz      int   // the number of random calldata tried for each case, besides Case.Inputs
+	Seed      int64 // for generating random calldata
+	MaxSteps  int   // at most so many steps of a trace are recorded when looking for divergence
+}
+
+func NewHarness(opts maot.Options) *Harness {
+	return &Harness{
+		Reference: ReferenceExecutor(),
+		Target:    AOTExecutor(opts),
+		Fuzz:      64,
+		Seed:      1,
+		MaxSteps:  1 << 20,
+	}
+}
+
+// Run a case with its inputs and some random ones, returning the number of runs and the mismatches
+func (h *Harness) Run(c Case) (int, []Mismatch) {
+	if c.Gas == 0 {
+		c.Gas = 1000000
+	}
+	inputs := append([][]byte(nil), c.Inputs...)
+	rnd := rand.New(rand.NewSource(h.Seed))
+	selectors := Selectors(c.Code)
+	for i := 0; i < h.Fuzz; i++ {
+		inputs = append(inputs, randomCalldata(rnd, selectors))
+	}
+	var mismatches []Mismatch
+	seen := make(map[string]bool) // report each kind of difference once per case
+	for _, input := range inputs {
+		ref, target := runCase(h.Reference, &c, input, 0), runCase(h.Target, &c, input, 0)
+		diff := compare(ref, target)
+		if len(diff) == 0 {
+			continue
+		}
+		m := Mismatch{Case: c.Name, OriginalInput: input, Diff: diff}
+		m.Input = minimize(input, func(in []byte) bool {
+			return len(compare(runCase(h.Reference, &c, in, 0), runCase(h.Target, &c, in, 0))) != 0
+		})
+		m.Reference, m.Target = runCase(h.Reference, &c, m.Input, h.MaxSteps), runCase(h.Target, &c, m.Input, h.MaxSteps)
+		m.Diff = compare(m.Reference, m.Target)
+		m.Divergence = diverge(m.Reference.Steps, m.Target.Steps)
+		key := m.Diff
+		if m.Divergence != nil && m.Divergence.Reference != nil {
+			key = fmt.Sprint(m.Divergence.Reference.PC)
+		}
+		if !seen[key] {
+			seen[key] = true
+			mismatches = append(mismatches, m)
+		}
+	}
+	return len(inputs), mismatches
+}
+
+// the 4-byte function selectors found in the dispatcher of a solc contract: PUSH4 <selector> EQ
+func Selectors(code []byte) [][]byte {
+	var res [][]byte
+	for pc := 0; pc < len(code); pc++ {
+		op := code[pc]
+		if op == maot.OP_PUSH4 && pc+5 < len(code) && code[pc+5] == maot.OP_EQ {
+			res = append(res, code[pc+1:pc+5])
+		}
+		if maot.OP_PUSH1 <= op && op <= maot.OP_PUSH32 {
+			pc += int(op-maot.OP_PUSH1) + 1
+		}
+	}
+	return res
+}
+
+var interestingWords = []*big.Int{
+	big.NewInt(0), big.NewInt(1), big.NewInt(2), big.NewInt(3), big.NewInt(31), big.NewInt(32),
+	big.NewInt(144), big.NewInt(255), big.NewInt(256), big.NewInt(1 << 32),
+	new(big.Int).Lsh(big.NewInt(1), 255),
+	new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)),
+}
+
+func randomWord(rnd *rand.Rand) []byte {
+	var w [32]byte
+	switch rnd.Intn(4) {
+	case 0:
+		interestingWords[rnd.Intn(len(interestingWords))].FillBytes(w[:])
+	case 1:
+		w[31] = byte(rnd.Intn(256))
+	case 2:
+		rnd.Read(w[24:])
+	default:
+		rnd.Read(w[:])
+	}
+	return w[:]
+}
+
+// a selector followed by a few words, and sometimes a few more random bytes
+func randomCalldata(rnd *rand.Rand, selectors [][]byte) []byte {
+	var res []byte
+	if len(selectors) != 0 && rnd.Intn(8) != 0 {
+		res = append(res, selectors[rnd.Intn(len(selectors))]...)
+	}
+	for n := rnd.Intn(4); n > 0; n-- {
+		res = append(res, randomWord(rnd)...)
+	}
+	if rnd.Intn(8) == 0 {
+		tail := make([]byte, rnd.Intn(40))
+		rnd.Read(tail)
+		res = append(res, tail...)
+	}
+	return res
+}
+
+// shrink the calldata while fails(calldata) still holds: drop the trailing bytes, then make the
+// words after the selector smaller
+func minimize(input []byte, fails func([]byte) bool) []byte {
+	cur := append([]byte(nil), input...)
+	budget := 2000 // at most so many calls to fails
+	try := func(cand []byte) bool {
+		if budget <= 0 {
+			return false
+		}
+		budget--
+		if fails(cand) {
+			cur = cand
+			return true
+		}
+		return false
+	}
+	for progress := true; progress && budget > 0; {
+		progress = false
+		for _, n := range []int{32, 1} {
+			for len(cur) >= n && try(append([]byte(nil), cur[:len(cur)-n]...)) {
+				progress = true
+			}
+		}
+		for off := 4; off < len(cur); off += 32 {
+			end := off + 32
+			if end > len(cur) {
+				end = len(cur)
+			}
+			word := new(big.Int).SetBytes(cur[off:end])
+			for word.Sign() != 0 {
+				smaller := []*big.Int{new(big.Int), new(big.Int).Rsh(word, 1), new(big.Int).Sub(word, big.NewInt(1))}
+				shrunk := false
+				for _, v := range smaller {
+					cand := append([]byte(nil), cur...)
+					v.FillBytes(cand[off:end])
+					if try(cand) {
+						word, shrunk, progress = v, true, true
+						break
+					}
+				}
+				if !shrunk {
+					break
+				}
+			}
+		}
+	}
+	return cur
+}
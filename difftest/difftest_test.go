@@ -0,0 +1,56 @@
+package difftest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+var testRevisions = []int{maot.EVMC_PETERSBURG, maot.EVMC_ISTANBUL, maot.EVMC_LONDON, maot.EVMC_CANCUN}
+
+// run the snippets and babylon through h, reporting each mismatch as an error
+func runCorpus(t *testing.T, h *Harness, rev int) {
+	cases := append(Snippets(rev), Case{Name: "babylon", Rev: rev, Code: Babylon()})
+	for _, c := range cases {
+		_, mismatches := h.Run(c)
+		for _, m := range mismatches {
+			var sb strings.Builder
+			m.Print(&sb, h.Target.Name)
+			t.Errorf("%s: %s", maot.RevisionNames[rev], sb.String())
+		}
+	}
+}
+
+func TestAOTExecutor(t *testing.T) {
+	plain := maot.DefaultOptions()
+	plain.Fusion, plain.StackHeights, plain.MergeBlocks = false, false, false
+	for _, opts := range []maot.Options{maot.DefaultOptions(), plain} {
+		for _, rev := range testRevisions {
+			h := NewHarness(opts)
+			h.Fuzz = 16
+			runCorpus(t, h, rev)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	var got []string
+	for _, sel := range Selectors(Babylon()) {
+		got = append(got, string(sel))
+	}
+	if want := []string{"\x65\x37\x21\x47", "\x67\x73\x42\xce"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Selectors=%q, want %q", got, want)
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	input := append([]byte{1, 2, 3, 4}, words(0x1234, 7)...)
+	// fails as long as the first word after the selector is not zero
+	got := minimize(input, func(in []byte) bool {
+		return len(in) >= 36 && strings.Trim(string(in[4:36]), "\x00") != ""
+	})
+	if want := append([]byte{1, 2, 3, 4}, word(1)...); string(got) != string(want) {
+		t.Errorf("minimize=%x, want %x", got, want)
+	}
+}
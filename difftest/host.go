@@ -0,0 +1,352 @@
+package difftest
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/interp"
+	"github.com/smartbch/moeingaot/keccak"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+type Account struct {
+	Balance *big.Int
+	Code    []byte
+	Storage map[interp.Bytes32]interp.Bytes32
+}
+
+func (acc *Account) clone() *Account {
+	res := &Account{Balance: new(big.Int).Set(acc.Balance), Code: acc.Code}
+	res.Storage = make(map[interp.Bytes32]interp.Bytes32, len(acc.Storage))
+	for k, v := range acc.Storage {
+		res.Storage[k] = v
+	}
+	return res
+}
+
+type Log struct {
+	Addr   interp.Address
+	Topics []interp.Bytes32
+	Data   []byte
+}
+
+type slotKey struct {
+	addr interp.Address
+	key  interp.Bytes32
+}
+
+// MockHost is an in-memory world state for one transaction. The state changes of a failed call
+// are reverted, and the called contracts are run by Executor, just like the top-level one.
+type MockHost struct {
+	Rev      int
+	Accounts map[interp.Address]*Account
+	Tx       interp.TxContext
+	Logs     []Log
+	Executor *Executor
+	Tracer   interp.Tracer // passed to Executor for all the call frames
+	Err      error         // the first error returned by Executor
+
+	warmAccounts map[interp.Address]bool
+	warmSlots    map[slotKey]bool
+	dirty        map[slotKey]bool
+	transient    map[slotKey]interp.Bytes32
+	createNonce  uint64
+	contexts     []interp.Address // the accounts whose storage are used by the running call frames
+}
+
+func NewMockHost(rev int, executor *Executor) *MockHost {
+	return &MockHost{
+		Rev:      rev,
+		Accounts: make(map[interp.Address]*Account),
+		Tx: interp.TxContext{
+			Number:    1000000,
+			Timestamp: 1600000000,
+			GasLimit:  30000000,
+		},
+		Executor:     executor,
+		warmAccounts: make(map[interp.Address]bool),
+		warmSlots:    make(map[slotKey]bool),
+		dirty:        make(map[slotKey]bool),
+		transient:    make(map[slotKey]interp.Bytes32),
+	}
+}
+
+// the account at addr, which is created when missing
+func (h *MockHost) account(addr interp.Address) *Account {
+	acc, ok := h.Accounts[addr]
+	if !ok {
+		acc = &Account{Balance: new(big.Int), Storage: make(map[interp.Bytes32]interp.Bytes32)}
+		h.Accounts[addr] = acc
+	}
+	return acc
+}
+
+// SetCode deploys code at addr
+func (h *MockHost) SetCode(addr interp.Address, code []byte) {
+	h.account(addr).Code = code
+}
+
+func (h *MockHost) AccountExists(addr interp.Address) bool {
+	_, ok := h.Accounts[addr]
+	return ok
+}
+
+func (h *MockHost) GetStorage(addr interp.Address, key interp.Bytes32) interp.Bytes32 {
+	if acc, ok := h.Accounts[addr]; ok {
+		return acc.Storage[key]
+	}
+	return interp.Bytes32{}
+}
+
+// the same rules as the example host of EVMC
+func (h *MockHost) SetStorage(addr interp.Address, key, value interp.Bytes32) interp.StorageStatus {
+	acc := h.account(addr)
+	old := acc.Storage[key]
+	if old == value {
+		return interp.StorageUnchanged
+	}
+	status := interp.StorageModifiedAgain
+	if sk := (slotKey{addr, key}); !h.dirty[sk] {
+		h.dirty[sk] = true
+		switch {
+		case old == (interp.Bytes32{}):
+			status = interp.StorageAdded
+		case value != (interp.Bytes32{}):
+			status = interp.StorageModified
+		default:
+			status = interp.StorageDeleted
+		}
+	}
+	if value == (interp.Bytes32{}) {
+		delete(acc.Storage, key)
+	} else {
+		acc.Storage[key] = value
+	}
+	return status
+}
+
+func (h *MockHost) GetBalance(addr interp.Address) (b interp.Bytes32) {
+	if acc, ok := h.Accounts[addr]; ok {
+		acc.Balance.FillBytes(b[:])
+	}
+	return
+}
+
+func (h *MockHost) GetCodeSize(addr interp.Address) int {
+	if acc, ok := h.Accounts[addr]; ok {
+		return len(acc.Code)
+	}
+	return 0
+}
+
+func (h *MockHost) GetCodeHash(addr interp.Address) interp.Bytes32 {
+	if acc, ok := h.Accounts[addr]; ok {
+		return keccak.Sum256(acc.Code)
+	}
+	return interp.Bytes32{}
+}
+
+func (h *MockHost) CopyCode(addr interp.Address, offset int, buf []byte) int {
+	acc, ok := h.Accounts[addr]
+	if !ok || offset >= len(acc.Code) {
+		return 0
+	}
+	return copy(buf, acc.Code[offset:])
+}
+
+func (h *MockHost) Selfdestruct(addr, beneficiary interp.Address) {
+	acc := h.account(addr)
+	h.account(beneficiary).Balance.Add(h.account(beneficiary).Balance, acc.Balance)
+	delete(h.Accounts, addr)
+}
+
+func (h *MockHost) GetTxContext() interp.TxContext {
+	return h.Tx
+}
+
+func (h *MockHost) GetBlockHash(number int64) interp.Bytes32 {
+	var bz [8]byte
+	binary.BigEndian.PutUint64(bz[:], uint64(number))
+	return keccak.Sum256(bz[:])
+}
+
+func (h *MockHost) EmitLog(addr interp.Address, data []byte, topics []interp.Bytes32) {
+	h.Logs = append(h.Logs, Log{Addr: addr, Topics: topics, Data: data})
+}
+
+func (h *MockHost) AccessAccount(addr interp.Address) interp.AccessStatus {
+	if h.warmAccounts[addr] {
+		return interp.AccessWarm
+	}
+	h.warmAccounts[addr] = true
+	return interp.AccessCold
+}
+
+func (h *MockHost) AccessStorage(addr interp.Address, key interp.Bytes32) interp.AccessStatus {
+	sk := slotKey{addr, key}
+	if h.warmSlots[sk] {
+		return interp.AccessWarm
+	}
+	h.warmSlots[sk] = true
+	return interp.AccessCold
+}
+
+func (h *MockHost) GetTransientStorage(addr interp.Address, key interp.Bytes32) interp.Bytes32 {
+	return h.transient[slotKey{addr, key}]
+}
+
+func (h *MockHost) SetTransientStorage(addr interp.Address, key, value interp.Bytes32) {
+	h.transient[slotKey{addr, key}] = value
+}
+
+type snapshot struct {
+	accounts     map[interp.Address]*Account
+	transient    map[slotKey]interp.Bytes32
+	warmAccounts map[interp.Address]bool
+	warmSlots    map[slotKey]bool
+	dirty        map[slotKey]bool
+	numLogs      int
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	res := make(map[K]V, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+func (h *MockHost) snapshot() snapshot {
+	s := snapshot{
+		accounts:     make(map[interp.Address]*Account, len(h.Accounts)),
+		transient:    copyMap(h.transient),
+		warmAccounts: copyMap(h.warmAccounts),
+		warmSlots:    copyMap(h.warmSlots),
+		dirty:        copyMap(h.dirty),
+		numLogs:      len(h.Logs),
+	}
+	for addr, acc := range h.Accounts {
+		s.accounts[addr] = acc.clone()
+	}
+	return s
+}
+
+func (h *MockHost) revert(s snapshot) {
+	h.Accounts = s.accounts
+	h.transient = s.transient
+	h.warmAccounts = s.warmAccounts
+	h.warmSlots = s.warmSlots
+	h.dirty = s.dirty
+	h.Logs = h.Logs[:s.numLogs]
+}
+
+// transfer value, returning false if the balance is not enough
+func (h *MockHost) transfer(from, to interp.Address, value *big.Int) bool {
+	if value.Sign() == 0 {
+		return true
+	}
+	src := h.account(from)
+	if src.Balance.Cmp(value) < 0 {
+		return false
+	}
+	src.Balance.Sub(src.Balance, value)
+	dst := h.account(to)
+	dst.Balance.Add(dst.Balance, value)
+	return true
+}
+
+// the address of a new contract, which only needs to be deterministic in tests
+func (h *MockHost) newAddress(msg *interp.Message) (addr interp.Address) {
+	var bz []byte
+	bz = append(bz, msg.Sender[:]...)
+	if msg.Kind == interp.Create2 {
+		bz = append(bz, msg.Create2Salt[:]...)
+		hash := keccak.Sum256(msg.Input)
+		bz = append(bz, hash[:]...)
+	} else {
+		h.createNonce++
+		var nonce [8]byte
+		binary.BigEndian.PutUint64(nonce[:], h.createNonce)
+		bz = append(bz, nonce[:]...)
+	}
+	hash := keccak.Sum256(bz)
+	copy(addr[:], hash[12:])
+	return
+}
+
+// Call runs a message with Executor, and reverts its state changes if it fails
+func (h *MockHost) Call(msg *interp.Message) interp.Result {
+	s := h.snapshot()
+	value := msg.Value.Big()
+	var code []byte
+	if acc, ok := h.Accounts[msg.Destination]; ok {
+		code = acc.Code
+	}
+	var createAddr interp.Address
+	switch msg.Kind {
+	case interp.Call:
+		if !h.transfer(msg.Sender, msg.Destination, value) {
+			return interp.Result{Status: interp.Failure, GasLeft: msg.Gas}
+		}
+	case interp.Create, interp.Create2:
+		createAddr = h.newAddress(msg)
+		if acc, ok := h.Accounts[createAddr]; ok && len(acc.Code) != 0 {
+			return interp.Result{Status: interp.Failure}
+		}
+		if !h.transfer(msg.Sender, createAddr, value) {
+			return interp.Result{Status: interp.Failure, GasLeft: msg.Gas}
+		}
+		h.warmAccounts[createAddr] = true
+		h.account(createAddr)
+		code = msg.Input
+		msg = &interp.Message{Kind: msg.Kind, Depth: msg.Depth, Gas: msg.Gas,
+			Destination: createAddr, Sender: msg.Sender, Value: msg.Value}
+	case interp.CallCode:
+		msg = &interp.Message{Kind: msg.Kind, Static: msg.Static, Depth: msg.Depth, Gas: msg.Gas,
+			Destination: msg.Sender, Sender: msg.Sender, Input: msg.Input, Value: msg.Value}
+	case interp.DelegateCall: // run the code at Destination in the context of the caller
+		msg = &interp.Message{Kind: msg.Kind, Static: msg.Static, Depth: msg.Depth, Gas: msg.Gas,
+			Destination: h.contexts[len(h.contexts)-1], Sender: msg.Sender, Input: msg.Input, Value: msg.Value}
+	}
+	h.contexts = append(h.contexts, msg.Destination)
+	defer func() { h.contexts = h.contexts[:len(h.contexts)-1] }()
+	var res interp.Result
+	if len(code) == 0 {
+		res = interp.Result{Status: interp.Success, GasLeft: msg.Gas}
+	} else {
+		var err error
+		res, err = h.Executor.Run(h, msg, code)
+		if err != nil && h.Err == nil {
+			h.Err = err
+		}
+	}
+	if res.Status == interp.Success && createAddr != (interp.Address{}) {
+		deposit := int64(len(res.Output)) * 200
+		if deposit > res.GasLeft {
+			res = interp.Result{Status: interp.OutOfGas}
+		} else {
+			res.GasLeft -= deposit
+			h.SetCode(createAddr, res.Output)
+			res.CreateAddress = createAddr
+			res.Output = nil
+		}
+	}
+	if res.Status != interp.Success {
+		h.revert(s)
+	}
+	return res
+}
+
+// the warm accounts at the beginning of a transaction, see EIP-2929
+func (h *MockHost) beginTx(origin, destination interp.Address) {
+	h.warmAccounts[origin] = true
+	h.warmAccounts[destination] = true
+	for i := 1; i <= 9; i++ { // the precompiled contracts
+		var addr interp.Address
+		addr[19] = byte(i)
+		h.warmAccounts[addr] = true
+	}
+	if h.Rev >= maot.EVMC_SHANGHAI { // EIP-3651
+		h.warmAccounts[h.Tx.Coinbase] = true
+	}
+}
@@ -0,0 +1,379 @@
+//go:build evmaot
+
+package difftest
+
+// The native executor needs cgo, the EVMC 11 headers and evmone, so it is only built with the evmaot
+// tag, for example:
+//
+//	CGO_CFLAGS="-I $MOEINGEVM/evmwrap/evmc/include" go test -tags evmaot ./difftest
+//
+// where BuildConfig.LinkFlags (EVMAOT_LDFLAGS for the tests) must link evmone's instructions into the
+// library. Without the tag, NativeExecutor always returns an error.
+
+/*
+#cgo LDFLAGS: -ldl
+#include <stdint.h>
+#include <stdlib.h>
+#include <evmc/evmc.h>
+
+void* difftest_open(const char* fname, char** err);
+void* difftest_symbol(void* lib, const char* name);
+void* difftest_query(void* query_fn, const evmc_bytes32* code_hash);
+struct evmc_result difftest_execute(void* fn, uintptr_t ctx, enum evmc_revision rev,
+	const struct evmc_message* msg, const uint8_t* code, size_t code_size);
+void difftest_release(const struct evmc_result* res);
+*/
+import "C"
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"runtime/cgo"
+	"unsafe"
+
+	"github.com/smartbch/moeingaot/interp"
+	"github.com/smartbch/moeingaot/keccak"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// the contracts compiled into the loaded library, and the library
+type nativeLibrary struct {
+	cfg     NativeConfig
+	dir     string
+	codes   map[string]bool // the bytecodes as strings
+	revs    map[int]bool
+	count   int            // how many libraries have been built, each with a new name for dlopen
+	query   unsafe.Pointer // query_executor_by_codehash of the latest library
+	entries map[[32]byte]unsafe.Pointer
+}
+
+// NativeExecutor compiles the bytecodes it is asked to run with AotCompileContracts and Build, loads
+// the library, and runs the generated executors with MockHost behind an evmc_host_interface. The
+// library is built again each time a new bytecode or revision is seen. It fails at once if the
+// library can not be built without any contract, so a broken toolchain is not reported as mismatches.
+func NativeExecutor(cfg NativeConfig) (*Executor, error) {
+	lib := &nativeLibrary{cfg: cfg, dir: cfg.WorkDir, codes: make(map[string]bool), revs: make(map[int]bool),
+		entries: make(map[[32]byte]unsafe.Pointer)}
+	if len(lib.dir) == 0 {
+		dir, err := os.MkdirTemp("", "difftest-native-")
+		if err != nil {
+			return nil, err
+		}
+		lib.dir = dir
+	}
+	if err := lib.rebuild(); err != nil {
+		return nil, err
+	}
+	return &Executor{Name: "native", Run: lib.run}, nil
+}
+
+// generate and build the library with all the bytecodes and revisions seen so far, and load it
+func (lib *nativeLibrary) rebuild() error {
+	revs := make([]int, 0, len(lib.revs))
+	for rev := range lib.revs {
+		revs = append(revs, rev)
+	}
+	if len(revs) == 0 {
+		revs = append(revs, maot.EVMC_ISTANBUL)
+	}
+	inputs := make([]maot.ContractInput, 0, len(lib.codes))
+	for code := range lib.codes {
+		hash := keccak.Sum256([]byte(code))
+		inputs = append(inputs, maot.ContractInput{Addr: hex.EncodeToString(hash[:20]), Code: []byte(code),
+			Source: "difftest"})
+	}
+	if _, err := maot.AotCompileContracts(revs, inputs, lib.dir, lib.cfg.Options); err != nil {
+		return err
+	}
+	lib.count++
+	build := lib.cfg.Build
+	build.Library = fmt.Sprintf("libdifftest%d.so", lib.count)
+	if result, err := maot.Build(lib.dir, build); err != nil {
+		if result != nil {
+			for _, obj := range result.Failures() {
+				err = fmt.Errorf("%w\n%s: %v\n%s", err, obj.Source, obj.Err, obj.Output)
+			}
+		}
+		return err
+	}
+	fname := C.CString(path.Join(lib.dir, build.Library))
+	defer C.free(unsafe.Pointer(fname))
+	var cerr *C.char
+	handle := C.difftest_open(fname, &cerr)
+	if handle == nil {
+		return fmt.Errorf("can not load %s: %s", path.Join(lib.dir, build.Library), C.GoString(cerr))
+	}
+	symbol := "query_executor_by_codehash"
+	if len(lib.cfg.Options.LibID) != 0 {
+		symbol += "_" + lib.cfg.Options.LibID
+	}
+	csymbol := C.CString(symbol)
+	defer C.free(unsafe.Pointer(csymbol))
+	if lib.query = C.difftest_symbol(handle, csymbol); lib.query == nil {
+		return fmt.Errorf("%s is not found in %s", symbol, build.Library)
+	}
+	lib.entries = make(map[[32]byte]unsafe.Pointer)
+	return nil
+}
+
+// the execute function compiled from code, building it for rev if needed
+func (lib *nativeLibrary) executor(rev int, code []byte) (unsafe.Pointer, error) {
+	if !lib.codes[string(code)] || !lib.revs[rev] {
+		lib.codes[string(code)] = true
+		lib.revs[rev] = true
+		if err := lib.rebuild(); err != nil {
+			return nil, err
+		}
+	}
+	hash := keccak.Sum256(code)
+	if fn, ok := lib.entries[hash]; ok {
+		return fn, nil
+	}
+	chash := (*C.evmc_bytes32)(C.malloc(C.sizeof_evmc_bytes32))
+	defer C.free(unsafe.Pointer(chash))
+	*chash = toCBytes32(hash)
+	fn := C.difftest_query(lib.query, chash)
+	if fn == nil {
+		return nil, fmt.Errorf("no executor for the code hash %x", hash)
+	}
+	lib.entries[hash] = fn
+	return fn, nil
+}
+
+// the state of a call to the library, which the host callbacks find through a cgo.Handle
+type nativeCall struct {
+	host  *MockHost
+	alloc []unsafe.Pointer // the C memory to free after the call
+}
+
+func (lib *nativeLibrary) run(h *MockHost, msg *interp.Message, code []byte) (interp.Result, error) {
+	fn, err := lib.executor(h.Rev, code)
+	if err != nil {
+		return interp.Result{Status: interp.Failure}, err
+	}
+	call := &nativeCall{host: h}
+	handle := cgo.NewHandle(call)
+	defer func() {
+		handle.Delete()
+		for _, p := range call.alloc {
+			C.free(p)
+		}
+	}()
+	cmsg := (*C.struct_evmc_message)(call.malloc(C.sizeof_struct_evmc_message))
+	*cmsg = C.struct_evmc_message{
+		kind:         C.enum_evmc_call_kind(msg.Kind),
+		depth:        C.int32_t(msg.Depth),
+		gas:          C.int64_t(msg.Gas),
+		recipient:    toCAddress(msg.Destination),
+		sender:       toCAddress(msg.Sender),
+		input_data:   (*C.uint8_t)(call.bytes(msg.Input)),
+		input_size:   C.size_t(len(msg.Input)),
+		value:        toCBytes32(msg.Value),
+		create2_salt: toCBytes32(msg.Create2Salt),
+		code_address: toCAddress(msg.Destination),
+	}
+	if msg.Static {
+		cmsg.flags = C.EVMC_STATIC
+	}
+	ccode := call.bytes(code)
+	res := C.difftest_execute(fn, C.uintptr_t(handle), C.enum_evmc_revision(h.Rev), cmsg, (*C.uint8_t)(ccode),
+		C.size_t(len(code)))
+	result := interp.Result{Status: interp.StatusCode(res.status_code), GasLeft: int64(res.gas_left),
+		CreateAddress: fromCAddress(&res.create_address)}
+	if res.output_size != 0 {
+		result.Output = C.GoBytes(unsafe.Pointer(res.output_data), C.int(res.output_size))
+	}
+	if res.release != nil {
+		C.difftest_release(&res)
+	}
+	if result.Status < interp.Success || result.Status > interp.StaticModeViolation {
+		return interp.Result{Status: interp.Failure}, fmt.Errorf("the native executor returns status %d", result.Status)
+	}
+	return result, nil
+}
+
+func (call *nativeCall) malloc(size C.size_t) unsafe.Pointer {
+	p := C.malloc(size)
+	call.alloc = append(call.alloc, p)
+	return p
+}
+
+// a copy of b in C memory, which lives until the end of the call
+func (call *nativeCall) bytes(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	p := C.CBytes(b)
+	call.alloc = append(call.alloc, p)
+	return p
+}
+
+func toCAddress(a interp.Address) (res C.evmc_address) {
+	for i, b := range a {
+		res.bytes[i] = C.uint8_t(b)
+	}
+	return
+}
+
+func fromCAddress(a *C.evmc_address) (res interp.Address) {
+	for i := range res {
+		res[i] = byte(a.bytes[i])
+	}
+	return
+}
+
+func toCBytes32(b [32]byte) (res C.evmc_bytes32) {
+	for i, x := range b {
+		res.bytes[i] = C.uint8_t(x)
+	}
+	return
+}
+
+func fromCBytes32(b *C.evmc_bytes32) (res interp.Bytes32) {
+	for i := range res {
+		res[i] = byte(b.bytes[i])
+	}
+	return
+}
+
+func callOf(ctx C.uintptr_t) *nativeCall {
+	return cgo.Handle(ctx).Value().(*nativeCall)
+}
+
+//export difftestAccountExists
+func difftestAccountExists(ctx C.uintptr_t, addr *C.evmc_address) C.bool {
+	return C.bool(callOf(ctx).host.AccountExists(fromCAddress(addr)))
+}
+
+//export difftestGetStorage
+func difftestGetStorage(ctx C.uintptr_t, addr *C.evmc_address, key *C.evmc_bytes32, out *C.evmc_bytes32) {
+	*out = toCBytes32(callOf(ctx).host.GetStorage(fromCAddress(addr), fromCBytes32(key)))
+}
+
+//export difftestSetStorage
+func difftestSetStorage(ctx C.uintptr_t, addr *C.evmc_address, key, value *C.evmc_bytes32) C.int {
+	return C.int(callOf(ctx).host.SetStorage(fromCAddress(addr), fromCBytes32(key), fromCBytes32(value)))
+}
+
+//export difftestGetBalance
+func difftestGetBalance(ctx C.uintptr_t, addr *C.evmc_address, out *C.evmc_bytes32) {
+	*out = toCBytes32(callOf(ctx).host.GetBalance(fromCAddress(addr)))
+}
+
+//export difftestGetCodeSize
+func difftestGetCodeSize(ctx C.uintptr_t, addr *C.evmc_address) C.size_t {
+	return C.size_t(callOf(ctx).host.GetCodeSize(fromCAddress(addr)))
+}
+
+//export difftestGetCodeHash
+func difftestGetCodeHash(ctx C.uintptr_t, addr *C.evmc_address, out *C.evmc_bytes32) {
+	*out = toCBytes32(callOf(ctx).host.GetCodeHash(fromCAddress(addr)))
+}
+
+//export difftestCopyCode
+func difftestCopyCode(ctx C.uintptr_t, addr *C.evmc_address, offset C.size_t, buf *C.uint8_t, size C.size_t) C.size_t {
+	if size == 0 {
+		return 0
+	}
+	return C.size_t(callOf(ctx).host.CopyCode(fromCAddress(addr), int(offset), unsafe.Slice((*byte)(buf), int(size))))
+}
+
+//export difftestSelfdestruct
+func difftestSelfdestruct(ctx C.uintptr_t, addr, beneficiary *C.evmc_address) {
+	callOf(ctx).host.Selfdestruct(fromCAddress(addr), fromCAddress(beneficiary))
+}
+
+//export difftestCall
+func difftestCall(ctx C.uintptr_t, cmsg *C.struct_evmc_message, out *C.struct_evmc_result) {
+	msg := &interp.Message{
+		Kind:        interp.CallKind(cmsg.kind),
+		Static:      cmsg.flags&C.EVMC_STATIC != 0,
+		Depth:       int(cmsg.depth),
+		Gas:         int64(cmsg.gas),
+		Destination: fromCAddress(&cmsg.code_address), // MockHost finds the recipient itself
+		Sender:      fromCAddress(&cmsg.sender),
+		Value:       fromCBytes32(&cmsg.value),
+		Create2Salt: fromCBytes32(&cmsg.create2_salt),
+	}
+	if cmsg.input_size != 0 {
+		msg.Input = C.GoBytes(unsafe.Pointer(cmsg.input_data), C.int(cmsg.input_size))
+	}
+	res := callOf(ctx).host.Call(msg)
+	out.status_code = C.enum_evmc_status_code(res.Status)
+	out.gas_left = C.int64_t(res.GasLeft)
+	out.create_address = toCAddress(res.CreateAddress)
+	if len(res.Output) != 0 { // freed by the release function of the result
+		out.output_data = (*C.uint8_t)(C.CBytes(res.Output))
+		out.output_size = C.size_t(len(res.Output))
+	}
+}
+
+//export difftestGetTxContext
+func difftestGetTxContext(ctx C.uintptr_t, out *C.struct_evmc_tx_context) {
+	call := callOf(ctx)
+	tx := call.host.GetTxContext()
+	*out = C.struct_evmc_tx_context{
+		tx_gas_price:      toCBytes32(tx.GasPrice),
+		tx_origin:         toCAddress(tx.Origin),
+		block_coinbase:    toCAddress(tx.Coinbase),
+		block_number:      C.int64_t(tx.Number),
+		block_timestamp:   C.int64_t(tx.Timestamp),
+		block_gas_limit:   C.int64_t(tx.GasLimit),
+		block_prev_randao: toCBytes32(tx.Difficulty),
+		chain_id:          toCBytes32(tx.ChainID),
+		block_base_fee:    toCBytes32(tx.BaseFee),
+		blob_base_fee:     toCBytes32(tx.BlobBaseFee),
+		blob_hashes_count: C.size_t(len(tx.BlobHashes)),
+	}
+	if len(tx.BlobHashes) != 0 {
+		hashes := (*C.evmc_bytes32)(call.malloc(C.size_t(len(tx.BlobHashes)) * C.sizeof_evmc_bytes32))
+		dst := unsafe.Slice(hashes, len(tx.BlobHashes))
+		for i, hash := range tx.BlobHashes {
+			dst[i] = toCBytes32(hash)
+		}
+		out.blob_hashes = hashes
+	}
+}
+
+//export difftestGetBlockHash
+func difftestGetBlockHash(ctx C.uintptr_t, number C.int64_t, out *C.evmc_bytes32) {
+	*out = toCBytes32(callOf(ctx).host.GetBlockHash(int64(number)))
+}
+
+//export difftestEmitLog
+func difftestEmitLog(ctx C.uintptr_t, addr *C.evmc_address, data *C.uint8_t, size C.size_t,
+	topics *C.evmc_bytes32, numTopics C.size_t) {
+	var goData []byte
+	if size != 0 {
+		goData = C.GoBytes(unsafe.Pointer(data), C.int(size))
+	}
+	goTopics := make([]interp.Bytes32, int(numTopics))
+	if numTopics != 0 {
+		for i := range goTopics {
+			goTopics[i] = fromCBytes32(&unsafe.Slice(topics, int(numTopics))[i])
+		}
+	}
+	callOf(ctx).host.EmitLog(fromCAddress(addr), goData, goTopics)
+}
+
+//export difftestAccessAccount
+func difftestAccessAccount(ctx C.uintptr_t, addr *C.evmc_address) C.int {
+	return C.int(callOf(ctx).host.AccessAccount(fromCAddress(addr)))
+}
+
+//export difftestAccessStorage
+func difftestAccessStorage(ctx C.uintptr_t, addr *C.evmc_address, key *C.evmc_bytes32) C.int {
+	return C.int(callOf(ctx).host.AccessStorage(fromCAddress(addr), fromCBytes32(key)))
+}
+
+//export difftestGetTransientStorage
+func difftestGetTransientStorage(ctx C.uintptr_t, addr *C.evmc_address, key *C.evmc_bytes32, out *C.evmc_bytes32) {
+	*out = toCBytes32(callOf(ctx).host.GetTransientStorage(fromCAddress(addr), fromCBytes32(key)))
+}
+
+//export difftestSetTransientStorage
+func difftestSetTransientStorage(ctx C.uintptr_t, addr *C.evmc_address, key, value *C.evmc_bytes32) {
+	callOf(ctx).host.SetTransientStorage(fromCAddress(addr), fromCBytes32(key), fromCBytes32(value))
+}
@@ -0,0 +1,147 @@
+//go:build evmaot
+
+// The evmc_host_interface of the native executor, which forwards each callback to the MockHost of
+// the running call. The context pointer is the cgo.Handle of that call.
+
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+#include "_cgo_export.h"
+
+static bool account_exists(struct evmc_host_context* ctx, const evmc_address* addr) {
+    return difftestAccountExists((uintptr_t)ctx, (evmc_address*)addr);
+}
+
+static evmc_bytes32 get_storage(struct evmc_host_context* ctx, const evmc_address* addr, const evmc_bytes32* key) {
+    evmc_bytes32 out;
+    difftestGetStorage((uintptr_t)ctx, (evmc_address*)addr, (evmc_bytes32*)key, &out);
+    return out;
+}
+
+static enum evmc_storage_status set_storage(struct evmc_host_context* ctx, const evmc_address* addr,
+    const evmc_bytes32* key, const evmc_bytes32* value) {
+    return (enum evmc_storage_status)difftestSetStorage((uintptr_t)ctx, (evmc_address*)addr,
+        (evmc_bytes32*)key, (evmc_bytes32*)value);
+}
+
+static evmc_uint256be get_balance(struct evmc_host_context* ctx, const evmc_address* addr) {
+    evmc_uint256be out;
+    difftestGetBalance((uintptr_t)ctx, (evmc_address*)addr, &out);
+    return out;
+}
+
+static size_t get_code_size(struct evmc_host_context* ctx, const evmc_address* addr) {
+    return difftestGetCodeSize((uintptr_t)ctx, (evmc_address*)addr);
+}
+
+static evmc_bytes32 get_code_hash(struct evmc_host_context* ctx, const evmc_address* addr) {
+    evmc_bytes32 out;
+    difftestGetCodeHash((uintptr_t)ctx, (evmc_address*)addr, &out);
+    return out;
+}
+
+static size_t copy_code(struct evmc_host_context* ctx, const evmc_address* addr, size_t offset,
+    uint8_t* buf, size_t size) {
+    return difftestCopyCode((uintptr_t)ctx, (evmc_address*)addr, offset, buf, size);
+}
+
+static bool selfdestruct(struct evmc_host_context* ctx, const evmc_address* addr, const evmc_address* beneficiary) {
+    difftestSelfdestruct((uintptr_t)ctx, (evmc_address*)addr, (evmc_address*)beneficiary);
+    return true;
+}
+
+static void release_output(const struct evmc_result* res) {
+    free((void*)res->output_data);
+}
+
+static struct evmc_result call(struct evmc_host_context* ctx, const struct evmc_message* msg) {
+    struct evmc_result res;
+    memset(&res, 0, sizeof(res));
+    difftestCall((uintptr_t)ctx, (struct evmc_message*)msg, &res);
+    if (res.output_data != NULL)
+        res.release = release_output;
+    return res;
+}
+
+static struct evmc_tx_context get_tx_context(struct evmc_host_context* ctx) {
+    struct evmc_tx_context out;
+    memset(&out, 0, sizeof(out));
+    difftestGetTxContext((uintptr_t)ctx, &out);
+    return out;
+}
+
+static evmc_bytes32 get_block_hash(struct evmc_host_context* ctx, int64_t number) {
+    evmc_bytes32 out;
+    difftestGetBlockHash((uintptr_t)ctx, number, &out);
+    return out;
+}
+
+static void emit_log(struct evmc_host_context* ctx, const evmc_address* addr, const uint8_t* data,
+    size_t data_size, const evmc_bytes32 topics[], size_t num_topics) {
+    difftestEmitLog((uintptr_t)ctx, (evmc_address*)addr, (uint8_t*)data, data_size, (evmc_bytes32*)topics, num_topics);
+}
+
+static enum evmc_access_status access_account(struct evmc_host_context* ctx, const evmc_address* addr) {
+    return (enum evmc_access_status)difftestAccessAccount((uintptr_t)ctx, (evmc_address*)addr);
+}
+
+static enum evmc_access_status access_storage(struct evmc_host_context* ctx, const evmc_address* addr,
+    const evmc_bytes32* key) {
+    return (enum evmc_access_status)difftestAccessStorage((uintptr_t)ctx, (evmc_address*)addr, (evmc_bytes32*)key);
+}
+
+static evmc_bytes32 get_transient_storage(struct evmc_host_context* ctx, const evmc_address* addr,
+    const evmc_bytes32* key) {
+    evmc_bytes32 out;
+    difftestGetTransientStorage((uintptr_t)ctx, (evmc_address*)addr, (evmc_bytes32*)key, &out);
+    return out;
+}
+
+static void set_transient_storage(struct evmc_host_context* ctx, const evmc_address* addr,
+    const evmc_bytes32* key, const evmc_bytes32* value) {
+    difftestSetTransientStorage((uintptr_t)ctx, (evmc_address*)addr, (evmc_bytes32*)key, (evmc_bytes32*)value);
+}
+
+static const struct evmc_host_interface host_interface = {
+    account_exists,
+    get_storage,
+    set_storage,
+    get_balance,
+    get_code_size,
+    get_code_hash,
+    copy_code,
+    selfdestruct,
+    call,
+    get_tx_context,
+    get_block_hash,
+    emit_log,
+    access_account,
+    access_storage,
+    get_transient_storage,
+    set_transient_storage,
+};
+
+// RTLD_NOW reports the symbols missing from the library here, instead of crashing in the middle of a call
+void* difftest_open(const char* fname, char** err) {
+    void* lib = dlopen(fname, RTLD_NOW | RTLD_LOCAL);
+    if (lib == NULL)
+        *err = dlerror();
+    return lib;
+}
+
+void* difftest_symbol(void* lib, const char* name) {
+    return dlsym(lib, name);
+}
+
+void* difftest_query(void* query_fn, const evmc_bytes32* code_hash) {
+    return (void*)((evmc_execute_fn (*)(const evmc_bytes32*))query_fn)(code_hash);
+}
+
+struct evmc_result difftest_execute(void* fn, uintptr_t ctx, enum evmc_revision rev,
+    const struct evmc_message* msg, const uint8_t* code, size_t code_size) {
+    return ((evmc_execute_fn)fn)(NULL, &host_interface, (struct evmc_host_context*)ctx, rev, msg, code, code_size);
+}
+
+void difftest_release(const struct evmc_result* res) {
+    res->release(res);
+}
@@ -0,0 +1,10 @@
+//go:build !evmaot
+
+package difftest
+
+import "errors"
+
+// NativeExecutor needs cgo and the EVMC headers, see native.go
+func NativeExecutor(cfg NativeConfig) (*Executor, error) {
+	return nil, errors.New("the native executor is not built in, rebuild with -tags evmaot")
+}
@@ -0,0 +1,27 @@
+//go:build evmaot
+
+package difftest
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// the generated C++ code, built with the headers at $MOEINGEVM and linked with $EVMAOT_LDFLAGS
+func TestNativeExecutor(t *testing.T) {
+	cfg := NativeConfig{Options: maot.DefaultOptions(), Build: maot.DefaultBuildConfig(), WorkDir: t.TempDir()}
+	cfg.Build.LinkFlags = strings.Fields(os.Getenv("EVMAOT_LDFLAGS"))
+	native, err := NativeExecutor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range testRevisions {
+		h := NewHarness(cfg.Options)
+		h.Target = native
+		h.Fuzz = 16
+		runCorpus(t, h, rev)
+	}
+}
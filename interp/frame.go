@@ -0,0 +1,759 @@
+package interp
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/keccak"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+const (
+	StackLimit    = 1024
+	CallDepthMax  = 1024
+	maxBufferSize = 1<<32 - 1 // the same as evmone's max_buffer_size
+	maxInitCode   = 49152     // EIP-3860
+
+	// the dynamic costs after EIP-2929, the warm costs are already in maot.GasCostTable
+	coldAccountAccessCost = maot.ColdAccountAccessCost
+	coldSloadCost         = maot.ColdSloadCost
+	warmStorageReadCost   = maot.WarmStorageReadCost
+	coldAccountSurcharge  = coldAccountAccessCost - warmStorageReadCost
+	coldSloadSurcharge    = coldSloadCost - warmStorageReadCost
+)
+
+// running is returned by execOp when the execution continues with the next instruction
+const running StatusCode = -1
+
+var (
+	tt255   = new(big.Int).Lsh(big.NewInt(1), 255)
+	tt256   = new(big.Int).Lsh(big.NewInt(1), 256)
+	tt256m1 = new(big.Int).Sub(tt256, big.NewInt(1))
+)
+
+// wrap x to an unsigned 256-bit value
+func u256(x *big.Int) *big.Int {
+	return x.And(x, tt256m1)
+}
+
+// the signed value of an unsigned 256-bit value, as a new big.Int
+func s256(x *big.Int) *big.Int {
+	if x.Cmp(tt255) < 0 {
+		return new(big.Int).Set(x)
+	}
+	return new(big.Int).Sub(x, tt256)
+}
+
+func bool2big(b bool) *big.Int {
+	if b {
+		return big.NewInt(1)
+	}
+	return new(big.Int)
+}
+
+func (b Bytes32) Big() *big.Int {
+	return new(big.Int).SetBytes(b[:])
+}
+
+func toBytes32(x *big.Int) (b Bytes32) {
+	x.FillBytes(b[:])
+	return
+}
+
+func (a Address) Big() *big.Int {
+	return new(big.Int).SetBytes(a[:])
+}
+
+// the lowest 20 bytes of x
+func toAddress(x *big.Int) (a Address) {
+	b := toBytes32(x)
+	copy(a[:], b[12:])
+	return
+}
+
+// x as a uint64, or ^uint64(0) if x does not fit
+func clampU64(x *big.Int) uint64 {
+	if !x.IsUint64() {
+		return ^uint64(0)
+	}
+	return x.Uint64()
+}
+
+func numWords(size uint64) int64 {
+	return int64((size + 31) / 32)
+}
+
+// The state of executing a message, shared by the different drivers
+type frame struct {
+	host       Host
+	rev        int
+	msg        *Message
+	code       []byte
+	stack      []*big.Int
+	memory     []byte
+	gasLeft    int64
+	returnData []byte
+	output     []byte
+}
+
+func (f *frame) push(x *big.Int) {
+	f.stack = append(f.stack, x)
+}
+
+func (f *frame) pop() *big.Int {
+	x := f.stack[len(f.stack)-1]
+	f.stack = f.stack[:len(f.stack)-1]
+	return x
+}
+
+func (f *frame) peek(n int) *big.Int {
+	return f.stack[len(f.stack)-1-n]
+}
+
+// charge some dynamic gas, returning false when running out of gas
+func (f *frame) charge(gas int64) bool {
+	f.gasLeft -= gas
+	return f.gasLeft >= 0
+}
+
+func memoryCost(words int64) int64 {
+	return 3*words + words*words/512
+}
+
+// expand the memory to cover [offset, offset+size) and charge the gas, like evmone's check_memory
+func (f *frame) checkMemory(offset, size *big.Int) bool {
+	if size.Sign() == 0 {
+		return true
+	}
+	if clampU64(offset) > maxBufferSize || clampU64(size) > maxBufferSize {
+		return false
+	}
+	newSize := offset.Uint64() + size.Uint64()
+	if newSize <= uint64(len(f.memory)) {
+		return true
+	}
+	newWords := numWords(newSize)
+	curWords := int64(len(f.memory) / 32)
+	// the quadratic terms are rounded down separately, like memory_cost in evmone
+	cost := memoryCost(newWords) - memoryCost(curWords)
+	if !f.charge(cost) {
+		return false
+	}
+	f.memory = append(f.memory, make([]byte, int(newWords*32)-len(f.memory))...)
+	return true
+}
+
+// copy src[offset:] into dst, padding with zeros
+func copyPadded(dst, src []byte, offset uint64) {
+	n := 0
+	if offset < uint64(len(src)) {
+		n = copy(dst, src[offset:])
+	}
+	for i := n; i < len(dst); i++ {
+		dst[i] = 0
+	}
+}
+
+// charge the cold surcharge of EIP-2929 when accessing an account
+func (f *frame) accessAccount(addr Address) bool {
+	if f.rev >= maot.EVMC_BERLIN && f.host.AccessAccount(addr) == AccessCold {
+		return f.charge(coldAccountSurcharge)
+	}
+	return true
+}
+
+// Execute the instructions other than JUMP, JUMPI, JUMPDEST and PUSH1~PUSH32. Their static gas
+// must be charged by the caller. pc is the value pushed by PC, and correction is the gas charged in
+// advance for the following instructions, which must be added back for GAS, SSTORE, CALL and CREATE.
+func (f *frame) execOp(op int, pc int, correction int64) StatusCode {
+	switch {
+	case maot.OP_DUP1 <= op && op <= maot.OP_DUP16:
+		f.push(new(big.Int).Set(f.peek(op - maot.OP_DUP1)))
+		return running
+	case maot.OP_SWAP1 <= op && op <= maot.OP_SWAP16:
+		n := len(f.stack) - 1
+		m := n - (op - maot.OP_SWAP1 + 1)
+		f.stack[n], f.stack[m] = f.stack[m], f.stack[n]
+		return running
+	case maot.OP_LOG0 <= op && op <= maot.OP_LOG4:
+		return f.opLog(op - maot.OP_LOG0)
+	}
+	switch op {
+	case maot.OP_STOP:
+		return Success
+	case maot.OP_ADD:
+		x, y := f.pop(), f.pop()
+		f.push(u256(x.Add(x, y)))
+	case maot.OP_MUL:
+		x, y := f.pop(), f.pop()
+		f.push(u256(x.Mul(x, y)))
+	case maot.OP_SUB:
+		x, y := f.pop(), f.pop()
+		f.push(u256(x.Sub(x, y)))
+	case maot.OP_DIV:
+		x, y := f.pop(), f.pop()
+		if y.Sign() == 0 {
+			f.push(y)
+		} else {
+			f.push(x.Quo(x, y))
+		}
+	case maot.OP_SDIV:
+		x, y := s256(f.pop()), s256(f.pop())
+		if y.Sign() == 0 {
+			f.push(y)
+		} else {
+			f.push(u256(x.Quo(x, y)))
+		}
+	case maot.OP_MOD:
+		x, y := f.pop(), f.pop()
+		if y.Sign() == 0 {
+			f.push(y)
+		} else {
+			f.push(x.Rem(x, y))
+		}
+	case maot.OP_SMOD:
+		x, y := s256(f.pop()), s256(f.pop())
+		if y.Sign() == 0 {
+			f.push(y)
+		} else {
+			f.push(u256(x.Rem(x, y)))
+		}
+	case maot.OP_ADDMOD:
+		x, y, m := f.pop(), f.pop(), f.pop()
+		if m.Sign() == 0 {
+			f.push(m)
+		} else {
+			x.Add(x, y)
+			f.push(x.Rem(x, m))
+		}
+	case maot.OP_MULMOD:
+		x, y, m := f.pop(), f.pop(), f.pop()
+		if m.Sign() == 0 {
+			f.push(m)
+		} else {
+			x.Mul(x, y)
+			f.push(x.Rem(x, m))
+		}
+	case maot.OP_EXP:
+		base, exponent := f.pop(), f.pop()
+		perByte := int64(10)
+		if f.rev >= maot.EVMC_SPURIOUS_DRAGON {
+			perByte = 50
+		}
+		if !f.charge(perByte * int64((exponent.BitLen()+7)/8)) {
+			return OutOfGas
+		}
+		f.push(base.Exp(base, exponent, tt256))
+	case maot.OP_SIGNEXTEND:
+		b, x := f.pop(), f.pop()
+		if b.Cmp(big.NewInt(31)) < 0 {
+			bit := uint(b.Uint64()*8 + 7)
+			mask := new(big.Int).Lsh(big.NewInt(1), bit)
+			mask.Sub(mask, big.NewInt(1))
+			if x.Bit(int(bit)) == 1 {
+				x.Or(x, new(big.Int).Xor(tt256m1, mask))
+			} else {
+				x.And(x, mask)
+			}
+		}
+		f.push(x)
+	case maot.OP_LT:
+		x, y := f.pop(), f.pop()
+		f.push(bool2big(x.Cmp(y) < 0))
+	case maot.OP_GT:
+		x, y := f.pop(), f.pop()
+		f.push(bool2big(x.Cmp(y) > 0))
+	case maot.OP_SLT:
+		x, y := f.pop(), f.pop()
+		f.push(bool2big(s256(x).Cmp(s256(y)) < 0))
+	case maot.OP_SGT:
+		x, y := f.pop(), f.pop()
+		f.push(bool2big(s256(x).Cmp(s256(y)) > 0))
+	case maot.OP_EQ:
+		x, y := f.pop(), f.pop()
+		f.push(bool2big(x.Cmp(y) == 0))
+	case maot.OP_ISZERO:
+		f.push(bool2big(f.pop().Sign() == 0))
+	case maot.OP_AND:
+		x, y := f.pop(), f.pop()
+		f.push(x.And(x, y))
+	case maot.OP_OR:
+		x, y := f.pop(), f.pop()
+		f.push(x.Or(x, y))
+	case maot.OP_XOR:
+		x, y := f.pop(), f.pop()
+		f.push(x.Xor(x, y))
+	case maot.OP_NOT:
+		x := f.pop()
+		f.push(x.Xor(x, tt256m1))
+	case maot.OP_BYTE:
+		i, x := f.pop(), f.pop()
+		if i.Cmp(big.NewInt(32)) < 0 {
+			b := toBytes32(x)
+			f.push(big.NewInt(int64(b[i.Uint64()])))
+		} else {
+			f.push(new(big.Int))
+		}
+	case maot.OP_SHL:
+		shift, x := f.pop(), f.pop()
+		if shift.Cmp(big.NewInt(256)) < 0 {
+			f.push(u256(x.Lsh(x, uint(shift.Uint64()))))
+		} else {
+			f.push(new(big.Int))
+		}
+	case maot.OP_SHR:
+		shift, x := f.pop(), f.pop()
+		if shift.Cmp(big.NewInt(256)) < 0 {
+			f.push(x.Rsh(x, uint(shift.Uint64())))
+		} else {
+			f.push(new(big.Int))
+		}
+	case maot.OP_SAR:
+		shift, x := f.pop(), s256(f.pop())
+		n := uint(256)
+		if shift.Cmp(big.NewInt(256)) < 0 {
+			n = uint(shift.Uint64())
+		}
+		f.push(u256(x.Rsh(x, n))) // Rsh rounds toward negative infinity, like an arithmetic shift
+	case maot.OP_KECCAK256:
+		offset, size := f.pop(), f.pop()
+		if !f.checkMemory(offset, size) {
+			return OutOfGas
+		}
+		if !f.charge(6 * numWords(size.Uint64())) {
+			return OutOfGas
+		}
+		var hash Bytes32
+		if size.Sign() == 0 {
+			hash = keccak.Sum256(nil)
+		} else {
+			hash = keccak.Sum256(f.memory[offset.Uint64() : offset.Uint64()+size.Uint64()])
+		}
+		f.push(hash.Big())
+	case maot.OP_ADDRESS:
+		f.push(f.msg.Destination.Big())
+	case maot.OP_BALANCE:
+		addr := toAddress(f.pop())
+		if !f.accessAccount(addr) {
+			return OutOfGas
+		}
+		f.push(f.host.GetBalance(addr).Big())
+	case maot.OP_ORIGIN:
+		f.push(f.host.GetTxContext().Origin.Big())
+	case maot.OP_CALLER:
+		f.push(f.msg.Sender.Big())
+	case maot.OP_CALLVALUE:
+		f.push(f.msg.Value.Big())
+	case maot.OP_CALLDATALOAD:
+		var b Bytes32
+		copyPadded(b[:], f.msg.Input, clampU64(f.pop()))
+		f.push(b.Big())
+	case maot.OP_CALLDATASIZE:
+		f.push(big.NewInt(int64(len(f.msg.Input))))
+	case maot.OP_CALLDATACOPY, maot.OP_CODECOPY:
+		src := f.msg.Input
+		if op == maot.OP_CODECOPY {
+			src = f.code
+		}
+		memOffset, offset, size := f.pop(), f.pop(), f.pop()
+		if !f.checkMemory(memOffset, size) || !f.charge(3*numWords(size.Uint64())) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			copyPadded(f.memory[memOffset.Uint64():memOffset.Uint64()+size.Uint64()], src, clampU64(offset))
+		}
+	case maot.OP_CODESIZE:
+		f.push(big.NewInt(int64(len(f.code))))
+	case maot.OP_GASPRICE:
+		f.push(f.host.GetTxContext().GasPrice.Big())
+	case maot.OP_EXTCODESIZE:
+		addr := toAddress(f.pop())
+		if !f.accessAccount(addr) {
+			return OutOfGas
+		}
+		f.push(big.NewInt(int64(f.host.GetCodeSize(addr))))
+	case maot.OP_EXTCODECOPY:
+		addr, memOffset, offset, size := toAddress(f.pop()), f.pop(), f.pop(), f.pop()
+		if !f.checkMemory(memOffset, size) || !f.charge(3*numWords(size.Uint64())) || !f.accessAccount(addr) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			buf := f.memory[memOffset.Uint64() : memOffset.Uint64()+size.Uint64()]
+			n := 0
+			if offset.IsUint64() && offset.Uint64() <= maxBufferSize {
+				n = f.host.CopyCode(addr, int(offset.Uint64()), buf)
+			}
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+		}
+	case maot.OP_RETURNDATASIZE:
+		f.push(big.NewInt(int64(len(f.returnData))))
+	case maot.OP_RETURNDATACOPY:
+		memOffset, offset, size := f.pop(), f.pop(), f.pop()
+		if !f.checkMemory(memOffset, size) {
+			return OutOfGas
+		}
+		end := new(big.Int).Add(offset, size)
+		if end.Cmp(big.NewInt(int64(len(f.returnData)))) > 0 {
+			return InvalidMemoryAccess
+		}
+		if !f.charge(3 * numWords(size.Uint64())) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			copy(f.memory[memOffset.Uint64():], f.returnData[offset.Uint64():end.Uint64()])
+		}
+	case maot.OP_EXTCODEHASH:
+		addr := toAddress(f.pop())
+		if !f.accessAccount(addr) {
+			return OutOfGas
+		}
+		f.push(f.host.GetCodeHash(addr).Big())
+	case maot.OP_BLOCKHASH:
+		number := f.pop()
+		upper := f.host.GetTxContext().Number
+		lower := upper - 256
+		if lower < 0 {
+			lower = 0
+		}
+		if number.IsInt64() && lower <= number.Int64() && number.Int64() < upper {
+			f.push(f.host.GetBlockHash(number.Int64()).Big())
+		} else {
+			f.push(new(big.Int))
+		}
+	case maot.OP_COINBASE:
+		f.push(f.host.GetTxContext().Coinbase.Big())
+	case maot.OP_TIMESTAMP:
+		f.push(big.NewInt(f.host.GetTxContext().Timestamp))
+	case maot.OP_NUMBER:
+		f.push(big.NewInt(f.host.GetTxContext().Number))
+	case maot.OP_DIFFICULTY:
+		f.push(f.host.GetTxContext().Difficulty.Big())
+	case maot.OP_GASLIMIT:
+		f.push(big.NewInt(f.host.GetTxContext().GasLimit))
+	case maot.OP_CHAINID:
+		f.push(f.host.GetTxContext().ChainID.Big())
+	case maot.OP_SELFBALANCE:
+		f.push(f.host.GetBalance(f.msg.Destination).Big())
+	case maot.OP_BASEFEE:
+		f.push(f.host.GetTxContext().BaseFee.Big())
+	case maot.OP_BLOBHASH:
+		index := f.pop()
+		hashes := f.host.GetTxContext().BlobHashes
+		if index.Cmp(big.NewInt(int64(len(hashes)))) < 0 {
+			f.push(hashes[index.Uint64()].Big())
+		} else {
+			f.push(new(big.Int))
+		}
+	case maot.OP_BLOBBASEFEE:
+		f.push(f.host.GetTxContext().BlobBaseFee.Big())
+	case maot.OP_POP:
+		f.pop()
+	case maot.OP_MLOAD:
+		offset := f.pop()
+		if !f.checkMemory(offset, big.NewInt(32)) {
+			return OutOfGas
+		}
+		f.push(new(big.Int).SetBytes(f.memory[offset.Uint64() : offset.Uint64()+32]))
+	case maot.OP_MSTORE:
+		offset, value := f.pop(), f.pop()
+		if !f.checkMemory(offset, big.NewInt(32)) {
+			return OutOfGas
+		}
+		value.FillBytes(f.memory[offset.Uint64() : offset.Uint64()+32])
+	case maot.OP_MSTORE8:
+		offset, value := f.pop(), f.pop()
+		if !f.checkMemory(offset, big.NewInt(1)) {
+			return OutOfGas
+		}
+		f.memory[offset.Uint64()] = byte(value.Uint64())
+	case maot.OP_SLOAD:
+		key := toBytes32(f.pop())
+		if f.rev >= maot.EVMC_BERLIN && f.host.AccessStorage(f.msg.Destination, key) == AccessCold {
+			if !f.charge(coldSloadSurcharge) {
+				return OutOfGas
+			}
+		}
+		f.push(f.host.GetStorage(f.msg.Destination, key).Big())
+	case maot.OP_SSTORE:
+		return f.withCorrection(correction, f.opSstore)
+	case maot.OP_PC:
+		f.push(big.NewInt(int64(pc)))
+	case maot.OP_MSIZE:
+		f.push(big.NewInt(int64(len(f.memory))))
+	case maot.OP_GAS:
+		f.push(big.NewInt(f.gasLeft + correction))
+	case maot.OP_TLOAD:
+		key := toBytes32(f.pop())
+		f.push(f.host.GetTransientStorage(f.msg.Destination, key).Big())
+	case maot.OP_TSTORE:
+		if f.msg.Static {
+			return StaticModeViolation
+		}
+		key, value := toBytes32(f.pop()), toBytes32(f.pop())
+		f.host.SetTransientStorage(f.msg.Destination, key, value)
+	case maot.OP_MCOPY:
+		dst, src, size := f.pop(), f.pop(), f.pop()
+		end := dst
+		if src.Cmp(dst) > 0 {
+			end = src
+		}
+		if !f.checkMemory(end, size) || !f.charge(3*numWords(size.Uint64())) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			copy(f.memory[dst.Uint64():], f.memory[src.Uint64():src.Uint64()+size.Uint64()])
+		}
+	case maot.OP_PUSH0:
+		f.push(new(big.Int))
+	case maot.OP_CREATE, maot.OP_CREATE2:
+		return f.withCorrection(correction, func() StatusCode { return f.opCreate(op) })
+	case maot.OP_CALL, maot.OP_CALLCODE, maot.OP_DELEGATECALL, maot.OP_STATICCALL:
+		return f.withCorrection(correction, func() StatusCode { return f.opCall(op) })
+	case maot.OP_RETURN, maot.OP_REVERT:
+		offset, size := f.pop(), f.pop()
+		if !f.checkMemory(offset, size) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			f.output = append([]byte(nil), f.memory[offset.Uint64():offset.Uint64()+size.Uint64()]...)
+		}
+		if op == maot.OP_REVERT {
+			return Revert
+		}
+		return Success
+	case maot.OP_INVALID:
+		return InvalidInstruction
+	case maot.OP_SELFDESTRUCT:
+		return f.opSelfdestruct()
+	default:
+		return UndefinedInstruction
+	}
+	return running
+}
+
+// like evmone's op_sstore/op_call/op_create, which add back the gas charged in advance
+func (f *frame) withCorrection(correction int64, fn func() StatusCode) StatusCode {
+	f.gasLeft += correction
+	if status := fn(); status != running {
+		return status
+	}
+	if !f.charge(correction) {
+		return OutOfGas
+	}
+	return running
+}
+
+func (f *frame) opLog(numTopics int) StatusCode {
+	if f.msg.Static {
+		return StaticModeViolation
+	}
+	offset, size := f.pop(), f.pop()
+	if !f.checkMemory(offset, size) || !f.charge(8*int64(clampU64(size))) {
+		return OutOfGas
+	}
+	topics := make([]Bytes32, numTopics)
+	for i := range topics {
+		topics[i] = toBytes32(f.pop())
+	}
+	var data []byte
+	if size.Sign() != 0 {
+		data = append(data, f.memory[offset.Uint64():offset.Uint64()+size.Uint64()]...)
+	}
+	f.host.EmitLog(f.msg.Destination, data, topics)
+	return running
+}
+
+func (f *frame) opSstore() StatusCode {
+	if f.msg.Static {
+		return StaticModeViolation
+	}
+	if f.rev >= maot.EVMC_ISTANBUL && f.gasLeft <= 2300 { // EIP-2200
+		return OutOfGas
+	}
+	key, value := toBytes32(f.pop()), toBytes32(f.pop())
+	cost := int64(0)
+	if f.rev >= maot.EVMC_BERLIN && f.host.AccessStorage(f.msg.Destination, key) == AccessCold {
+		cost = coldSloadCost
+	}
+	switch f.host.SetStorage(f.msg.Destination, key, value) {
+	case StorageUnchanged, StorageModifiedAgain:
+		switch {
+		case f.rev >= maot.EVMC_BERLIN:
+			cost += warmStorageReadCost
+		case f.rev == maot.EVMC_ISTANBUL:
+			cost = 800
+		case f.rev == maot.EVMC_CONSTANTINOPLE:
+			cost = 200
+		default:
+			cost = 5000
+		}
+	case StorageModified, StorageDeleted:
+		if f.rev >= maot.EVMC_BERLIN {
+			cost += 5000 - coldSloadCost
+		} else {
+			cost = 5000
+		}
+	case StorageAdded:
+		cost += 20000
+	}
+	if !f.charge(cost) {
+		return OutOfGas
+	}
+	return running
+}
+
+func (f *frame) opCall(op int) StatusCode {
+	gas, dst := f.pop(), toAddress(f.pop())
+	value := new(big.Int)
+	if op == maot.OP_CALL || op == maot.OP_CALLCODE {
+		value = f.pop()
+	}
+	inOffset, inSize, outOffset, outSize := f.pop(), f.pop(), f.pop(), f.pop()
+	hasValue := value.Sign() != 0
+	f.push(new(big.Int)) // assume failure
+	if !f.accessAccount(dst) || !f.checkMemory(inOffset, inSize) || !f.checkMemory(outOffset, outSize) {
+		return OutOfGas
+	}
+	msg := &Message{
+		Kind:        Call,
+		Static:      f.msg.Static || op == maot.OP_STATICCALL,
+		Depth:       f.msg.Depth + 1,
+		Destination: dst,
+		Sender:      f.msg.Destination,
+		Value:       toBytes32(value),
+	}
+	switch op {
+	case maot.OP_CALLCODE:
+		msg.Kind = CallCode
+	case maot.OP_DELEGATECALL:
+		msg.Kind = DelegateCall
+		msg.Sender = f.msg.Sender
+		msg.Value = f.msg.Value
+	}
+	if inSize.Sign() != 0 {
+		msg.Input = append([]byte(nil), f.memory[inOffset.Uint64():inOffset.Uint64()+inSize.Uint64()]...)
+	}
+	cost := int64(0)
+	if hasValue {
+		cost = 9000
+	}
+	if op == maot.OP_CALL {
+		if hasValue && f.msg.Static {
+			return StaticModeViolation
+		}
+		if (hasValue || f.rev < maot.EVMC_SPURIOUS_DRAGON) && !f.host.AccountExists(dst) {
+			cost += 25000
+		}
+	}
+	if !f.charge(cost) {
+		return OutOfGas
+	}
+	msg.Gas = math.MaxInt64
+	if gas.IsInt64() {
+		msg.Gas = gas.Int64()
+	}
+	if f.rev >= maot.EVMC_TANGERINE_WHISTLE {
+		if limit := f.gasLeft - f.gasLeft/64; msg.Gas > limit {
+			msg.Gas = limit
+		}
+	} else if msg.Gas > f.gasLeft {
+		return OutOfGas
+	}
+	if hasValue {
+		msg.Gas += 2300 // the stipend
+		f.gasLeft += 2300
+	}
+	f.returnData = nil
+	if f.msg.Depth >= CallDepthMax {
+		return running
+	}
+	if hasValue && f.host.GetBalance(f.msg.Destination).Big().Cmp(value) < 0 {
+		return running
+	}
+	result := f.host.Call(msg)
+	f.returnData = result.Output
+	f.stack[len(f.stack)-1] = bool2big(result.Status == Success)
+	if outSize.Sign() != 0 {
+		copy(f.memory[outOffset.Uint64():outOffset.Uint64()+outSize.Uint64()], result.Output)
+	}
+	f.gasLeft -= msg.Gas - result.GasLeft
+	return running
+}
+
+func (f *frame) opCreate(op int) StatusCode {
+	if f.msg.Static {
+		return StaticModeViolation
+	}
+	endowment, offset, size := f.pop(), f.pop(), f.pop()
+	if !f.checkMemory(offset, size) {
+		return OutOfGas
+	}
+	salt := new(big.Int)
+	if op == maot.OP_CREATE2 {
+		salt = f.pop()
+		if !f.charge(6 * numWords(size.Uint64())) {
+			return OutOfGas
+		}
+	}
+	if f.rev >= maot.EVMC_SHANGHAI { // EIP-3860
+		if size.Uint64() > maxInitCode || !f.charge(2*numWords(size.Uint64())) {
+			return OutOfGas
+		}
+	}
+	f.push(new(big.Int))
+	f.returnData = nil
+	if f.msg.Depth >= CallDepthMax {
+		return running
+	}
+	if endowment.Sign() != 0 && f.host.GetBalance(f.msg.Destination).Big().Cmp(endowment) < 0 {
+		return running
+	}
+	msg := &Message{
+		Kind:        Create,
+		Static:      false,
+		Depth:       f.msg.Depth + 1,
+		Gas:         f.gasLeft,
+		Sender:      f.msg.Destination,
+		Value:       toBytes32(endowment),
+		Create2Salt: toBytes32(salt),
+	}
+	if op == maot.OP_CREATE2 {
+		msg.Kind = Create2
+	}
+	if f.rev >= maot.EVMC_TANGERINE_WHISTLE {
+		msg.Gas -= msg.Gas / 64
+	}
+	if size.Sign() != 0 {
+		msg.Input = append([]byte(nil), f.memory[offset.Uint64():offset.Uint64()+size.Uint64()]...)
+	}
+	result := f.host.Call(msg)
+	f.gasLeft -= msg.Gas - result.GasLeft
+	f.returnData = result.Output
+	if result.Status == Success {
+		f.stack[len(f.stack)-1] = result.CreateAddress.Big()
+	}
+	return running
+}
+
+func (f *frame) opSelfdestruct() StatusCode {
+	if f.msg.Static {
+		return StaticModeViolation
+	}
+	beneficiary := toAddress(f.pop())
+	if f.rev >= maot.EVMC_BERLIN && f.host.AccessAccount(beneficiary) == AccessCold {
+		if !f.charge(coldAccountAccessCost) {
+			return OutOfGas
+		}
+	}
+	if f.rev >= maot.EVMC_TANGERINE_WHISTLE {
+		if f.rev == maot.EVMC_TANGERINE_WHISTLE || f.host.GetBalance(f.msg.Destination).Big().Sign() != 0 {
+			if !f.host.AccountExists(beneficiary) && !f.charge(25000) {
+				return OutOfGas
+			}
+		}
+	}
+	f.host.Selfdestruct(f.msg.Destination, beneficiary)
+	return Success
+}
@@ -0,0 +1,58 @@
+package interp
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// The super-instructions marked by the fusion pass, which do what maotF_<Name> does in the generated
+// C++ code. The fused instructions themselves stay in InstrList, so running a super-instruction here and
+// running its instructions one by one must agree.
+
+// the lowest stack height needed by instrs, which are in one basic block, and how much they grow the stack
+func fusedStackReq(opTbl *[256]maot.OpTableEntry, instrs []*maot.Instruction) (req, growth int) {
+	height := 0 // relative to the height before instrs
+	for _, instr := range instrs {
+		if instr.OpCode == maot.NOP {
+			continue // a PUSH fused into the following JUMPI
+		}
+		entry := opTbl[instr.OpCode]
+		stackReq, change := int(entry.StackReq), int(entry.StackChange)
+		if isFusedJump(instr) {
+			stackReq, change = stackReq-1, change+1 // the target is not on the stack
+		}
+		if stackReq-height > req {
+			req = stackReq - height
+		}
+		height += change
+		if height > growth {
+			growth = height
+		}
+	}
+	return
+}
+
+// run the super-instruction p made of instrs, returning whether it ends with a taken JUMPI
+func (f *frame) execFused(p *maot.FusionPattern, instrs []*maot.Instruction) (bool, error) {
+	switch p.Name {
+	case "SELECTOR_JUMPI":
+		return f.pop().Cmp(new(big.Int).SetUint64(instrs[0].SmallPushValue)) == 0, nil
+	case "DUP2_DUP2_LT_ISZERO":
+		f.push(bool2big(f.peek(0).Cmp(f.peek(1)) >= 0))
+	case "PUSH_ADD":
+		top := f.peek(0)
+		u256(top.Add(top, new(big.Int).SetUint64(instrs[0].SmallPushValue)))
+	case "MASK":
+		mask := new(big.Int).Lsh(big.NewInt(1), uint(maot.MaskBits(instrs[0])))
+		top := f.peek(0)
+		top.And(top, mask.Sub(mask, big.NewInt(1)))
+	case "SWAP1_POP":
+		top := f.pop()
+		f.stack[len(f.stack)-1] = top
+	default:
+		return false, &AnalysisError{PC: instrs[0].PC, Msg: fmt.Sprintf("unknown super-instruction %s", p.Name)}
+	}
+	return false, nil
+}
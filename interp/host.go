@@ -0,0 +1,135 @@
+package interp
+
+// The types in this file mirror the ones of EVMC 11, which is the interface between evmone and
+// its host, such that a Go host behaves just like the host of the generated C++ code.
+
+type Address [20]byte
+
+// A big-endian 256-bit value, like evmc_bytes32 and evmc_uint256be
+type Bytes32 [32]byte
+
+type StatusCode int
+
+// the same numbers as evmc_status_code
+const (
+	Success              StatusCode = 0
+	Failure              StatusCode = 1
+	Revert               StatusCode = 2
+	OutOfGas             StatusCode = 3
+	InvalidInstruction   StatusCode = 4
+	UndefinedInstruction StatusCode = 5
+	StackOverflow        StatusCode = 6
+	StackUnderflow       StatusCode = 7
+	BadJumpDestination   StatusCode = 8
+	InvalidMemoryAccess  StatusCode = 9
+	CallDepthExceeded    StatusCode = 10
+	StaticModeViolation  StatusCode = 11
+)
+
+var statusNames = map[StatusCode]string{
+	Success:              "success",
+	Failure:              "failure",
+	Revert:               "revert",
+	OutOfGas:             "out of gas",
+	InvalidInstruction:   "invalid instruction",
+	UndefinedInstruction: "undefined instruction",
+	StackOverflow:        "stack overflow",
+	StackUnderflow:       "stack underflow",
+	BadJumpDestination:   "bad jump destination",
+	InvalidMemoryAccess:  "invalid memory access",
+	CallDepthExceeded:    "call depth exceeded",
+	StaticModeViolation:  "static mode violation",
+}
+
+func (s StatusCode) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown status"
+}
+
+type CallKind int
+
+// the same numbers as evmc_call_kind
+const (
+	Call         CallKind = 0
+	DelegateCall CallKind = 1
+	CallCode     CallKind = 2
+	Create       CallKind = 3
+	Create2      CallKind = 4
+)
+
+// like evmc_message
+type Message struct {
+	Kind        CallKind
+	Static      bool // EVMC_STATIC is set in flags
+	Depth       int
+	Gas         int64
+	Destination Address
+	Sender      Address
+	Input       []byte
+	Value       Bytes32
+	Create2Salt Bytes32
+}
+
+// like evmc_result
+type Result struct {
+	Status        StatusCode
+	GasLeft       int64
+	Output        []byte
+	CreateAddress Address
+}
+
+// like evmc_tx_context
+type TxContext struct {
+	GasPrice    Bytes32
+	Origin      Address
+	Coinbase    Address
+	Number      int64
+	Timestamp   int64
+	GasLimit    int64
+	Difficulty  Bytes32 // PREVRANDAO since the merge
+	ChainID     Bytes32
+	BaseFee     Bytes32
+	BlobBaseFee Bytes32
+	BlobHashes  []Bytes32
+}
+
+type StorageStatus int
+
+// the same numbers as evmc_storage_status
+const (
+	StorageUnchanged     StorageStatus = 0
+	StorageModified      StorageStatus = 1
+	StorageModifiedAgain StorageStatus = 2
+	StorageAdded         StorageStatus = 3
+	StorageDeleted       StorageStatus = 4
+)
+
+type AccessStatus int
+
+// the same numbers as evmc_access_status
+const (
+	AccessCold AccessStatus = 0
+	AccessWarm AccessStatus = 1
+)
+
+// Host is the Go counterpart of evmc_host_interface. Refunds are tracked by the host, as in EVMC.
+type Host interface {
+	AccountExists(addr Address) bool
+	GetStorage(addr Address, key Bytes32) Bytes32
+	SetStorage(addr Address, key, value Bytes32) StorageStatus
+	GetBalance(addr Address) Bytes32
+	GetCodeSize(addr Address) int
+	GetCodeHash(addr Address) Bytes32
+	CopyCode(addr Address, offset int, buf []byte) int
+	Selfdestruct(addr, beneficiary Address)
+	Call(msg *Message) Result
+	GetTxContext() TxContext
+	GetBlockHash(number int64) Bytes32
+	EmitLog(addr Address, data []byte, topics []Bytes32)
+	AccessAccount(addr Address) AccessStatus
+	AccessStorage(addr Address, key Bytes32) AccessStatus
+	GetTransientStorage(addr Address, key Bytes32) Bytes32
+	SetTransientStorage(addr Address, key, value Bytes32)
+}
@@ -0,0 +1,284 @@
+// Package interp executes a maot.AdvancedCodeAnalysis in Go, with the same semantics as the
+// generated C++ code: the gas and stack requirements are checked once per basic block using
+// BlockInfo, the fused jumps go to their targets directly, the other jumps use the JUMPTABLE, and
+// the super-instructions marked by the fusion pass run as one step, except when tracing.
+// So the analysis can be validated without a C++ toolchain, and used as a reference executor.
+package interp
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// Step describes the state before executing an instruction, like a line of EIP-3155 traces
+type Step struct {
+	PC      int
+	Op      int
+	GasLeft int64 // the gas an instruction-by-instruction interpreter would show
+	GasCost int64 // the static gas cost of Op
+	Depth   int
+	Stack   []Bytes32 // from bottom to top
+	MemSize int
+}
+
+func (s *Step) OpName() string {
+	if s.Op == maot.OP_JUMPDEST {
+		return "JUMPDEST" // TraitsTable calls it BEGINBLOCK
+	}
+	if name := maot.TraitsTable[s.Op].Name; len(name) != 0 {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", s.Op)
+}
+
+type Tracer func(step *Step)
+
+// AnalysisError reports that the execution disagrees with the analysis, such as a stack underflow
+// inside a basic block whose StackReq has been checked. The generated C++ code would crash.
+type AnalysisError struct {
+	PC  int
+	Msg string
+}
+
+func (e *AnalysisError) Error() string {
+	return fmt.Sprintf("pc %d: %s", e.PC, e.Msg)
+}
+
+type Interpreter struct {
+	Host   Host
+	Tracer Tracer // optional, called before each instruction
+}
+
+// Execute runs code, which has been analyzed as "analysis", for msg
+func (in *Interpreter) Execute(analysis maot.AdvancedCodeAnalysis, msg *Message, code []byte) (Result, error) {
+	f := &frame{host: in.Host, rev: analysis.Rev, msg: msg, code: code, gasLeft: msg.Gas}
+	status, err := in.run(f, analysis)
+	if err != nil {
+		return Result{Status: Failure}, err
+	}
+	res := Result{Status: status}
+	if status == Success || status == Revert {
+		res.GasLeft = f.gasLeft
+		res.Output = f.output
+	}
+	return res, nil
+}
+
+// JumpTable maps the PC of each JUMPDEST in the JUMPTABLE to the index of its OPX_BEGINBLOCK in InstrList
+func JumpTable(analysis maot.AdvancedCodeAnalysis) map[int]int {
+	return jumpdestBlocks(analysis, analysis.JumpTableTargets())
+}
+
+// map the PCs of the JUMPDESTs in targets to the indexes of their OPX_BEGINBLOCKs
+func jumpdestBlocks(analysis maot.AdvancedCodeAnalysis, targets []int) map[int]int {
+	inTargets := make(map[int]bool, len(targets))
+	for _, pc := range targets {
+		inTargets[pc] = true
+	}
+	table := make(map[int]int, len(targets))
+	for i, instr := range analysis.InstrList {
+		if instr.OpCode != maot.OPX_BEGINBLOCK {
+			continue
+		}
+		pc := instr.PC
+		if pc < 0 {
+			pc = 0
+		}
+		if inTargets[pc] {
+			table[pc] = i
+		}
+	}
+	return table
+}
+
+func (in *Interpreter) run(f *frame, analysis maot.AdvancedCodeAnalysis) (StatusCode, error) {
+	opTbl := &maot.OpTables[analysis.Rev]
+	jumpTable := JumpTable(analysis)
+	// the fused jumps go to their targets directly, without the JUMPTABLE
+	jumpdests := jumpdestBlocks(analysis, analysis.JumpdestTargets)
+	var currentBlockCost int64 // like state->current_block_cost
+	var blockOffset int64      // the static gas of the instructions executed in this block
+	var rest int64             // the static gas of the blocks after this one in its super-block
+	fast := false              // is the current super-block checked as a whole, like "fast" in C++?
+	for i := 0; i < len(analysis.InstrList); {
+		instr := analysis.InstrList[i]
+		i++
+		op := instr.OpCode
+		if op == maot.NOP {
+			op = instr.Number // a PUSH fused into the following JUMP/JUMPI, which pushes nothing
+		}
+		if op < 0 || op > 255 {
+			return Failure, &AnalysisError{PC: instr.PC, Msg: fmt.Sprintf("unknown opcode %d", instr.OpCode)}
+		}
+		if op == maot.OPX_BEGINBLOCK {
+			block := instr.Block
+			if in.Tracer != nil && isJumpdest(analysis, instr) {
+				gasLeft := f.gasLeft
+				if fast && block.Merged { // charged by the super-block
+					gasLeft += int64(block.GasCost + block.Rest)
+				}
+				in.trace(f, instr, op, gasLeft, int64(opTbl[op].GasCost))
+			}
+			blockOffset = 0
+			if isJumpdest(analysis, instr) {
+				blockOffset = int64(opTbl[op].GasCost)
+			}
+			rest = int64(block.Rest)
+			height := len(f.stack)
+			if block.Proven && (height < int(block.StackReq) || height+int(block.StackMaxGrowth) > StackLimit ||
+				(block.EntryHeight >= 0 && height != int(block.EntryHeight))) {
+				return Failure, &AnalysisError{PC: instr.PC,
+					Msg: fmt.Sprintf("stack height %d is not the proven one", height)}
+			}
+			if super := block.Super; super != nil {
+				fast = f.gasLeft >= int64(super.GasCost) && height >= int(super.StackReq) &&
+					height+int(super.StackMaxGrowth) <= StackLimit
+				if fast {
+					f.gasLeft -= int64(super.GasCost)
+					currentBlockCost = int64(super.GasCost)
+					continue
+				}
+			} else if block.Merged && fast {
+				currentBlockCost = int64(block.GasCost + block.Rest)
+				continue
+			}
+			if !f.charge(int64(block.GasCost)) {
+				return OutOfGas, nil
+			}
+			if !block.Proven { // otherwise the generated code only charges the gas
+				if height < int(block.StackReq) {
+					return StackUnderflow, nil
+				}
+				if height+int(block.StackMaxGrowth) > StackLimit {
+					return StackOverflow, nil
+				}
+			}
+			currentBlockCost = int64(block.GasCost)
+			continue
+		}
+		if instr.Fusion > 0 && in.Tracer == nil { // a tracer sees the original instructions
+			p := &maot.FusionPatterns[instr.Fusion-1]
+			instrs := analysis.InstrList[i-1 : i-1+len(p.Match)]
+			i += len(p.Match) - 1
+			req, growth := fusedStackReq(opTbl, instrs)
+			if len(f.stack) < req {
+				return Failure, &AnalysisError{PC: instr.PC, Msg: "stack underflow inside a basic block"}
+			}
+			if len(f.stack)+growth > StackLimit {
+				return Failure, &AnalysisError{PC: instr.PC, Msg: "stack overflow inside a basic block"}
+			}
+			jump, err := f.execFused(p, instrs)
+			if err != nil {
+				return Failure, err
+			}
+			if !jump {
+				continue
+			}
+			if fast { // leaving the super-block early
+				f.gasLeft += rest
+			}
+			next, ok := jumpdests[instrs[len(instrs)-1].Number]
+			if !ok {
+				return BadJumpDestination, nil
+			}
+			i = next
+			continue
+		}
+		entry := opTbl[op]
+		if in.Tracer != nil {
+			in.trace(f, instr, op, f.gasLeft+currentBlockCost-blockOffset, int64(entry.GasCost))
+		}
+		blockOffset += int64(entry.GasCost)
+		if entry.FuncName == "op_undefined" {
+			return UndefinedInstruction, nil
+		}
+		if instr.OpCode == maot.NOP {
+			continue
+		}
+		stackReq := int(entry.StackReq)
+		if isFusedJump(instr) {
+			stackReq-- // the target is not on the stack
+		}
+		if len(f.stack) < stackReq {
+			return Failure, &AnalysisError{PC: instr.PC, Msg: "stack underflow inside a basic block"}
+		}
+		if len(f.stack)+int(entry.StackChange) > StackLimit {
+			return Failure, &AnalysisError{PC: instr.PC, Msg: "stack overflow inside a basic block"}
+		}
+		switch {
+		case maot.OP_PUSH1 <= op && op <= maot.OP_PUSH8:
+			f.push(new(big.Int).SetUint64(instr.SmallPushValue))
+		case maot.OP_PUSH9 <= op && op <= maot.OP_PUSH32:
+			w := instr.PushWords
+			x := new(big.Int)
+			for _, word := range w {
+				x.Lsh(x, 64)
+				x.Or(x, new(big.Int).SetUint64(word))
+			}
+			f.push(x)
+		case op == maot.OP_JUMP || op == maot.OP_JUMPI:
+			var target *big.Int
+			table := jumpTable
+			if instr.Number != 0 {
+				target = big.NewInt(int64(instr.Number))
+				table = jumpdests
+			} else {
+				target = f.pop()
+			}
+			if op == maot.OP_JUMPI && f.pop().Sign() == 0 {
+				continue
+			}
+			if fast { // leaving the super-block early
+				f.gasLeft += rest
+			}
+			next, ok := -1, target.IsInt64()
+			if ok {
+				next, ok = table[int(target.Int64())]
+			}
+			if !ok {
+				return BadJumpDestination, nil
+			}
+			i = next
+		default:
+			correction := currentBlockCost - int64(instr.Number)
+			// OP_PC stores the PC in Number, and GAS/CALL/CREATE/SSTORE store the block's cost so far
+			if status := f.execOp(op, instr.Number, correction); status != running {
+				return status, nil
+			}
+		}
+	}
+	return Success, nil // the STOP appended by Analyze never falls through, but be safe
+}
+
+func isFusedJump(instr *maot.Instruction) bool {
+	return (instr.OpCode == maot.OP_JUMP || instr.OpCode == maot.OP_JUMPI) && instr.Number != 0
+}
+
+// a basic block starting with a real JUMPDEST, not the one after a JUMPI
+func isJumpdest(analysis maot.AdvancedCodeAnalysis, instr *maot.Instruction) bool {
+	pc := instr.PC
+	if pc < 0 {
+		pc = 0
+	}
+	_, ok := analysis.TargetsSet[pc]
+	return ok
+}
+
+func (in *Interpreter) trace(f *frame, instr *maot.Instruction, op int, gasLeft, gasCost int64) {
+	step := &Step{PC: instr.PC, Op: op, GasLeft: gasLeft, GasCost: gasCost, Depth: f.msg.Depth, MemSize: len(f.memory)}
+	if step.PC < 0 {
+		step.PC = 0
+	}
+	step.Stack = make([]Bytes32, len(f.stack), len(f.stack)+1)
+	for j, x := range f.stack {
+		step.Stack[j] = toBytes32(x)
+	}
+	if isFusedJump(instr) { // show the target pushed by the fused PUSH
+		var target Bytes32
+		big.NewInt(int64(instr.Number)).FillBytes(target[:])
+		step.Stack = append(step.Stack, target)
+	}
+	in.Tracer(step)
+}
@@ -0,0 +1,903 @@
+package interp
+
+import (
+	"math"
+	"math/big"
+
+	"github.com/smartbch/moeingaot/keccak"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// The reference interpreter shares nothing with Execute but the host types and the opcode
+// numbers: the gas schedule, the stack arities and the instructions are written again here from
+// the Yellow Paper and the EIPs, instead of using maot.OpTables and frame.execOp, so that a mistake
+// in those shows up as a mismatch in the differential tests rather than cancelling out.
+
+// the static gas of op in rev, and false if op is undefined in rev
+func refStaticGas(rev, op int) (int64, bool) {
+	since := func(first int, gas int64) (int64, bool) {
+		return gas, rev >= first
+	}
+	// BALANCE, EXT*, SLOAD and the calls got more expensive twice, and warm-only since EIP-2929
+	repriced := func(frontier, tangerine, istanbul int64) int64 {
+		switch {
+		case rev >= maot.EVMC_BERLIN:
+			return 100
+		case rev >= maot.EVMC_ISTANBUL && istanbul != 0:
+			return istanbul
+		case rev >= maot.EVMC_TANGERINE_WHISTLE:
+			return tangerine
+		}
+		return frontier
+	}
+	switch {
+	case maot.OP_PUSH1 <= op && op <= maot.OP_PUSH32, maot.OP_DUP1 <= op && op <= maot.OP_DUP16,
+		maot.OP_SWAP1 <= op && op <= maot.OP_SWAP16:
+		return 3, true
+	case maot.OP_LOG0 <= op && op <= maot.OP_LOG4:
+		return 375 * int64(op-maot.OP_LOG0+1), true
+	}
+	switch op {
+	case maot.OP_STOP, maot.OP_RETURN, maot.OP_INVALID, maot.OP_SSTORE:
+		return 0, true
+	case maot.OP_ADD, maot.OP_SUB, maot.OP_LT, maot.OP_GT, maot.OP_SLT, maot.OP_SGT, maot.OP_EQ,
+		maot.OP_ISZERO, maot.OP_AND, maot.OP_OR, maot.OP_XOR, maot.OP_NOT, maot.OP_BYTE,
+		maot.OP_CALLDATALOAD, maot.OP_CALLDATACOPY, maot.OP_CODECOPY, maot.OP_MLOAD, maot.OP_MSTORE,
+		maot.OP_MSTORE8:
+		return 3, true
+	case maot.OP_MUL, maot.OP_DIV, maot.OP_SDIV, maot.OP_MOD, maot.OP_SMOD, maot.OP_SIGNEXTEND:
+		return 5, true
+	case maot.OP_ADDMOD, maot.OP_MULMOD, maot.OP_JUMP:
+		return 8, true
+	case maot.OP_EXP, maot.OP_JUMPI:
+		return 10, true
+	case maot.OP_KECCAK256:
+		return 30, true
+	case maot.OP_ADDRESS, maot.OP_ORIGIN, maot.OP_CALLER, maot.OP_CALLVALUE, maot.OP_CALLDATASIZE,
+		maot.OP_CODESIZE, maot.OP_GASPRICE, maot.OP_COINBASE, maot.OP_TIMESTAMP, maot.OP_NUMBER,
+		maot.OP_DIFFICULTY, maot.OP_GASLIMIT, maot.OP_POP, maot.OP_PC, maot.OP_MSIZE, maot.OP_GAS:
+		return 2, true
+	case maot.OP_JUMPDEST:
+		return 1, true
+	case maot.OP_BALANCE:
+		return repriced(20, 400, 700), true
+	case maot.OP_EXTCODESIZE, maot.OP_EXTCODECOPY:
+		return repriced(20, 700, 0), true
+	case maot.OP_SLOAD:
+		return repriced(50, 200, 800), true
+	case maot.OP_CALL, maot.OP_CALLCODE:
+		return repriced(40, 700, 0), true
+	case maot.OP_BLOCKHASH:
+		return 20, true
+	case maot.OP_CREATE:
+		return 32000, true
+	case maot.OP_SELFDESTRUCT:
+		if rev >= maot.EVMC_TANGERINE_WHISTLE {
+			return 5000, true
+		}
+		return 0, true
+	case maot.OP_DELEGATECALL:
+		return since(maot.EVMC_HOMESTEAD, repriced(40, 700, 0))
+	case maot.OP_RETURNDATASIZE:
+		return since(maot.EVMC_BYZANTIUM, 2)
+	case maot.OP_RETURNDATACOPY:
+		return since(maot.EVMC_BYZANTIUM, 3)
+	case maot.OP_STATICCALL:
+		return since(maot.EVMC_BYZANTIUM, repriced(0, 700, 0))
+	case maot.OP_REVERT:
+		return since(maot.EVMC_BYZANTIUM, 0)
+	case maot.OP_SHL, maot.OP_SHR, maot.OP_SAR:
+		return since(maot.EVMC_CONSTANTINOPLE, 3)
+	case maot.OP_EXTCODEHASH:
+		return since(maot.EVMC_CONSTANTINOPLE, repriced(0, 400, 700))
+	case maot.OP_CREATE2:
+		return since(maot.EVMC_CONSTANTINOPLE, 32000)
+	case maot.OP_CHAINID:
+		return since(maot.EVMC_ISTANBUL, 2)
+	case maot.OP_SELFBALANCE:
+		return since(maot.EVMC_ISTANBUL, 5)
+	case maot.OP_BASEFEE:
+		return since(maot.EVMC_LONDON, 2)
+	case maot.OP_PUSH0:
+		return since(maot.EVMC_SHANGHAI, 2)
+	case maot.OP_BLOBHASH, maot.OP_MCOPY:
+		return since(maot.EVMC_CANCUN, 3)
+	case maot.OP_BLOBBASEFEE:
+		return since(maot.EVMC_CANCUN, 2)
+	case maot.OP_TLOAD, maot.OP_TSTORE:
+		return since(maot.EVMC_CANCUN, 100)
+	}
+	return 0, false
+}
+
+// how many items op pops and pushes
+func refArity(op int) (in, out int) {
+	switch {
+	case maot.OP_PUSH1 <= op && op <= maot.OP_PUSH32:
+		return 0, 1
+	case maot.OP_DUP1 <= op && op <= maot.OP_DUP16:
+		n := op - maot.OP_DUP1 + 1
+		return n, n + 1
+	case maot.OP_SWAP1 <= op && op <= maot.OP_SWAP16:
+		n := op - maot.OP_SWAP1 + 2
+		return n, n
+	case maot.OP_LOG0 <= op && op <= maot.OP_LOG4:
+		return op - maot.OP_LOG0 + 2, 0
+	}
+	switch op {
+	case maot.OP_ADDRESS, maot.OP_ORIGIN, maot.OP_CALLER, maot.OP_CALLVALUE, maot.OP_CALLDATASIZE,
+		maot.OP_CODESIZE, maot.OP_GASPRICE, maot.OP_RETURNDATASIZE, maot.OP_COINBASE, maot.OP_TIMESTAMP,
+		maot.OP_NUMBER, maot.OP_DIFFICULTY, maot.OP_GASLIMIT, maot.OP_CHAINID, maot.OP_SELFBALANCE,
+		maot.OP_BASEFEE, maot.OP_BLOBBASEFEE, maot.OP_PC, maot.OP_MSIZE, maot.OP_GAS, maot.OP_PUSH0:
+		return 0, 1
+	case maot.OP_ISZERO, maot.OP_NOT, maot.OP_BALANCE, maot.OP_CALLDATALOAD, maot.OP_EXTCODESIZE,
+		maot.OP_EXTCODEHASH, maot.OP_BLOCKHASH, maot.OP_BLOBHASH, maot.OP_MLOAD, maot.OP_SLOAD, maot.OP_TLOAD:
+		return 1, 1
+	case maot.OP_POP, maot.OP_JUMP, maot.OP_SELFDESTRUCT:
+		return 1, 0
+	case maot.OP_ADD, maot.OP_MUL, maot.OP_SUB, maot.OP_DIV, maot.OP_SDIV, maot.OP_MOD, maot.OP_SMOD,
+		maot.OP_EXP, maot.OP_SIGNEXTEND, maot.OP_LT, maot.OP_GT, maot.OP_SLT, maot.OP_SGT, maot.OP_EQ,
+		maot.OP_AND, maot.OP_OR, maot.OP_XOR, maot.OP_BYTE, maot.OP_SHL, maot.OP_SHR, maot.OP_SAR,
+		maot.OP_KECCAK256:
+		return 2, 1
+	case maot.OP_MSTORE, maot.OP_MSTORE8, maot.OP_SSTORE, maot.OP_JUMPI, maot.OP_TSTORE, maot.OP_RETURN,
+		maot.OP_REVERT:
+		return 2, 0
+	case maot.OP_ADDMOD, maot.OP_MULMOD, maot.OP_CREATE:
+		return 3, 1
+	case maot.OP_CALLDATACOPY, maot.OP_CODECOPY, maot.OP_RETURNDATACOPY, maot.OP_MCOPY:
+		return 3, 0
+	case maot.OP_EXTCODECOPY:
+		return 4, 0
+	case maot.OP_CREATE2:
+		return 4, 1
+	case maot.OP_DELEGATECALL, maot.OP_STATICCALL:
+		return 6, 1
+	case maot.OP_CALL, maot.OP_CALLCODE:
+		return 7, 1
+	}
+	return 0, 0 // STOP, JUMPDEST, INVALID
+}
+
+var (
+	refModulus = new(big.Int).Lsh(big.NewInt(1), 256)
+	refSignBit = new(big.Int).Lsh(big.NewInt(1), 255)
+)
+
+// a 256-bit word as a non-negative big.Int below refModulus
+type refWord = *big.Int
+
+func refWrap(x *big.Int) refWord {
+	return x.Mod(x, refModulus)
+}
+
+func refSigned(x refWord) *big.Int {
+	if x.Cmp(refSignBit) >= 0 {
+		return new(big.Int).Sub(x, refModulus)
+	}
+	return new(big.Int).Set(x)
+}
+
+func refBool(b bool) refWord {
+	if b {
+		return big.NewInt(1)
+	}
+	return big.NewInt(0)
+}
+
+func refBytes(x refWord) (b Bytes32) {
+	x.FillBytes(b[:])
+	return
+}
+
+func refAddress(x refWord) (a Address) {
+	b := refBytes(x)
+	copy(a[:], b[12:])
+	return
+}
+
+// x if it is small enough to be an offset or a size, or else -1
+func refSmall(x refWord) int64 {
+	if x.BitLen() > 32 {
+		return -1
+	}
+	return x.Int64()
+}
+
+// bytes [offset, offset+size) of data, with zeros past its end
+func refSlice(data []byte, offset refWord, size int64) []byte {
+	res := make([]byte, size)
+	if off := refSmall(offset); off >= 0 && off < int64(len(data)) {
+		copy(res, data[off:])
+	}
+	return res
+}
+
+type refMachine struct {
+	in         *Interpreter
+	rev        int
+	msg        *Message
+	code       []byte
+	jumpdests  map[int]bool
+	stack      []refWord
+	memory     []byte
+	gas        int64
+	returnData []byte
+	output     []byte
+}
+
+// ExecuteBytecode runs code instruction by instruction without any analysis, checking the gas and
+// stack requirements of each instruction separately. It is the reference which the results of
+// Execute are compared against.
+func (in *Interpreter) ExecuteBytecode(rev int, msg *Message, code []byte) Result {
+	m := &refMachine{in: in, rev: rev, msg: msg, code: code, gas: msg.Gas, jumpdests: make(map[int]bool)}
+	for pc := 0; pc < len(code); pc++ {
+		if op := int(code[pc]); op == maot.OP_JUMPDEST {
+			m.jumpdests[pc] = true
+		} else if maot.OP_PUSH1 <= op && op <= maot.OP_PUSH32 {
+			pc += op - maot.OP_PUSH1 + 1
+		}
+	}
+	status := m.run()
+	if status != Success && status != Revert {
+		return Result{Status: status}
+	}
+	return Result{Status: status, GasLeft: m.gas, Output: m.output}
+}
+
+func (m *refMachine) pop() refWord {
+	x := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return x
+}
+
+func (m *refMachine) push(x refWord) {
+	m.stack = append(m.stack, x)
+}
+
+func (m *refMachine) useGas(gas int64) bool {
+	if gas > m.gas {
+		m.gas = 0
+		return false
+	}
+	m.gas -= gas
+	return true
+}
+
+func refMemCost(words int64) int64 {
+	return 3*words + words*words/512
+}
+
+// expand the memory for accessing size bytes at offset, charging the gas of the Yellow Paper
+func (m *refMachine) expand(offset, size refWord) bool {
+	if size.Sign() == 0 {
+		return true
+	}
+	off, n := refSmall(offset), refSmall(size)
+	if off < 0 || n < 0 {
+		return false
+	}
+	words := (off + n + 31) / 32
+	oldWords := int64(len(m.memory)) / 32
+	if words <= oldWords {
+		return true
+	}
+	if !m.useGas(refMemCost(words) - refMemCost(oldWords)) {
+		return false
+	}
+	m.memory = append(m.memory, make([]byte, 32*(words-oldWords))...)
+	return true
+}
+
+// the gas for copying size bytes, after expand has checked size
+func refCopyGas(size refWord) int64 {
+	return 3 * ((size.Int64() + 31) / 32)
+}
+
+func (m *refMachine) trace(pc, op int, gasCost int64) {
+	step := &Step{PC: pc, Op: op, GasLeft: m.gas, GasCost: gasCost, Depth: m.msg.Depth, MemSize: len(m.memory)}
+	step.Stack = make([]Bytes32, len(m.stack))
+	for i, x := range m.stack {
+		step.Stack[i] = refBytes(x)
+	}
+	m.in.Tracer(step)
+}
+
+func (m *refMachine) run() StatusCode {
+	pc := 0
+	for {
+		op := maot.OP_STOP // running past the end of the code stops
+		if pc < len(m.code) {
+			op = int(m.code[pc])
+		}
+		gas, defined := refStaticGas(m.rev, op)
+		if m.in.Tracer != nil {
+			m.trace(pc, op, gas)
+		}
+		if !defined {
+			return UndefinedInstruction
+		}
+		in, out := refArity(op)
+		if len(m.stack) < in {
+			return StackUnderflow
+		}
+		if len(m.stack)-in+out > StackLimit {
+			return StackOverflow
+		}
+		if !m.useGas(gas) {
+			return OutOfGas
+		}
+		next := pc + 1
+		if maot.OP_PUSH1 <= op && op <= maot.OP_PUSH32 {
+			n := op - maot.OP_PUSH1 + 1
+			var imm [32]byte
+			if pc+1 < len(m.code) {
+				copy(imm[32-n:], m.code[pc+1:]) // a PUSH cut off by the end of the code is padded on the right
+			}
+			m.push(new(big.Int).SetBytes(imm[:]))
+			next += n
+		} else if op == maot.OP_JUMP || op == maot.OP_JUMPI {
+			dest := m.pop()
+			if op == maot.OP_JUMP || m.pop().Sign() != 0 {
+				if !dest.IsInt64() || !m.jumpdests[int(dest.Int64())] {
+					return BadJumpDestination
+				}
+				next = int(dest.Int64())
+			}
+		} else if status := m.step(op, pc); status != running {
+			return status
+		}
+		pc = next
+	}
+}
+
+// execute an instruction other than PUSHn, JUMP and JUMPI, whose static gas has been charged
+func (m *refMachine) step(op, pc int) StatusCode {
+	host := m.in.Host
+	self := m.msg.Destination
+	switch {
+	case maot.OP_DUP1 <= op && op <= maot.OP_DUP16:
+		m.push(new(big.Int).Set(m.stack[len(m.stack)-1-(op-maot.OP_DUP1)]))
+		return running
+	case maot.OP_SWAP1 <= op && op <= maot.OP_SWAP16:
+		top, other := len(m.stack)-1, len(m.stack)-2-(op-maot.OP_SWAP1)
+		m.stack[top], m.stack[other] = m.stack[other], m.stack[top]
+		return running
+	case maot.OP_LOG0 <= op && op <= maot.OP_LOG4:
+		if m.msg.Static {
+			return StaticModeViolation
+		}
+		offset, size := m.pop(), m.pop()
+		if !m.expand(offset, size) || !m.useGas(8*size.Int64()) {
+			return OutOfGas
+		}
+		topics := make([]Bytes32, op-maot.OP_LOG0)
+		for i := range topics {
+			topics[i] = refBytes(m.pop())
+		}
+		var data []byte
+		if size.Sign() != 0 {
+			data = refSlice(m.memory, offset, size.Int64())
+		}
+		host.EmitLog(self, data, topics)
+		return running
+	}
+	switch op {
+	case maot.OP_STOP:
+		return Success
+	case maot.OP_JUMPDEST:
+	case maot.OP_ADD:
+		a, b := m.pop(), m.pop()
+		m.push(refWrap(new(big.Int).Add(a, b)))
+	case maot.OP_MUL:
+		a, b := m.pop(), m.pop()
+		m.push(refWrap(new(big.Int).Mul(a, b)))
+	case maot.OP_SUB:
+		a, b := m.pop(), m.pop()
+		m.push(refWrap(new(big.Int).Sub(a, b)))
+	case maot.OP_DIV, maot.OP_MOD:
+		a, b := m.pop(), m.pop()
+		switch {
+		case b.Sign() == 0:
+			m.push(big.NewInt(0))
+		case op == maot.OP_DIV:
+			m.push(new(big.Int).Div(a, b))
+		default:
+			m.push(new(big.Int).Mod(a, b))
+		}
+	case maot.OP_SDIV, maot.OP_SMOD:
+		a, b := refSigned(m.pop()), refSigned(m.pop())
+		switch {
+		case b.Sign() == 0:
+			m.push(big.NewInt(0))
+		case op == maot.OP_SDIV: // rounds toward zero, and -2^255 / -1 overflows to -2^255
+			m.push(refWrap(new(big.Int).Quo(a, b)))
+		default: // takes the sign of the dividend
+			m.push(refWrap(new(big.Int).Rem(a, b)))
+		}
+	case maot.OP_ADDMOD, maot.OP_MULMOD:
+		a, b, n := m.pop(), m.pop(), m.pop()
+		switch {
+		case n.Sign() == 0:
+			m.push(big.NewInt(0))
+		case op == maot.OP_ADDMOD:
+			m.push(new(big.Int).Mod(new(big.Int).Add(a, b), n))
+		default:
+			m.push(new(big.Int).Mod(new(big.Int).Mul(a, b), n))
+		}
+	case maot.OP_EXP:
+		base, exponent := m.pop(), m.pop()
+		perByte := int64(10)
+		if m.rev >= maot.EVMC_SPURIOUS_DRAGON { // EIP-160
+			perByte = 50
+		}
+		if !m.useGas(perByte * int64(len(exponent.Bytes()))) {
+			return OutOfGas
+		}
+		m.push(new(big.Int).Exp(base, exponent, refModulus))
+	case maot.OP_SIGNEXTEND:
+		k, x := m.pop(), m.pop()
+		if k.Cmp(big.NewInt(31)) >= 0 {
+			m.push(x)
+			break
+		}
+		b := refBytes(x)
+		signByte := 31 - int(k.Int64())
+		fill := byte(0)
+		if b[signByte]&0x80 != 0 {
+			fill = 0xff
+		}
+		for i := 0; i < signByte; i++ {
+			b[i] = fill
+		}
+		m.push(new(big.Int).SetBytes(b[:]))
+	case maot.OP_LT, maot.OP_GT, maot.OP_EQ:
+		c := m.pop().Cmp(m.pop())
+		m.push(refBool(op == maot.OP_LT && c < 0 || op == maot.OP_GT && c > 0 || op == maot.OP_EQ && c == 0))
+	case maot.OP_SLT, maot.OP_SGT:
+		c := refSigned(m.pop()).Cmp(refSigned(m.pop()))
+		m.push(refBool(op == maot.OP_SLT && c < 0 || op == maot.OP_SGT && c > 0))
+	case maot.OP_ISZERO:
+		m.push(refBool(m.pop().Sign() == 0))
+	case maot.OP_AND, maot.OP_OR, maot.OP_XOR:
+		a, b := refBytes(m.pop()), refBytes(m.pop())
+		for i := range a {
+			switch op {
+			case maot.OP_AND:
+				a[i] &= b[i]
+			case maot.OP_OR:
+				a[i] |= b[i]
+			default:
+				a[i] ^= b[i]
+			}
+		}
+		m.push(new(big.Int).SetBytes(a[:]))
+	case maot.OP_NOT:
+		a := refBytes(m.pop())
+		for i := range a {
+			a[i] = ^a[i]
+		}
+		m.push(new(big.Int).SetBytes(a[:]))
+	case maot.OP_BYTE:
+		i, x := m.pop(), m.pop()
+		if i.Cmp(big.NewInt(32)) >= 0 {
+			m.push(big.NewInt(0))
+		} else {
+			m.push(big.NewInt(int64(refBytes(x)[i.Int64()])))
+		}
+	case maot.OP_SHL, maot.OP_SHR, maot.OP_SAR:
+		shift, x := m.pop(), m.pop()
+		n := uint(256)
+		if shift.Cmp(big.NewInt(256)) < 0 {
+			n = uint(shift.Int64())
+		}
+		switch op {
+		case maot.OP_SHL:
+			m.push(refWrap(new(big.Int).Lsh(x, n)))
+		case maot.OP_SHR:
+			m.push(new(big.Int).Rsh(x, n))
+		default: // big.Int shifts negative numbers right with sign extension
+			m.push(refWrap(new(big.Int).Rsh(refSigned(x), n)))
+		}
+	case maot.OP_KECCAK256:
+		offset, size := m.pop(), m.pop()
+		if !m.expand(offset, size) || !m.useGas(6*((size.Int64()+31)/32)) {
+			return OutOfGas
+		}
+		var data []byte
+		if size.Sign() != 0 {
+			data = refSlice(m.memory, offset, size.Int64())
+		}
+		hash := keccak.Sum256(data)
+		m.push(new(big.Int).SetBytes(hash[:]))
+	case maot.OP_ADDRESS:
+		m.push(new(big.Int).SetBytes(self[:]))
+	case maot.OP_BALANCE, maot.OP_EXTCODESIZE, maot.OP_EXTCODEHASH:
+		addr := refAddress(m.pop())
+		if !m.touchAccount(addr) {
+			return OutOfGas
+		}
+		switch op {
+		case maot.OP_BALANCE:
+			balance := host.GetBalance(addr)
+			m.push(new(big.Int).SetBytes(balance[:]))
+		case maot.OP_EXTCODESIZE:
+			m.push(big.NewInt(int64(host.GetCodeSize(addr))))
+		default:
+			hash := host.GetCodeHash(addr)
+			m.push(new(big.Int).SetBytes(hash[:]))
+		}
+	case maot.OP_ORIGIN:
+		origin := host.GetTxContext().Origin
+		m.push(new(big.Int).SetBytes(origin[:]))
+	case maot.OP_CALLER:
+		m.push(new(big.Int).SetBytes(m.msg.Sender[:]))
+	case maot.OP_CALLVALUE:
+		m.push(new(big.Int).SetBytes(m.msg.Value[:]))
+	case maot.OP_CALLDATALOAD:
+		m.push(new(big.Int).SetBytes(refSlice(m.msg.Input, m.pop(), 32)))
+	case maot.OP_CALLDATASIZE:
+		m.push(big.NewInt(int64(len(m.msg.Input))))
+	case maot.OP_CODESIZE:
+		m.push(big.NewInt(int64(len(m.code))))
+	case maot.OP_CALLDATACOPY, maot.OP_CODECOPY, maot.OP_EXTCODECOPY:
+		var addr Address
+		if op == maot.OP_EXTCODECOPY {
+			addr = refAddress(m.pop())
+		}
+		dst, src, size := m.pop(), m.pop(), m.pop()
+		if !m.expand(dst, size) || !m.useGas(refCopyGas(size)) {
+			return OutOfGas
+		}
+		if op == maot.OP_EXTCODECOPY && !m.touchAccount(addr) {
+			return OutOfGas
+		}
+		if size.Sign() == 0 {
+			break
+		}
+		var data []byte
+		switch op {
+		case maot.OP_CALLDATACOPY:
+			data = refSlice(m.msg.Input, src, size.Int64())
+		case maot.OP_CODECOPY:
+			data = refSlice(m.code, src, size.Int64())
+		default:
+			data = make([]byte, size.Int64())
+			if off := refSmall(src); off >= 0 {
+				host.CopyCode(addr, int(off), data)
+			}
+		}
+		copy(m.memory[dst.Int64():], data)
+	case maot.OP_GASPRICE:
+		price := host.GetTxContext().GasPrice
+		m.push(new(big.Int).SetBytes(price[:]))
+	case maot.OP_RETURNDATASIZE:
+		m.push(big.NewInt(int64(len(m.returnData))))
+	case maot.OP_RETURNDATACOPY:
+		dst, src, size := m.pop(), m.pop(), m.pop()
+		if !m.expand(dst, size) {
+			return OutOfGas
+		}
+		if new(big.Int).Add(src, size).Cmp(big.NewInt(int64(len(m.returnData)))) > 0 { // EIP-211
+			return InvalidMemoryAccess
+		}
+		if !m.useGas(refCopyGas(size)) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			copy(m.memory[dst.Int64():], m.returnData[src.Int64():])
+		}
+	case maot.OP_BLOCKHASH:
+		n := m.pop()
+		current := big.NewInt(host.GetTxContext().Number)
+		age := new(big.Int).Sub(current, n)
+		if age.Sign() > 0 && age.Cmp(big.NewInt(256)) <= 0 {
+			hash := host.GetBlockHash(n.Int64())
+			m.push(new(big.Int).SetBytes(hash[:]))
+		} else {
+			m.push(big.NewInt(0))
+		}
+	case maot.OP_COINBASE:
+		coinbase := host.GetTxContext().Coinbase
+		m.push(new(big.Int).SetBytes(coinbase[:]))
+	case maot.OP_TIMESTAMP:
+		m.push(big.NewInt(host.GetTxContext().Timestamp))
+	case maot.OP_NUMBER:
+		m.push(big.NewInt(host.GetTxContext().Number))
+	case maot.OP_DIFFICULTY:
+		difficulty := host.GetTxContext().Difficulty
+		m.push(new(big.Int).SetBytes(difficulty[:]))
+	case maot.OP_GASLIMIT:
+		m.push(big.NewInt(host.GetTxContext().GasLimit))
+	case maot.OP_CHAINID:
+		chainID := host.GetTxContext().ChainID
+		m.push(new(big.Int).SetBytes(chainID[:]))
+	case maot.OP_SELFBALANCE:
+		balance := host.GetBalance(self)
+		m.push(new(big.Int).SetBytes(balance[:]))
+	case maot.OP_BASEFEE:
+		baseFee := host.GetTxContext().BaseFee
+		m.push(new(big.Int).SetBytes(baseFee[:]))
+	case maot.OP_BLOBHASH:
+		i, hashes := m.pop(), host.GetTxContext().BlobHashes
+		if i.IsInt64() && i.Int64() < int64(len(hashes)) {
+			m.push(new(big.Int).SetBytes(hashes[i.Int64()][:]))
+		} else {
+			m.push(big.NewInt(0))
+		}
+	case maot.OP_BLOBBASEFEE:
+		fee := host.GetTxContext().BlobBaseFee
+		m.push(new(big.Int).SetBytes(fee[:]))
+	case maot.OP_POP:
+		m.pop()
+	case maot.OP_MLOAD:
+		offset := m.pop()
+		if !m.expand(offset, big.NewInt(32)) {
+			return OutOfGas
+		}
+		m.push(new(big.Int).SetBytes(m.memory[offset.Int64() : offset.Int64()+32]))
+	case maot.OP_MSTORE, maot.OP_MSTORE8:
+		offset, value := m.pop(), refBytes(m.pop())
+		data := value[:]
+		if op == maot.OP_MSTORE8 {
+			data = value[31:]
+		}
+		if !m.expand(offset, big.NewInt(int64(len(data)))) {
+			return OutOfGas
+		}
+		copy(m.memory[offset.Int64():], data)
+	case maot.OP_SLOAD:
+		key := refBytes(m.pop())
+		if m.rev >= maot.EVMC_BERLIN && host.AccessStorage(self, key) == AccessCold && !m.useGas(2100-100) {
+			return OutOfGas
+		}
+		value := host.GetStorage(self, key)
+		m.push(new(big.Int).SetBytes(value[:]))
+	case maot.OP_SSTORE:
+		return m.sstore()
+	case maot.OP_PC:
+		m.push(big.NewInt(int64(pc)))
+	case maot.OP_MSIZE:
+		m.push(big.NewInt(int64(len(m.memory))))
+	case maot.OP_GAS:
+		m.push(big.NewInt(m.gas))
+	case maot.OP_TLOAD:
+		value := host.GetTransientStorage(self, refBytes(m.pop()))
+		m.push(new(big.Int).SetBytes(value[:]))
+	case maot.OP_TSTORE:
+		if m.msg.Static {
+			return StaticModeViolation
+		}
+		key, value := refBytes(m.pop()), refBytes(m.pop())
+		host.SetTransientStorage(self, key, value)
+	case maot.OP_MCOPY:
+		dst, src, size := m.pop(), m.pop(), m.pop()
+		if !m.expand(dst, size) || !m.expand(src, size) || !m.useGas(refCopyGas(size)) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			data := refSlice(m.memory, src, size.Int64())
+			copy(m.memory[dst.Int64():], data)
+		}
+	case maot.OP_PUSH0:
+		m.push(big.NewInt(0))
+	case maot.OP_CREATE, maot.OP_CREATE2:
+		return m.create(op)
+	case maot.OP_CALL, maot.OP_CALLCODE, maot.OP_DELEGATECALL, maot.OP_STATICCALL:
+		return m.call(op)
+	case maot.OP_RETURN, maot.OP_REVERT:
+		offset, size := m.pop(), m.pop()
+		if !m.expand(offset, size) {
+			return OutOfGas
+		}
+		if size.Sign() != 0 {
+			m.output = refSlice(m.memory, offset, size.Int64())
+		}
+		if op == maot.OP_REVERT {
+			return Revert
+		}
+		return Success
+	case maot.OP_INVALID:
+		return InvalidInstruction
+	case maot.OP_SELFDESTRUCT:
+		if m.msg.Static {
+			return StaticModeViolation
+		}
+		beneficiary := refAddress(m.pop())
+		if m.rev >= maot.EVMC_BERLIN && host.AccessAccount(beneficiary) == AccessCold && !m.useGas(2600) {
+			return OutOfGas
+		}
+		// EIP-150 charges for creating the beneficiary, and EIP-161 only if there is a balance to send
+		newAccount := m.rev >= maot.EVMC_TANGERINE_WHISTLE && !host.AccountExists(beneficiary)
+		if m.rev >= maot.EVMC_SPURIOUS_DRAGON {
+			balance := host.GetBalance(self)
+			newAccount = newAccount && balance != (Bytes32{})
+		}
+		if newAccount && !m.useGas(25000) {
+			return OutOfGas
+		}
+		host.Selfdestruct(self, beneficiary)
+		return Success
+	default:
+		return UndefinedInstruction
+	}
+	return running
+}
+
+// charge the cold surcharge of EIP-2929 for accessing addr
+func (m *refMachine) touchAccount(addr Address) bool {
+	if m.rev >= maot.EVMC_BERLIN && m.in.Host.AccessAccount(addr) == AccessCold {
+		return m.useGas(2600 - 100)
+	}
+	return true
+}
+
+func (m *refMachine) sstore() StatusCode {
+	host := m.in.Host
+	if m.msg.Static {
+		return StaticModeViolation
+	}
+	if m.rev >= maot.EVMC_ISTANBUL && m.gas <= 2300 { // the sentry of EIP-2200
+		return OutOfGas
+	}
+	key, value := refBytes(m.pop()), refBytes(m.pop())
+	var cold int64
+	if m.rev >= maot.EVMC_BERLIN && host.AccessStorage(m.msg.Destination, key) == AccessCold {
+		cold = 2100
+	}
+	status := host.SetStorage(m.msg.Destination, key, value)
+	var gas int64
+	switch {
+	case m.rev >= maot.EVMC_BERLIN: // EIP-2929 on top of EIP-2200
+		gas = map[StorageStatus]int64{StorageAdded: 20000, StorageModified: 2900, StorageDeleted: 2900}[status]
+		if gas == 0 {
+			gas = 100
+		}
+	case m.rev >= maot.EVMC_ISTANBUL: // EIP-2200
+		gas = map[StorageStatus]int64{StorageAdded: 20000, StorageModified: 5000, StorageDeleted: 5000}[status]
+		if gas == 0 {
+			gas = 800
+		}
+	case m.rev == maot.EVMC_CONSTANTINOPLE: // EIP-1283, which Petersburg removed
+		gas = map[StorageStatus]int64{StorageAdded: 20000, StorageModified: 5000, StorageDeleted: 5000}[status]
+		if gas == 0 {
+			gas = 200
+		}
+	default:
+		gas = 5000
+		if status == StorageAdded {
+			gas = 20000
+		}
+	}
+	if !m.useGas(cold + gas) {
+		return OutOfGas
+	}
+	return running
+}
+
+func (m *refMachine) call(op int) StatusCode {
+	host := m.in.Host
+	gasArg, addr := m.pop(), refAddress(m.pop())
+	value := big.NewInt(0)
+	if op == maot.OP_CALL || op == maot.OP_CALLCODE {
+		value = m.pop()
+	}
+	inOffset, inSize, outOffset, outSize := m.pop(), m.pop(), m.pop(), m.pop()
+	success := big.NewInt(0)
+	m.push(success)
+	if !m.touchAccount(addr) || !m.expand(inOffset, inSize) || !m.expand(outOffset, outSize) {
+		return OutOfGas
+	}
+	transfers := value.Sign() != 0
+	if op == maot.OP_CALL && transfers && m.msg.Static {
+		return StaticModeViolation
+	}
+	var extra int64
+	if transfers {
+		extra += 9000
+	}
+	// creating an account, which EIP-161 only charges when value is sent
+	if op == maot.OP_CALL && (transfers || m.rev < maot.EVMC_SPURIOUS_DRAGON) && !host.AccountExists(addr) {
+		extra += 25000
+	}
+	if !m.useGas(extra) {
+		return OutOfGas
+	}
+	gas := int64(math.MaxInt64)
+	if gasArg.IsInt64() {
+		gas = gasArg.Int64()
+	}
+	if m.rev >= maot.EVMC_TANGERINE_WHISTLE { // all but one 64th, EIP-150
+		if limit := m.gas - m.gas/64; gas > limit {
+			gas = limit
+		}
+	} else if gas > m.gas {
+		return OutOfGas
+	}
+	msg := &Message{Kind: Call, Static: m.msg.Static, Depth: m.msg.Depth + 1, Gas: gas,
+		Destination: addr, Sender: m.msg.Destination, Value: refBytes(value)}
+	switch op {
+	case maot.OP_CALLCODE:
+		msg.Kind = CallCode
+	case maot.OP_DELEGATECALL:
+		msg.Kind, msg.Sender, msg.Value = DelegateCall, m.msg.Sender, m.msg.Value
+	case maot.OP_STATICCALL:
+		msg.Static = true
+	}
+	if inSize.Sign() != 0 {
+		msg.Input = refSlice(m.memory, inOffset, inSize.Int64())
+	}
+	if transfers { // the stipend is given to the callee for free
+		msg.Gas += 2300
+		m.gas += 2300
+	}
+	m.returnData = nil
+	if m.msg.Depth >= CallDepthMax {
+		return running
+	}
+	if balance := host.GetBalance(m.msg.Destination); transfers && new(big.Int).SetBytes(balance[:]).Cmp(value) < 0 {
+		return running
+	}
+	m.gas -= msg.Gas
+	res := host.Call(msg)
+	m.gas += res.GasLeft
+	m.returnData = res.Output
+	if res.Status == Success {
+		success.SetInt64(1)
+	}
+	if outSize.Sign() != 0 {
+		copy(m.memory[outOffset.Int64():outOffset.Int64()+outSize.Int64()], res.Output)
+	}
+	return running
+}
+
+func (m *refMachine) create(op int) StatusCode {
+	host := m.in.Host
+	if m.msg.Static {
+		return StaticModeViolation
+	}
+	value, offset, size := m.pop(), m.pop(), m.pop()
+	var salt Bytes32
+	if op == maot.OP_CREATE2 {
+		salt = refBytes(m.pop())
+	}
+	address := big.NewInt(0)
+	m.push(address)
+	if !m.expand(offset, size) {
+		return OutOfGas
+	}
+	words := (size.Int64() + 31) / 32
+	if op == maot.OP_CREATE2 && !m.useGas(6*words) { // hashing the init code
+		return OutOfGas
+	}
+	if m.rev >= maot.EVMC_SHANGHAI && (size.Int64() > 2*24576 || !m.useGas(2*words)) { // EIP-3860
+		return OutOfGas
+	}
+	m.returnData = nil
+	if m.msg.Depth >= CallDepthMax {
+		return running
+	}
+	if balance := host.GetBalance(m.msg.Destination); new(big.Int).SetBytes(balance[:]).Cmp(value) < 0 {
+		return running
+	}
+	gas := m.gas
+	if m.rev >= maot.EVMC_TANGERINE_WHISTLE {
+		gas -= gas / 64
+	}
+	msg := &Message{Kind: Create, Depth: m.msg.Depth + 1, Gas: gas, Sender: m.msg.Destination,
+		Value: refBytes(value), Create2Salt: salt}
+	if op == maot.OP_CREATE2 {
+		msg.Kind = Create2
+	}
+	if size.Sign() != 0 {
+		msg.Input = refSlice(m.memory, offset, size.Int64())
+	}
+	m.gas -= gas
+	res := host.Call(msg)
+	m.gas += res.GasLeft
+	m.returnData = res.Output
+	if res.Status == Success {
+		address.SetBytes(res.CreateAddress[:])
+	}
+	return running
+}
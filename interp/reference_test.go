@@ -0,0 +1,54 @@
+package interp
+
+import (
+	"testing"
+
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// a host without any account, which the snippets below never call into
+type emptyHost struct{ Host }
+
+func (emptyHost) AccessStorage(Address, Bytes32) AccessStatus { return AccessCold }
+func (emptyHost) GetStorage(Address, Bytes32) Bytes32         { return Bytes32{} }
+func (emptyHost) SetStorage(Address, Bytes32, Bytes32) StorageStatus {
+	return StorageAdded
+}
+
+// The gas used by small programs, computed by hand from the Yellow Paper and the EIPs, so that the
+// reference is checked against the specification rather than against Execute.
+func TestReferenceGas(t *testing.T) {
+	cases := []struct {
+		name   string
+		rev    int
+		code   []byte
+		gas    int64
+		status StatusCode
+	}{
+		// 4 PUSHes and 2 MSTOREs, 22 words cost 66+0 and 23 words 69+1
+		{"memory", maot.EVMC_LONDON, []byte{0x60, 0, 0x61, 0x02, 0xa0, 0x52, 0x60, 0, 0x61, 0x02, 0xc0, 0x52}, 12 + 6 + 70, Success},
+		// PUSH1 2 PUSH1 0xff EXP: one byte of exponent costs 50 since EIP-160, and 10 before
+		{"exp", maot.EVMC_BYZANTIUM, []byte{0x60, 2, 0x60, 0xff, 0x0a}, 6 + 10 + 50, Success},
+		{"exp-frontier", maot.EVMC_FRONTIER, []byte{0x60, 2, 0x60, 0xff, 0x0a}, 6 + 10 + 10, Success},
+		// PUSH1 1 PUSH1 0 SSTORE: a cold new slot is 2100+20000 since EIP-2929, and 20000 before
+		{"sstore", maot.EVMC_BERLIN, []byte{0x60, 1, 0x60, 0, 0x55}, 6 + 22100, Success},
+		{"sstore-istanbul", maot.EVMC_ISTANBUL, []byte{0x60, 1, 0x60, 0, 0x55}, 6 + 20000, Success},
+		// PUSH1 0 SLOAD: a cold slot is 2100 since EIP-2929, and 800 in Istanbul
+		{"sload", maot.EVMC_LONDON, []byte{0x60, 0, 0x54}, 3 + 2100, Success},
+		{"sload-istanbul", maot.EVMC_ISTANBUL, []byte{0x60, 0, 0x54}, 3 + 800, Success},
+		// PUSH1 4 JUMP JUMPDEST? the byte 0x5b at pc 4 is PUSH1's data
+		{"jump-into-push", maot.EVMC_LONDON, []byte{0x60, 4, 0x56, 0x60, 0x5b}, 0, BadJumpDestination},
+		{"push0-shanghai", maot.EVMC_SHANGHAI, []byte{0x5f}, 2, Success},
+		{"push0-paris", maot.EVMC_PARIS, []byte{0x5f}, 0, UndefinedInstruction},
+		{"underflow", maot.EVMC_LONDON, []byte{0x01}, 0, StackUnderflow},
+	}
+	for _, c := range cases {
+		in := &Interpreter{Host: emptyHost{}}
+		res := in.ExecuteBytecode(c.rev, &Message{Gas: 100000}, c.code)
+		if res.Status != c.status {
+			t.Errorf("%s: status %v, want %v", c.name, res.Status, c.status)
+		} else if c.status == Success && 100000-res.GasLeft != c.gas {
+			t.Errorf("%s: used %d gas, want %d", c.name, 100000-res.GasLeft, c.gas)
+		}
+	}
+}
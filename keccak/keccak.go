@@ -0,0 +1,123 @@
+// Package keccak implements the legacy Keccak-256 hash used by Ethereum, which differs from
+// SHA3-256 only in the padding byte.
+package keccak
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const rate = 136 // in bytes, for a capacity of 512 bits
+
+var roundConstants = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808a, 0x8000000080008000,
+	0x000000000000808b, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008a, 0x0000000000000088, 0x0000000080008009, 0x000000008000000a,
+	0x000000008000808b, 0x800000000000008b, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800a, 0x800000008000000a,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+// rotation offsets and the lane positions visited by the combined rho and pi steps
+var rotations = [24]int{1, 3, 6, 10, 15, 21, 28, 36, 45, 55, 2, 14, 27, 41, 56, 8, 25, 43, 62, 18, 39, 61, 20, 44}
+var piLanes = [24]int{10, 7, 11, 17, 18, 3, 5, 16, 8, 21, 24, 4, 15, 23, 19, 13, 12, 2, 20, 14, 22, 9, 6, 1}
+
+func keccakF1600(a *[25]uint64) {
+	var c [5]uint64
+	for round := 0; round < 24; round++ {
+		// theta
+		for x := 0; x < 5; x++ {
+			c[x] = a[x] ^ a[x+5] ^ a[x+10] ^ a[x+15] ^ a[x+20]
+		}
+		for x := 0; x < 5; x++ {
+			d := c[(x+4)%5] ^ bits.RotateLeft64(c[(x+1)%5], 1)
+			for y := 0; y < 25; y += 5 {
+				a[y+x] ^= d
+			}
+		}
+		// rho and pi
+		t := a[1]
+		for i := 0; i < 24; i++ {
+			j := piLanes[i]
+			t, a[j] = a[j], bits.RotateLeft64(t, rotations[i])
+		}
+		// chi
+		for y := 0; y < 25; y += 5 {
+			copy(c[:], a[y:y+5])
+			for x := 0; x < 5; x++ {
+				a[y+x] = c[x] ^ (^c[(x+1)%5] & c[(x+2)%5])
+			}
+		}
+		// iota
+		a[0] ^= roundConstants[round]
+	}
+}
+
+type digest struct {
+	state [25]uint64
+	buf   []byte // the bytes not absorbed yet, shorter than rate
+}
+
+// New returns a hash.Hash computing Keccak-256
+func New() hash.Hash {
+	return &digest{buf: make([]byte, 0, rate)}
+}
+
+func (d *digest) absorb(block []byte) {
+	for i := 0; i < rate/8; i++ {
+		d.state[i] ^= binary.LittleEndian.Uint64(block[i*8:])
+	}
+	keccakF1600(&d.state)
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(d.buf) != 0 {
+		k := copy(d.buf[len(d.buf):rate], p)
+		d.buf = d.buf[:len(d.buf)+k]
+		p = p[k:]
+		if len(d.buf) < rate {
+			return n, nil
+		}
+		d.absorb(d.buf)
+		d.buf = d.buf[:0]
+	}
+	for len(p) >= rate {
+		d.absorb(p[:rate])
+		p = p[rate:]
+	}
+	d.buf = append(d.buf, p...)
+	return n, nil
+}
+
+func (d *digest) Sum(in []byte) []byte {
+	dup := *d // Sum must not change the state
+	var block [rate]byte
+	copy(block[:], dup.buf)
+	block[len(dup.buf)] ^= 0x01 // the legacy padding, SHA3 uses 0x06
+	block[rate-1] ^= 0x80
+	dup.absorb(block[:])
+	var out [32]byte
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(out[i*8:], dup.state[i])
+	}
+	return append(in, out[:]...)
+}
+
+func (d *digest) Reset() {
+	d.state = [25]uint64{}
+	d.buf = d.buf[:0]
+}
+
+func (d *digest) Size() int { return 32 }
+
+func (d *digest) BlockSize() int { return rate }
+
+// Sum256 returns the Keccak-256 digest of data
+func Sum256(data []byte) (out [32]byte) {
+	d := New()
+	d.Write(data)
+	copy(out[:], d.Sum(nil))
+	return
+}
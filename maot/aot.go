@@ -1,21 +1,32 @@
 package maot
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/smartbch/moeingaot/keccak"
 )
 
 type BlockInfo struct {
-	GasCost        uint32
+	GasCost        uint32 // the sum of the static costs only, see GasModelOf for what is charged at run time
 	StackReq       int16
 	StackMaxGrowth int16
+	Dead           bool // set by markReachable if no execution can enter the block, so no code is emitted
+	// set by proveStackHeights if the stack height when entering the block always satisfies StackReq
+	// and StackMaxGrowth, so only the gas is checked at run time
+	Proven      bool
+	EntryHeight int16 // the exact height if Proven, or -1 if only its range is known
+	// set by mergeBlocks on the first block of a super-block, the combined requirements of its blocks
+	Super  *BlockInfo
+	Merged bool   // set by mergeBlocks on the other blocks of a super-block
+	Rest   uint32 // the static gas of the blocks after this one in its super-block
 }
 
 type BlockAnalysis struct {
@@ -46,26 +57,51 @@ type Instruction struct {
 	OpCode         int
 	Number         int
 	PushValue      string
+	PushWords      [4]uint64 // the same value as PushValue, the most significant word first
 	SmallPushValue uint64
 	Block          BlockInfo
+	Targets        []int // possible targets of a JUMP/JUMPI whose target is not fused
+	Fusion         int   // a super-instruction starts here if positive, or it is a part of one if -1
 }
 
 // For PUSH9~PUSH32
 func (i *Instruction) SetPushValue(bz []byte) {
 	var b32 [32]byte
 	copy(b32[32-len(bz):], bz)
+	for j := range i.PushWords {
+		i.PushWords[j] = binary.BigEndian.Uint64(b32[j*8 : j*8+8])
+	}
 	i.PushValue = fmt.Sprintf("0x%xull, 0x%xull, 0x%xull, 0x%xull",
-		binary.BigEndian.Uint64(b32[0:8]),
-		binary.BigEndian.Uint64(b32[8:16]),
-		binary.BigEndian.Uint64(b32[16:24]),
-		binary.BigEndian.Uint64(b32[24:32]))
+		i.PushWords[0], i.PushWords[1], i.PushWords[2], i.PushWords[3])
+}
+
+// A range of bytes in the bytecode, [Start, End)
+type CodeRange struct {
+	Start int
+	End   int
+}
+
+func (r CodeRange) Len() int {
+	return r.End - r.Start
 }
 
 type AdvancedCodeAnalysis struct {
+	Rev       int
+	Options   Options
 	InstrList []*Instruction
 	// the following two fields contain the same targets
 	JumpdestTargets []int
 	TargetsSet      map[int]struct{}
+	// the bytes which can not be reached from PC 0 are data and no code is generated for them
+	DataRanges []CodeRange
+	// The CBOR metadata appended by Solidity or Vyper, empty if not found. Analyze scans it like other
+	// data, so a 0x5b byte in it is still a JUMPDEST as in evmone, and only the blocks which begin at
+	// such JUMPDESTs get code.
+	Metadata CodeRange
+	// the compiled executor only runs the bytecode equal to Code, which is embedded into it
+	Code     []byte
+	CodeSize int
+	CodeHash [32]byte // for query_executor_by_codehash
 }
 
 func max(a, b int) int {
@@ -75,18 +111,57 @@ func max(a, b int) int {
 	return b
 }
 
-func Analyze(rev int, codeArr []byte) (analysis AdvancedCodeAnalysis) {
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// the size of an instruction's immediate data, which is non-zero only for PUSH1~PUSH32
+func immediateSize(opCode byte) int {
+	if OP_PUSH1 <= opCode && opCode <= OP_PUSH32 {
+		return int(opCode-OP_PUSH1) + 1
+	}
+	return 0
+}
+
+func Analyze(rev int, codeArr []byte, opts Options) (analysis AdvancedCodeAnalysis) {
 	opTbl := OpTables[rev]
 
+	analysis.Rev = rev
+	analysis.Options = opts
+	analysis.Code = codeArr
+	analysis.CodeSize = len(codeArr)
+	analysis.CodeHash = keccak.Sum256(codeArr)
 	analysis.TargetsSet = make(map[int]struct{})
 	analysis.InstrList = make([]*Instruction, 0, len(codeArr)+1)
 	instr := &Instruction{OpCode: OPX_BEGINBLOCK, PC: -1} // for the first basic block
 	analysis.InstrList = append(analysis.InstrList, instr)
 
+	if n := MetadataSize(codeArr); n != 0 {
+		analysis.Metadata = CodeRange{Start: len(codeArr) - n, End: len(codeArr)}
+	}
+
 	block := NewBlockAnalysis(0)
 	codePos := 0
+	reachable := true // can the current byte be reached by falling through from the previous instruction?
+	dataStart := 0
 	for codePos < len(codeArr) {
 		opCode := codeArr[codePos]
+		if !reachable {
+			if opCode != OP_JUMPDEST { // skip it, but still respect PUSH's data when looking for JUMPDEST
+				codePos = min(codePos+1+immediateSize(opCode), len(codeArr))
+				continue
+			}
+			if dataStart < codePos {
+				analysis.DataRanges = append(analysis.DataRanges, CodeRange{Start: dataStart, End: codePos})
+			}
+			reachable = true
+			instr := &Instruction{OpCode: OPX_BEGINBLOCK, PC: codePos}
+			analysis.InstrList = append(analysis.InstrList, instr)
+			block = NewBlockAnalysis(len(analysis.InstrList) - 1) // open a new block for this JUMPDEST
+		}
 		codePos++
 		opInfo := opTbl[opCode]
 
@@ -106,9 +181,13 @@ func Analyze(rev int, codeArr []byte) (analysis AdvancedCodeAnalysis) {
 		}
 
 		instr = analysis.InstrList[len(analysis.InstrList)-1]
-		isTerminator := false // does it terminate a basic block?
+		isTerminator := false                              // does it terminate a basic block?
+		noFallThrough := opInfo.FuncName == "op_undefined" // is the next byte unreachable from it?
 		switch opCode {
-		case OP_JUMP, OP_JUMPI, OP_STOP, OP_RETURN, OP_REVERT, OP_SELFDESTRUCT:
+		case OP_JUMP, OP_STOP, OP_RETURN, OP_REVERT, OP_SELFDESTRUCT, OP_INVALID:
+			isTerminator = true
+			noFallThrough = true
+		case OP_JUMPI:
 			isTerminator = true
 		case OP_PUSH1, OP_PUSH2, OP_PUSH3, OP_PUSH4,
 			OP_PUSH5, OP_PUSH6, OP_PUSH7, OP_PUSH8:
@@ -147,11 +226,16 @@ func Analyze(rev int, codeArr []byte) (analysis AdvancedCodeAnalysis) {
 			last := analysis.InstrList[lastIdx]
 			if (OP_PUSH1 <= last.OpCode && last.OpCode <= OP_PUSH3) && last.SmallPushValue != 0 {
 				instr.Number = int(last.SmallPushValue)
+				last.Number = last.OpCode // remember which PUSH it was
 				analysis.InstrList[lastIdx].OpCode = NOP
 			}
 		}
 
-		if isTerminator || (codePos < len(codeArr) && codeArr[codePos] == OP_JUMPDEST) {
+		if noFallThrough {
+			analysis.InstrList[block.BeginBlockIndex].Block = block.Close() //close the last basic block
+			reachable = false                                               // the following bytes are data until the next JUMPDEST
+			dataStart = codePos
+		} else if isTerminator || (codePos < len(codeArr) && codeArr[codePos] == OP_JUMPDEST) {
 			analysis.InstrList[block.BeginBlockIndex].Block = block.Close() //close the last basic block
 			//fmt.Printf("At Close %d %#v\n", block.BeginBlockIndex, analysis.InstrList[block.BeginBlockIndex].Block)
 			instr := &Instruction{OpCode: OPX_BEGINBLOCK, PC: codePos}
@@ -159,71 +243,227 @@ func Analyze(rev int, codeArr []byte) (analysis AdvancedCodeAnalysis) {
 			block = NewBlockAnalysis(len(analysis.InstrList) - 1) // open a new block
 		}
 	}
-	// Save current block.
-	analysis.InstrList[block.BeginBlockIndex].Block = block.Close()
+	if reachable { // Save current block.
+		analysis.InstrList[block.BeginBlockIndex].Block = block.Close()
+	} else if dataStart < len(codeArr) {
+		analysis.DataRanges = append(analysis.DataRanges, CodeRange{Start: dataStart, End: len(codeArr)})
+	}
 
 	instr = &Instruction{OpCode: OP_STOP, PC: codePos}
 	analysis.InstrList = append(analysis.InstrList, instr)
+	analysis.resolveJumps()
+	analysis.markReachable()
+	analysis.proveStackHeights()
+	analysis.mergeBlocks()
+	analysis.fuseInstructions()
 	return
 }
 
-func (analysis AdvancedCodeAnalysis) Dump(name string, fout io.Writer) {
-	enterInfo := fmt.Sprintf("\n    std::cout<<\"enter %s\"<<std::endl;", name) // for debug
-	wr(fout, fmt.Sprintf(`#include <memory>
+func (analysis AdvancedCodeAnalysis) Dump(name string, fout io.Writer) error {
+	return DumpExecutors(name, []AdvancedCodeAnalysis{analysis}, fout)
+}
+
+// the name of the executor function compiled for one revision
+func revExecutorName(name string, rev int) string {
+	return fmt.Sprintf("execute_%s_%s", name, RevisionNames[rev])
+}
+
+// the name of a revision in evmc_revision, such that the C++ compiler rejects the revisions unknown
+// to the EVMC headers instead of dispatching on a number which means another revision there
+func revisionEnum(rev int) string {
+	return "EVMC_" + strings.ToUpper(RevisionNames[rev])
+}
+
+// a C++ initializer list of bytes, with 32 bytes per line
+func bytesInitializer(bz []byte) string {
+	var lines []string
+	for start := 0; start < len(bz); start += 32 {
+		items := make([]string, 0, 32)
+		for _, b := range bz[start:min(start+32, len(bz))] {
+			items = append(items, fmt.Sprintf("0x%02x", b))
+		}
+		lines = append(lines, strings.Join(items, ","))
+	}
+	return "{" + strings.Join(lines, ",\n        ") + "}"
+}
+
+// The condition of running the compiled executor, which compares the code with an embedded copy.
+// It costs much less than hashing the code on every call, and the size is checked first.
+func codeCheck(code []byte) string {
+	if len(code) == 0 {
+		return "    if(code_size != 0)\n"
+	}
+	return fmt.Sprintf(`    static const uint8_t compiled_code[%d] = %s;
+    if(code_size != %d || (code != compiled_code && std::memcmp(code, compiled_code, %d) != 0))
+`, len(code), bytesInitializer(code), len(code), len(code))
+}
+
+// Dump a C++ file containing execute_<name>, which dispatches on the evmc_revision argument
+// to the executor compiled for this revision. Each analysis must be of a different revision.
+// For the revisions without a compiled executor, evmone's interpreter is used.
+// execute_<name> also falls back to evmone's interpreter when the code passed to it is not the
+// compiled one, for example, after the account is self-destructed and re-created with CREATE2.
+// All the functions are in the namespace selected by the Options of the analyses.
+func DumpExecutors(name string, analyses []AdvancedCodeAnalysis, fout io.Writer) error {
+	if err := checkContractName(name); err != nil {
+		return err
+	}
+	if err := analyses[0].Options.checkSymbols(); err != nil {
+		return err
+	}
+	syms := analyses[0].Options.symbols()
+	ew := newErrWriter(fout)
+	fout = ew
+	wr(fout, `#include <memory>
 #include <iostream>
+#include <cstring>
+#include "execution.hpp"
 #include "instrexe.hpp"
-extern "C" { // declare the execute function with C linkage
-evmc_result execute_%s(evmc_vm* /*unused*/, const evmc_host_interface* host, evmc_host_context* ctx,
+%sevmc_result %s(evmc_vm* vm, const evmc_host_interface* host, evmc_host_context* ctx,
     evmc_revision rev, const evmc_message* msg, const uint8_t* code, size_t code_size) noexcept;
+`, syms.open(), syms.executor(name))
+	for _, analysis := range analyses {
+		analysis.dumpExecutor(name, fout)
+	}
+	wr(fout, `
+evmc_result %s(evmc_vm* vm, const evmc_host_interface* host, evmc_host_context* ctx,
+    evmc_revision rev, const evmc_message* msg, const uint8_t* code, size_t code_size) noexcept
+{
+%s        return evmone::execute(vm, host, ctx, rev, msg, code, code_size); // not the compiled code
+    switch(rev) {
+`, syms.executor(name), codeCheck(analyses[0].Code))
+	for _, analysis := range analyses {
+		wr(fout, "    case %s:\n", revisionEnum(analysis.Rev))
+		wr(fout, "        return %s(vm, host, ctx, rev, msg, code, code_size);\n",
+			revExecutorName(name, analysis.Rev))
+	}
+	wr(fout, `    default: // not compiled for this revision
+        return evmone::execute(vm, host, ctx, rev, msg, code, code_size);
+    }
+}
+%s`, syms.close())
+	return ew.err
 }
 
-evmc_result execute_%s(evmc_vm* /*unused*/, const evmc_host_interface* host, evmc_host_context* ctx,
+// Dump the executor compiled for analysis.Rev
+func (analysis AdvancedCodeAnalysis) dumpExecutor(name string, fout io.Writer) {
+	enterInfo := ""
+	if analysis.Options.Mode == EmitStackDump {
+		enterInfo = fmt.Sprintf("\n    std::cout<<\"enter %s\"<<std::endl;", name) // for debug
+	}
+	// the body is emitted first, which collects the statistics of the stack cache for the comments
+	var body bytes.Buffer
+	var cacheStats StackCacheStats
+	analysis.dumpAllInstr(&body, &cacheStats)
+	mergeStats := analysis.MergeStats()
+	wr(fout, "\n// jumps: %s\n// reachability: %s\n// fusion: %s\n// stack cache: %s\n// stack heights: %s\n"+
+		"// super-blocks: %s\n// jump table: %s\n", analysis.JumpStats(), analysis.ReachStats(), analysis.FusionStats(),
+		cacheStats, analysis.StackHeightStats(), mergeStats, analysis.jumpTableDesc(name))
+	localsInfo := ""
+	if mergeStats.SuperBlocks != 0 {
+		localsInfo = "\n    bool fast = false; // is the current super-block checked as a whole?"
+	}
+	wr(fout, fmt.Sprintf(`static evmc_result %s(evmc_vm* /*unused*/, const evmc_host_interface* host, evmc_host_context* ctx,
     evmc_revision rev, const evmc_message* msg, const uint8_t* code, size_t code_size) noexcept
 {%s
     auto state = std::make_unique<evmone::AdvancedExecutionState>(*msg, rev, *host, ctx, code, code_size);
     evmone::instruction instr(nullptr);
     evmone::instruction* next_instr = 1 + &instr;
-    size_t PC = ~size_t(0);
-`, name, name, enterInfo))
-	analysis.DumpAllInstr(fout)
-	analysis.DumpJumpTable(fout)
+    size_t PC = ~size_t(0);%s
+`, revExecutorName(name, analysis.Rev), enterInfo, localsInfo))
+	fout.Write(body.Bytes())
+	analysis.dumpJumpTable(fout, analysis.jumpTableKind(name))
 	wr(fout, "}\n")
 }
 
-// The JumpTable is a PC-to-label table implemented with "switch"
-func (analysis AdvancedCodeAnalysis) DumpJumpTable(fout io.Writer) {
+// The JumpTable is a PC-to-label table implemented with "switch" or computed goto, see JumpTableKind
+func (analysis AdvancedCodeAnalysis) DumpJumpTable(fout io.Writer) error {
+	return analysis.dumpJumpTable(fout, analysis.jumpTableKind(""))
+}
+
+func (analysis AdvancedCodeAnalysis) dumpJumpTable(fout io.Writer, kind JumpTableKind) error {
+	ew := newErrWriter(fout)
+	fout = ew
 	wr(fout, "JUMPTABLE:\n")
-	wr(fout, "switch(PC){\n")
-	for _, target := range analysis.JumpdestTargets {
-		wr(fout, "  case %d: goto L%05d;\n", target, target)
-	}
-	wr(fout, "  default:\n")
+	targets := analysis.JumpTableTargets()
+	dumpJumpDispatch(fout, targets, kind, denseJumpTable(targets))
 	wr(fout, "    state->exit(EVMC_BAD_JUMP_DESTINATION);\n")
-	wr(fout, `}
-ENDING:
+	wr(fout, `ENDING:
     const auto gas_left =
         (state->status == EVMC_SUCCESS || state->status == EVMC_REVERT) ? state->gas_left : 0;
 
     return evmc::make_result(
         state->status, gas_left, state->memory.data() + state->output_offset, state->output_size);
 `)
+	return ew.err
+}
+
+func (analysis AdvancedCodeAnalysis) DumpAllInstr(fout io.Writer) error {
+	return analysis.dumpAllInstr(fout, nil)
 }
 
-func (analysis AdvancedCodeAnalysis) DumpAllInstr(fout io.Writer) {
+// the statistics of the stack cache are added to stats if it is not nil
+func (analysis AdvancedCodeAnalysis) dumpAllInstr(fout io.Writer, stats *StackCacheStats) error {
+	ew := newErrWriter(fout)
+	fout = ew
+	opTbl := OpTables[analysis.Rev]
+	cache := analysis.newStackCache(fout)
+	blockOffset := 0  // the gas cost of the instructions executed since the beginning of the basic block
+	rest := uint32(0) // the static gas of the blocks after the current one in its super-block
+	dead := false     // is the current basic block unreachable?
 	wr(fout, "L00000:\n")
-	for _, instr := range analysis.InstrList {
+	for i, instr := range analysis.InstrList {
+		if instr.OpCode == OPX_BEGINBLOCK {
+			dead = instr.Block.Dead
+			if dead {
+				wr(fout, "// pc=%d unreachable block omitted\n", instr.PC)
+			}
+		}
+		if dead {
+			continue
+		}
+		cached := cache != nil && instr.OpCode != NOP && instr.Fusion == 0 &&
+			opTbl[instr.OpCode].FuncName != "op_undefined" && cache.canEmit(instr)
+		if cache != nil && !cached && instr.OpCode != NOP && instr.Fusion >= 0 {
+			cache.flush() // also before the labels, which must be outside the scope of the locals
+		}
 		if instr.OpCode == OP_JUMPDEST && instr.PC > 0 {
 			wr(fout, "L%05d:\n", instr.PC) // a label at the beginning of a basic block
 		}
+		if instr.OpCode == OPX_BEGINBLOCK {
+			blockOffset = 0
+			rest = instr.Block.Rest
+		}
+		if analysis.Options.Mode == EmitTrace {
+			analysis.dumpTraceStep(fout, instr, blockOffset)
+		}
 		if instr.OpCode == NOP {
+			blockOffset += int(opTbl[instr.Number].GasCost) // Number is the original PUSH
+		} else if instr.OpCode != OPX_BEGINBLOCK || analysis.isJumpdest(instr) {
+			blockOffset += int(opTbl[instr.OpCode].GasCost)
+		}
+		if instr.Fusion < 0 { // emitted with the super-instruction
+			wr(fout, "// pc=%d fused\n", instr.PC)
+			continue
+		} else if p := fusionOf(instr); p != nil {
+			wr(fout, "// pc=%d super-instruction %s\n", instr.PC, p.Name)
+			analysis.dumpFused(fout, i, rest)
+			continue
+		} else if instr.OpCode == NOP {
 			wr(fout, "// pc=%d NOP\n", instr.PC)
 			continue
 		} else {
 			wr(fout, "// pc=%d op=%d (%s)\n", instr.PC, instr.OpCode, TraitsTable[instr.OpCode].Name)
-			wr(fout, "std::cout<<\"====*====\"<<std::endl;")
-			wr(fout, "std::cout<<\"PC:%d OP: %s %d gas 0x\"<<std::hex<<state->gas_left<<std::endl;\n",
-				instr.PC, TraitsTable[instr.OpCode].Name, instr.OpCode) // for debug
-			wr(fout, "show_stack(*state);\n")
+			if analysis.Options.Mode == EmitStackDump {
+				wr(fout, "std::cout<<\"====*====\"<<std::endl;")
+				wr(fout, "std::cout<<\"PC:%d OP: %s %d gas 0x\"<<std::hex<<state->gas_left<<std::endl;\n",
+					instr.PC, TraitsTable[instr.OpCode].Name, instr.OpCode) // for debug
+				wr(fout, "show_stack(*state);\n")
+			}
+		}
+		if cached {
+			cache.emit(instr)
+			continue
 		}
 		if instr.OpCode == OP_JUMP && instr.Number != 0 { //Known target, for an unconditional jump
 			if _, ok := analysis.TargetsSet[instr.Number]; ok {
@@ -234,6 +474,7 @@ func (analysis AdvancedCodeAnalysis) DumpAllInstr(fout io.Writer) {
 		}
 		if instr.OpCode == OP_JUMPI && instr.Number != 0 { //Known target, for a conditional jump
 			wr(fout, "if(test_jump_cond(*state)) {\n")
+			dumpSuperBlockExit(fout, rest)
 			if _, ok := analysis.TargetsSet[instr.Number]; ok {
 				wr(fout, "  goto L%05d;\n", instr.Number)
 			} else {
@@ -242,20 +483,26 @@ func (analysis AdvancedCodeAnalysis) DumpAllInstr(fout io.Writer) {
 			wr(fout, "}\n")
 		}
 		if instr.OpCode == OP_JUMP && instr.Number == 0 { //Unknown target, for an unconditional jump
-			wr(fout, "PC=pop_target_pc(*state);\ngoto JUMPTABLE;\n")
+			wr(fout, "PC=pop_target_pc(*state);\n")
+			analysis.dumpLocalSwitch(fout, instr.Targets)
+			wr(fout, "goto JUMPTABLE;\n")
 		}
 		if instr.OpCode == OP_JUMPI && instr.Number == 0 { //Unknown target, for a conditional jump
 			wr(fout, "PC=(get_target_pc(*state));\n")
-			wr(fout, "if((~PC)!=0) goto JUMPTABLE;\n") // an all-ones PC means "don't jump"
+			wr(fout, "if((~PC)!=0) {\n") // an all-ones PC means "don't jump"
+			dumpSuperBlockExit(fout, rest)
+			analysis.dumpLocalSwitch(fout, instr.Targets)
+			wr(fout, "goto JUMPTABLE;\n}\n")
 		}
 		if instr.OpCode == OP_JUMP || instr.OpCode == OP_JUMPI {
 			continue
 		}
+		if instr.OpCode == OPX_BEGINBLOCK {
+			analysis.dumpPrologue(fout, instr)
+			continue
+		}
 		// prepare some miscellaneous information for the instruction's execution
 		switch instr.OpCode {
-		case OPX_BEGINBLOCK:
-			wr(fout, "instr=instr_from_block(%d, %d, %d);\n", instr.Block.GasCost,
-				instr.Block.StackReq, instr.Block.StackMaxGrowth)
 		case OP_PUSH1, OP_PUSH2, OP_PUSH3, OP_PUSH4,
 			OP_PUSH5, OP_PUSH6, OP_PUSH7, OP_PUSH8:
 			wr(fout, "instr=instr_from_push(%d);\n", instr.SmallPushValue)
@@ -271,153 +518,248 @@ func (analysis AdvancedCodeAnalysis) DumpAllInstr(fout io.Writer) {
 			wr(fout, "instr=instr_from_num(%d);\n", instr.Number)
 		}
 		name := TraitsTable[instr.OpCode].Name
-		if t := TypeTable[instr.OpCode] &^ Inline; t == FullWithBreak || t == StateWithStatus {
+		if opTbl[instr.OpCode].FuncName == "op_undefined" { //undefined instruction in this revision
+			wr(fout, "evmone::op_undefined(&instr, *state);\ngoto ENDING;\n")
+		} else if t := TypeTable[instr.OpCode] &^ Inline; t == FullWithBreak || t == StateWithStatus {
 			// an instruction which may not return instr++
 			wr(fout, "if(next_instr!=maot%s(&instr, *state)) goto ENDING;\n", name)
-		} else if len(name) == 0 { //undefined instruction
-			wr(fout, "evmone::op_undefined(&instr, *state);\ngoto ENDING;\n")
 		} else {
 			wr(fout, "maot%s(&instr, *state);\n", name)
 		}
 	}
+	if cache != nil {
+		cache.flush()
+		if stats != nil {
+			stats.Add(cache.stats)
+		}
+	}
+	return ew.err
 }
 
-func wr(fout io.Writer, line string, a ...any) {
-	s := fmt.Sprintf(line, a...)
-	_, err := fout.Write([]byte(s))
-	if err != nil {
-		panic(err)
+// Jump to the targets found by resolveJumps without consulting the JUMPTABLE.
+// The caller must fall back to the JUMPTABLE for the other PCs.
+func (analysis AdvancedCodeAnalysis) dumpLocalSwitch(fout io.Writer, targets []int) {
+	valid := make([]int, 0, len(targets))
+	for _, target := range targets {
+		if _, ok := analysis.TargetsSet[target]; ok {
+			valid = append(valid, target)
+		}
+	}
+	if len(valid) == 1 {
+		wr(fout, "if(PC==%d) goto L%05d;\n", valid[0], valid[0])
+	} else if len(valid) > 1 {
+		wr(fout, "switch(PC){\n")
+		for _, target := range valid {
+			wr(fout, "  case %d: goto L%05d;\n", target, target)
+		}
+		wr(fout, "}\n")
 	}
 }
 
-func CodeToFile(rev int, codeArr []byte, name, fname string) {
-	fout, err := os.Create(fname)
-	if err != nil {
-		panic(err)
-	}
-	analysis := Analyze(rev, codeArr)
-	analysis.Dump(name, fout)
-	err = fout.Close()
-	if err != nil {
-		panic(err)
+// Does this OPX_BEGINBLOCK instruction stand for a JUMPDEST in the bytecode?
+func (analysis AdvancedCodeAnalysis) isJumpdest(instr *Instruction) bool {
+	pc := instr.PC
+	if pc < 0 { // the first basic block also covers a JUMPDEST at PC 0
+		pc = 0
 	}
+	_, ok := analysis.TargetsSet[pc]
+	return ok
 }
 
-// read files in "dir" and returns a "address-to-bytecode" map
-func readFiles(dir string) (codeMap map[string][]byte) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		panic(err)
+// Emit a trace_step call which reports the state before executing instr.
+// The gas charged in advance by the basic block is added back, such that the reported
+// gas equals the value an instruction-by-instruction interpreter would show.
+func (analysis AdvancedCodeAnalysis) dumpTraceStep(fout io.Writer, instr *Instruction, blockOffset int) {
+	opCode := instr.OpCode
+	if opCode == NOP { // a PUSH fused into the following JUMP/JUMPI
+		opCode = instr.Number
 	}
-	codeMap = make(map[string][]byte, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
+	name := TraitsTable[opCode].Name
+	if len(name) == 0 {
+		name = fmt.Sprintf("0x%02x", opCode)
+	}
+	precharged := fmt.Sprintf("state->current_block_cost-%d", blockOffset)
+	if opCode == OPX_BEGINBLOCK {
+		if !analysis.isJumpdest(instr) {
+			return // not a real JUMPDEST, so nothing to report
 		}
-		content, err := ioutil.ReadFile(path.Join(dir, entry.Name()))
-		if err != nil {
-			panic(err)
+		name = "JUMPDEST"
+		// the new block has not been charged yet, unless its super-block is checked as a whole
+		precharged = "0"
+		if instr.Block.Merged {
+			precharged = fmt.Sprintf("(fast ? %d : 0)", instr.Block.GasCost+instr.Block.Rest)
 		}
+	}
+	pc := instr.PC
+	if pc < 0 {
+		pc = 0
+	}
+	wr(fout, "trace_step(*state, %d, %d, \"%s\", %d, %s);\n", pc, opCode, name,
+		OpTables[analysis.Rev][opCode].GasCost, precharged)
+}
 
-		codeMap[entry.Name()], err = hex.DecodeString(strings.TrimSpace(string(content)))
-		if err != nil {
-			fmt.Printf("f %s %s '%s'\n", dir, entry.Name(), strings.TrimSpace(string(content)))
-			panic(err)
+// fout is normally an errWriter, which remembers the first error
+func wr(fout io.Writer, line string, a ...any) {
+	fmt.Fprintf(fout, line, a...)
+}
+
+// returns a sorted copy of revs, after making sure they are valid and distinct
+func sortRevisions(revs []int) ([]int, error) {
+	if len(revs) == 0 {
+		return nil, fmt.Errorf("no revision is specified")
+	}
+	revs = append([]int(nil), revs...)
+	sort.Ints(revs)
+	for i, rev := range revs {
+		if rev < 0 || rev >= len(RevisionNames) {
+			return nil, fmt.Errorf("invalid revision %d", rev)
+		}
+		if i > 0 && revs[i-1] == rev {
+			return nil, fmt.Errorf("duplicated revision %s", RevisionNames[rev])
 		}
 	}
-	return
+	return revs, nil
 }
 
-// hex address to a string literal which presents it
-func addr2str(addr string) string {
-	res := ""
-	for i := 0; i < len(addr); i += 2 {
-		res += "\\x" + addr[i:i+2]
+// Compile codeArr for each revision in revs and write the executors to fname
+func CodeToFile(revs []int, codeArr []byte, name, fname string, opts Options) error {
+	revs, err := sortRevisions(revs)
+	if err != nil {
+		return err
 	}
-	return res
+	_, err = codeToFile(revs, codeArr, name, fname, opts)
+	return err
 }
 
-// generate the query_executor function, which maps <addr> to an execute_<addr> function
-func getQueryExecutorSrc(addrList []string) string {
-	lines := make([]string, 0, 100)
-	lines = append(lines, `
-#include <string>
-#include <unordered_map>
-#include "evmc/evmc.h"
-
-extern "C" {
-__attribute__ ((visibility ("default"))) evmc_execute_fn query_executor(const evmc_address* destination);
-`)
-	for _, addr := range addrList {
-		s := fmt.Sprintf(`evmc_result execute_%s(evmc_vm* /*unused*/, const evmc_host_interface* host, evmc_host_context* ctx,
-    evmc_revision rev, const evmc_message* msg, const uint8_t* code, size_t code_size) noexcept;`, addr)
-		lines = append(lines, s)
+// revs must have been sorted by sortRevisions
+func codeToFile(revs []int, codeArr []byte, name, fname string, opts Options) (ContractReport, error) {
+	fout, err := os.Create(fname)
+	if err != nil {
+		return ContractReport{}, &CompileError{File: fname, Addr: name, Offset: -1, Err: err}
+	}
+	analyses := make([]AdvancedCodeAnalysis, len(revs))
+	for i, rev := range revs {
+		analyses[i] = Analyze(rev, codeArr, opts)
+	}
+	err = DumpExecutors(name, analyses, fout)
+	if closeErr := fout.Close(); err == nil {
+		err = closeErr
 	}
-	lines = append(lines, `
+	if err != nil {
+		return ContractReport{}, &CompileError{File: fname, Addr: name, Offset: -1, Err: err}
+	}
+	return newContractReport(name, analyses), nil
 }
 
-evmc_execute_fn query_executor(const evmc_address* destination) {
-	static std::unordered_map<std::string, evmc_execute_fn> m;
-	if(m.size() == 0) { //initialized on first called`)
-
-	s := fmt.Sprintf("\t\tm.reserve(%d);", len(addrList))
-	lines = append(lines, s)
-	for _, addr := range addrList {
-		s = fmt.Sprintf("\t\tm.emplace(std::string(\"%s\", 20), execute_%s);",
-			addr2str(addr), addr)
-		lines = append(lines, s)
+// Read the bytecode from a file which contains it in hex, with an optional 0x prefix, surrounded by
+// optional white spaces
+func ReadHexFile(fname string) ([]byte, error) {
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
 	}
-	lines = append(lines, "\t}")
-	lines = append(lines, `
-	std::string key((const char*)(destination->bytes), 20);
-	auto got = m.find(key);
-	if(got == m.end()) return nullptr;
-	return got->second;
-}
-`)
-	return strings.Join(lines, "\n")
+	code, offset, err := decodeCodeHex(string(content)) // offsets are reported relative to the file
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: offset, Err: err}
+	}
+	return code, nil
 }
 
-func getCompileScript(addrList []string) string {
-	lines := make([]string, 0, 100)
-	lines = append(lines, "#!/bin/bash")
-	lines = append(lines, "export MOEINGEVM="+os.Getenv("MOEINGEVM"))
-	cmd := "g++ -O3 -fPIC -std=c++17 -I $MOEINGEVM/evmwrap/evmone.release/ -I $MOEINGEVM/evmwrap/evmc/include/ -I $MOEINGEVM/evmwrap/intx/include -I $MOEINGEVM/evmwrap/keccak/include"
-	fileNames := make([]string, 0, len(addrList))
-	for _, addr := range addrList { // compile the files generated from bytecodes
-		lines = append(lines, "echo === "+addr+" ===")
-		lines = append(lines, cmd+" -c "+addr+".cpp")
-		fileNames = append(fileNames, addr+".o")
+// Compile the bytecodes in inDir, which is read in the detected format like LoadContracts,
+// for the revisions in revs, and write C++ files to outDir
+func AotCompile(revs []int, inDir string, outDir string, opts Options) (*CompileReport, error) {
+	inputs, err := LoadInputs(inDir, LoadOptions{})
+	if err != nil {
+		return nil, err
 	}
-	lines = append(lines, cmd+" -c instrexe.cpp")
-	last := cmd + " -shared -fvisibility=hidden -o libevmaot.so query_executor.cpp instrexe.o " + strings.Join(fileNames, " ") // we use -fvisibility=hidden to hide unnecessary functions
-	lines = append(lines, last)
-	return strings.Join(lines, "\n")
+	return AotCompileContracts(revs, inputs, outDir, opts)
 }
 
-func AotCompile(rev int, inDir string, outDir string) {
-	codeMap := readFiles(inDir)
+// Compile the contracts read by a Loader for the revisions in revs, and write C++ files to outDir,
+// which can be built into a shared library by Build. The inputs with invalid addresses or empty
+// bytecodes are skipped and reported. With the manifest left in outDir by the last run, only the
+// contracts which are added or changed are regenerated, the files of the removed contracts are
+// deleted, and the dispatcher is regenerated only when the set of addresses or code hashes changes.
+func AotCompileContracts(revs []int, inputs []ContractInput, outDir string, opts Options) (*CompileReport, error) {
+	revs, err := sortRevisions(revs)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkSymbols(); err != nil {
+		return nil, err
+	}
+	codeMap, rejected, err := normalizeAddresses(inputs)
+	if err != nil {
+		return nil, err
+	}
 	addrList := make([]string, 0, len(codeMap))
 	for addr := range codeMap {
 		addrList = append(addrList, addr)
 	}
 	sort.Strings(addrList)
+
+	manifestFile := path.Join(outDir, aotManifestFile)
+	old := readAotManifest(manifestFile)
+	settings := aotSettings(revs, opts)
+	reusable := old.Settings == settings // otherwise everything must be regenerated
+	manifest := &aotManifest{Settings: settings, Contracts: make(map[string]manifestContract, len(addrList))}
+	dispatcherChanged := !reusable || len(old.Contracts) != len(addrList)
+
+	report := &CompileReport{Contracts: make([]ContractReport, 0, len(addrList)), Rejected: rejected}
+	codeHashes := make(map[string][32]byte, len(addrList))
 	for _, addr := range addrList {
 		codeArr := codeMap[addr]
-		ofile := path.Join(outDir, addr+".cpp")
-		CodeToFile(rev, codeArr, addr, ofile)
+		codeHashes[addr] = keccak.Sum256(codeArr)
+		entry := manifestContract{CodeHash: codeHashHex(codeHashes[addr]), File: contractFileName(addr)}
+		if prev, ok := old.Contracts[addr]; ok && reusable && prev.CodeHash == entry.CodeHash &&
+			prev.File == entry.File && fileExists(path.Join(outDir, entry.File)) {
+			manifest.Contracts[addr] = prev
+			report.Contracts = append(report.Contracts, ContractReport{Addr: addr, Jumps: prev.Jumps, Fusion: prev.Fusion})
+			continue
+		}
+		dispatcherChanged = true
+		contract, err := codeToFile(revs, codeArr, addr, path.Join(outDir, entry.File), opts)
+		if err != nil {
+			return nil, err
+		}
+		contract.Regenerated = true
+		entry.Jumps = contract.Jumps
+		entry.Fusion = contract.Fusion
+		manifest.Contracts[addr] = entry
+		report.Contracts = append(report.Contracts, contract)
 	}
-	src := getQueryExecutorSrc(addrList)
+	removed := make([]string, 0)
+	for addr := range old.Contracts {
+		if _, ok := manifest.Contracts[addr]; !ok {
+			removed = append(removed, addr)
+			if err := removeContractFiles(outDir, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(removed)
+	report.Removed = removed
+
 	ofile := path.Join(outDir, "query_executor.cpp")
-	err := ioutil.WriteFile(ofile, []byte(src), 0644)
-	if err != nil {
-		panic(err)
+	hfile := path.Join(outDir, evmaotInfoHeader)
+	if dispatcherChanged || !fileExists(ofile) || !fileExists(hfile) {
+		src, err := getQueryExecutorSrc(libraryDesc{AddrList: addrList, CodeHashes: codeHashes,
+			Revs: revs, Opts: opts, Timestamp: time.Now().Unix()})
+		if err == nil {
+			err = os.WriteFile(ofile, []byte(src), 0644)
+		}
+		if err != nil {
+			return nil, &CompileError{File: ofile, Offset: -1, Err: err}
+		}
+		if err = os.WriteFile(hfile, []byte(evmaotInfoHeaderSrc), 0644); err != nil {
+			return nil, &CompileError{File: hfile, Offset: -1, Err: err}
+		}
 	}
-	DumpInstrExeFiles(outDir)
-	src = getCompileScript(addrList)
-	ofile = path.Join(outDir, "compile.sh")
-	err = ioutil.WriteFile(ofile, []byte(src), 0644)
-	if err != nil {
-		panic(err)
+	if !reusable || !fileExists(path.Join(outDir, "instrexe.cpp")) {
+		err = DumpInstrExeFiles(revs[len(revs)-1], outDir, opts) // shared by all the revisions
+		if err != nil {
+			return nil, err
+		}
 	}
+	return report, manifest.write(manifestFile)
 }
@@ -0,0 +1,382 @@
+package maot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BuildConfig controls how Build compiles the C++ files generated by AotCompile
+type BuildConfig struct {
+	Compiler    string   // such as g++ or clang++
+	Flags       []string // used for compiling each source file
+	IncludeDirs []string
+	Jobs        int    // the number of compiler processes run in parallel, runtime.NumCPU() if not positive
+	Library     string // the name of the shared library, in the output directory
+	// passed when linking the library, after the objects, such as -L and -l for evmone
+	LinkFlags []string
+	// more objects or static libraries linked into the library, such as the ones implementing keccak
+	ExtraObjects []string
+	// the version of evmone whose headers are used, which is reported by evmaot_info()
+	EvmoneVersion string
+}
+
+// the include directories under the moeingevm repository
+func MoeingevmIncludeDirs(moeingevm string) []string {
+	return []string{
+		path.Join(moeingevm, "evmwrap/evmone.release"),
+		path.Join(moeingevm, "evmwrap/evmc/include"),
+		path.Join(moeingevm, "evmwrap/intx/include"),
+		path.Join(moeingevm, "evmwrap/keccak/include"),
+	}
+}
+
+// DefaultBuildConfig uses g++ with the headers in the moeingevm repository at $MOEINGEVM
+func DefaultBuildConfig() BuildConfig {
+	return BuildConfig{
+		Compiler:    "g++",
+		Flags:       []string{"-O3", "-fPIC", "-std=c++17"},
+		IncludeDirs: MoeingevmIncludeDirs(os.Getenv("MOEINGEVM")),
+		Library:     "libevmaot.so",
+	}
+}
+
+// the arguments for compiling src to obj
+func (cfg *BuildConfig) compileArgs(src, obj string) []string {
+	args := append([]string{}, cfg.Flags...)
+	for _, dir := range cfg.IncludeDirs {
+		args = append(args, "-I", dir)
+	}
+	if path.Base(src) == "query_executor.cpp" { // only export the entry points, such as query_executor
+		args = append(args, "-fvisibility=hidden")
+		// recorded by evmaot_info(), they are passed without a shell so no more quoting is needed
+		args = append(args, "-DEVMAOT_COMPILE_FLAGS="+cStringLiteral(strings.Join(cfg.Flags, " ")))
+		if len(cfg.EvmoneVersion) != 0 {
+			args = append(args, "-DEVMAOT_EVMONE_VERSION="+cStringLiteral(cfg.EvmoneVersion))
+		}
+	}
+	// the compiler lists the headers which obj depends on, see parseDepFile
+	return append(args, "-MMD", "-MF", depFile(obj), "-c", src, "-o", obj)
+}
+
+// the arguments for linking objs into cfg.Library
+func (cfg *BuildConfig) linkArgs(objs []string) []string {
+	args := append([]string{"-shared", "-o", cfg.Library}, objs...)
+	args = append(args, cfg.ExtraObjects...)
+	return append(args, cfg.LinkFlags...)
+}
+
+func depFile(obj string) string {
+	return strings.TrimSuffix(obj, ".o") + ".d"
+}
+
+// the first line printed by "compiler --version", so that upgrading the compiler rebuilds everything
+func compilerVersion(compiler string) string {
+	out, err := exec.Command(compiler, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+// The result of compiling one source file
+type ObjectResult struct {
+	Addr     string // the contract's address, empty for the files shared by all the contracts
+	Source   string
+	Object   string
+	Skipped  bool // the object is up to date
+	Duration time.Duration
+	Output   string // what the compiler printed
+	Err      error
+}
+
+// The results of Build, an object fails to compile does not stop compiling others
+type BuildResult struct {
+	Objects      []ObjectResult
+	Library      string
+	Linked       bool // false if the library is up to date or some object failed
+	LinkDuration time.Duration
+	LinkOutput   string
+}
+
+func (r *BuildResult) Failures() []ObjectResult {
+	var res []ObjectResult
+	for _, obj := range r.Objects {
+		if obj.Err != nil {
+			res = append(res, obj)
+		}
+	}
+	return res
+}
+
+// Print one line for each compiled object, the failures with the compiler's output, and a summary line
+func (r *BuildResult) Print(w io.Writer) {
+	skipped := 0
+	for _, obj := range r.Objects {
+		switch {
+		case obj.Skipped:
+			skipped++
+		case obj.Err != nil:
+			fmt.Fprintf(w, "%s FAILED after %s: %s\n%s", obj.Source, obj.Duration.Round(time.Millisecond), obj.Err, obj.Output)
+		default:
+			fmt.Fprintf(w, "%s compiled in %s\n", obj.Source, obj.Duration.Round(time.Millisecond))
+		}
+	}
+	if r.Linked {
+		fmt.Fprintf(w, "%s linked in %s\n", r.Library, r.LinkDuration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "%d objects: %d up to date, %d failed\n", len(r.Objects), skipped, len(r.Failures()))
+}
+
+// The manifest remembers how each object was built, so unchanged objects are not compiled again
+type buildManifest struct {
+	Objects map[string]manifestEntry `json:"objects"` // keyed by the object's file name
+}
+
+type manifestEntry struct {
+	SourceHash string `json:"source_hash"` // the source covers the bytecode, the revisions and Options
+	Command    string `json:"command"`     // with the flags and the include directories
+	Compiler   string `json:"compiler"`    // see compilerVersion
+	// the hashes of the headers included by the source, as listed by the depfile, or of
+	// BuildConfig.ExtraObjects for the library
+	Deps map[string]string `json:"deps,omitempty"`
+}
+
+// is the file built by old up to date for e, whose Deps are not known before building?
+func (e manifestEntry) upToDate(dir string, old manifestEntry) bool {
+	if e.SourceHash != old.SourceHash || e.Command != old.Command || e.Compiler != old.Compiler {
+		return false
+	}
+	for fname, hash := range old.Deps {
+		if h, err := hashFile(joinDir(dir, fname)); err != nil || h != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// fname relative to dir, in which the compiler runs
+func joinDir(dir, fname string) string {
+	if path.IsAbs(fname) {
+		return fname
+	}
+	return path.Join(dir, fname)
+}
+
+// hash each of fnames, which are relative to dir
+func hashFiles(dir string, fnames []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(fnames))
+	for _, fname := range fnames {
+		hash, err := hashFile(joinDir(dir, fname))
+		if err != nil {
+			return nil, err
+		}
+		hashes[fname] = hash
+	}
+	return hashes, nil
+}
+
+// the prerequisites in a depfile written by -MMD, except src. The lines may be continued with backslashes.
+func parseDepFile(content, src string) []string {
+	text := strings.ReplaceAll(content, "\\\n", " ")
+	if _, rest, ok := strings.Cut(text, ": "); ok {
+		text = rest
+	}
+	var deps []string
+	for _, fname := range strings.Fields(strings.ReplaceAll(text, "\\ ", "\x00")) {
+		if fname = strings.ReplaceAll(fname, "\x00", " "); fname != src {
+			deps = append(deps, fname)
+		}
+	}
+	return deps
+}
+
+const buildManifestFile = "build_manifest.json"
+
+func readBuildManifest(fname string) *buildManifest {
+	m := &buildManifest{Objects: make(map[string]manifestEntry)}
+	if content, err := os.ReadFile(fname); err == nil {
+		if json.Unmarshal(content, m) != nil || m.Objects == nil { // rebuild everything
+			m.Objects = make(map[string]manifestEntry)
+		}
+	}
+	return m
+}
+
+func hashFile(fname string) (string, error) {
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// the C++ source files in dir, sorted by name
+func cppSources(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".cpp") {
+			srcs = append(srcs, entry.Name())
+		}
+	}
+	sort.Strings(srcs)
+	return srcs, nil
+}
+
+// Build compiles the C++ files written by AotCompile in dir with a pool of compiler processes, and links
+// them into cfg.Library. The objects whose sources, included headers, compiler and command are the same
+// as last time are not compiled again, and the library is not linked again if all the objects and
+// cfg.ExtraObjects are up to date.
+func Build(dir string, cfg BuildConfig) (*BuildResult, error) {
+	srcs, err := cppSources(dir)
+	if err != nil {
+		return nil, &CompileError{File: dir, Offset: -1, Err: err}
+	}
+	manifestFile := path.Join(dir, buildManifestFile)
+	manifest := readBuildManifest(manifestFile)
+	result := &BuildResult{Objects: make([]ObjectResult, len(srcs)), Library: cfg.Library}
+	newEntries := make([]manifestEntry, len(srcs))
+	compiler := compilerVersion(cfg.Compiler)
+	var todo []int
+	for i, src := range srcs {
+		obj := strings.TrimSuffix(src, ".cpp") + ".o"
+		result.Objects[i] = ObjectResult{Source: src, Object: obj}
+		if name := strings.TrimSuffix(src, ".cpp"); name != "instrexe" && name != "query_executor" {
+			result.Objects[i].Addr = name
+		}
+		hash, err := hashFile(path.Join(dir, src))
+		if err != nil {
+			return nil, &CompileError{File: path.Join(dir, src), Offset: -1, Err: err}
+		}
+		args := cfg.compileArgs(src, obj)
+		newEntries[i] = manifestEntry{SourceHash: hash, Command: cfg.Compiler + " " + strings.Join(args, " "),
+			Compiler: compiler}
+		if old := manifest.Objects[obj]; newEntries[i].upToDate(dir, old) && fileExists(path.Join(dir, obj)) {
+			result.Objects[i].Skipped = true
+			newEntries[i].Deps = old.Deps
+		} else {
+			todo = append(todo, i)
+		}
+	}
+
+	jobs := cfg.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				obj := &result.Objects[i] // each worker writes different elements
+				obj.Duration, obj.Output, obj.Err = runCompiler(dir, cfg.Compiler, cfg.compileArgs(obj.Source, obj.Object))
+				if obj.Err == nil {
+					obj.Err = recordDeps(dir, obj, &newEntries[i])
+				}
+			}
+		}()
+	}
+	for _, i := range todo {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	allSkipped := true
+	for i, obj := range result.Objects {
+		if obj.Err == nil {
+			manifest.Objects[obj.Object] = newEntries[i]
+		} else {
+			delete(manifest.Objects, obj.Object)
+		}
+		allSkipped = allSkipped && obj.Skipped
+	}
+	numFailures := len(result.Failures())
+	if numFailures == 0 {
+		objs := make([]string, len(result.Objects))
+		for i, obj := range result.Objects {
+			objs[i] = obj.Object
+		}
+		args := cfg.linkArgs(objs)
+		linkEntry := manifestEntry{Command: cfg.Compiler + " " + strings.Join(args, " "), Compiler: compiler}
+		if linkEntry.Deps, err = hashFiles(dir, cfg.ExtraObjects); err != nil {
+			return result, &CompileError{File: path.Join(dir, cfg.Library), Offset: -1, Err: err}
+		}
+		if !allSkipped || !linkEntry.upToDate(dir, manifest.Objects[cfg.Library]) ||
+			!fileExists(path.Join(dir, cfg.Library)) {
+			delete(manifest.Objects, cfg.Library)
+			result.LinkDuration, result.LinkOutput, err = runCompiler(dir, cfg.Compiler, args)
+			if err != nil {
+				writeBuildManifest(manifestFile, manifest)
+				return result, &CompileError{File: path.Join(dir, cfg.Library), Offset: -1,
+					Err: fmt.Errorf("%w\n%s", err, result.LinkOutput)}
+			}
+			result.Linked = true
+			manifest.Objects[cfg.Library] = linkEntry
+		}
+	}
+	if err := writeBuildManifest(manifestFile, manifest); err != nil {
+		return result, err
+	}
+	if numFailures != 0 {
+		return result, &CompileError{File: dir, Offset: -1,
+			Err: fmt.Errorf("%d of %d objects failed to compile", numFailures, len(result.Objects))}
+	}
+	return result, nil
+}
+
+// hash the headers listed in the depfile of obj into entry
+func recordDeps(dir string, obj *ObjectResult, entry *manifestEntry) error {
+	content, err := os.ReadFile(path.Join(dir, depFile(obj.Object)))
+	if err == nil {
+		entry.Deps, err = hashFiles(dir, parseDepFile(string(content), obj.Source))
+	}
+	return err
+}
+
+func writeBuildManifest(fname string, m *buildManifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = os.WriteFile(fname, content, 0644)
+	}
+	if err != nil {
+		return &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	return nil
+}
+
+// run the compiler in dir, returning how long it takes and what it prints
+func runCompiler(dir, compiler string, args []string) (time.Duration, string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(compiler, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	start := time.Now()
+	err := cmd.Run()
+	return time.Since(start), out.String(), err
+}
@@ -0,0 +1,14 @@
+package maot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDepFile(t *testing.T) {
+	content := "abc.o: abc.cpp /usr/include/evmc/evmc.h instrexe.hpp \\\n /opt/my\\ evmone/execution.hpp\n"
+	want := []string{"/usr/include/evmc/evmc.h", "instrexe.hpp", "/opt/my evmone/execution.hpp"}
+	if got := parseDepFile(content, "abc.cpp"); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDepFile=%q, want %q", got, want)
+	}
+}
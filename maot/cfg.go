@@ -0,0 +1,237 @@
+package maot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The kinds of control flow edges between basic blocks
+type EdgeKind int
+
+const (
+	EdgeFallThrough EdgeKind = iota // to the next block in the bytecode
+	EdgeFused                       // a JUMP/JUMPI whose target is pushed right before it
+	EdgeResolved                    // a JUMP/JUMPI whose target is found by resolveJumps
+	EdgeJumpTable                   // a JUMP/JUMPI which may go to the JUMPTABLE
+	EdgeDynamic                     // from the JUMPTABLE to a JUMPDEST
+)
+
+var edgeKindNames = []string{"fallthrough", "fused", "resolved", "jumptable", "dynamic"}
+
+func (k EdgeKind) String() string {
+	if int(k) < 0 || int(k) >= len(edgeKindNames) {
+		return fmt.Sprintf("EdgeKind(%d)", int(k))
+	}
+	return edgeKindNames[k]
+}
+
+func (k EdgeKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
+// JumpTableNode is the pseudo block index of the JUMPTABLE, which maps a PC to its JUMPDEST
+const JumpTableNode = -1
+
+type CFGEdge struct {
+	From int      `json:"from"`
+	To   int      `json:"to"`
+	Kind EdgeKind `json:"kind"`
+}
+
+// A basic block, with a summary from its BlockInfo
+type CFGBlock struct {
+	Index          int    `json:"index"`
+	StartPC        int    `json:"start_pc"`
+	EndPC          int    `json:"end_pc"` // the bytecode of this block is [StartPC, EndPC)
+	Jumpdest       bool   `json:"jumpdest"`
+	Dead           bool   `json:"dead"` // unreachable, so no code is generated for it
+	GasCost        uint32 `json:"gas_cost"`
+	StackReq       int16  `json:"stack_req"`
+	StackMaxGrowth int16  `json:"stack_max_growth"`
+	Last           string `json:"last"`  // the name of the last instruction
+	Succs          []int  `json:"succs"` // may contain JumpTableNode
+	Preds          []int  `json:"preds"` // may contain JumpTableNode
+	Begin          int    `json:"-"`     // InstrList[Begin] is the block's OPX_BEGINBLOCK
+	End            int    `json:"-"`     // InstrList[End-1] is the block's last instruction
+}
+
+// The control flow graph of a contract, as believed by the AOT compiler
+type CFG struct {
+	Blocks []CFGBlock `json:"blocks"`
+	Edges  []CFGEdge  `json:"edges"`
+}
+
+// the PC after an instruction, which is the PC of the next instruction in the bytecode
+func nextPC(instr *Instruction) int {
+	if instr.PC < 0 {
+		return 0
+	}
+	op := instr.OpCode
+	if op == NOP {
+		op = instr.Number // the original PUSH
+	}
+	if op < 0 || op > 255 {
+		return instr.PC + 1
+	}
+	return instr.PC + 1 + immediateSize(byte(op))
+}
+
+// Build the control flow graph from the basic blocks of InstrList
+func (analysis AdvancedCodeAnalysis) CFG() *CFG {
+	spans := analysis.blockSpans()
+	cfg := &CFG{Blocks: make([]CFGBlock, len(spans))}
+	blockOfPC := make(map[int]int, len(spans))
+	for i, span := range spans {
+		first := analysis.InstrList[span.Begin]
+		last := analysis.InstrList[span.End-1]
+		block := CFGBlock{
+			Index:          i,
+			StartPC:        analysis.blockPC(span),
+			EndPC:          nextPC(last),
+			Jumpdest:       analysis.isJumpdest(first),
+			Dead:           first.Block.Dead,
+			GasCost:        first.Block.GasCost,
+			StackReq:       first.Block.StackReq,
+			StackMaxGrowth: first.Block.StackMaxGrowth,
+			Last:           instrName(last),
+			Begin:          span.Begin,
+			End:            span.End,
+		}
+		if span.End == span.Begin+1 && !block.Jumpdest { // an empty block
+			block.EndPC = block.StartPC
+		}
+		cfg.Blocks[i] = block
+		blockOfPC[block.StartPC] = i
+	}
+	usesJumpTable := false
+	added := make(map[CFGEdge]bool) // two targets of a jump may be the same
+	addEdge := func(from, to int, kind EdgeKind) {
+		e := CFGEdge{From: from, To: to, Kind: kind}
+		if !added[e] {
+			added[e] = true
+			cfg.Edges = append(cfg.Edges, e)
+		}
+	}
+	for i, block := range cfg.Blocks {
+		last := analysis.InstrList[block.End-1]
+		if last.OpCode == OP_JUMP || last.OpCode == OP_JUMPI {
+			if last.Number != 0 {
+				if _, ok := analysis.TargetsSet[last.Number]; ok {
+					addEdge(i, blockOfPC[last.Number], EdgeFused)
+				}
+			} else {
+				for _, target := range last.Targets {
+					if _, ok := analysis.TargetsSet[target]; ok {
+						addEdge(i, blockOfPC[target], EdgeResolved)
+					}
+				}
+				addEdge(i, JumpTableNode, EdgeJumpTable) // the fallback for the unresolved PCs
+				usesJumpTable = true
+			}
+		}
+		if i+1 < len(cfg.Blocks) && analysis.fallsThrough(last) {
+			addEdge(i, i+1, EdgeFallThrough)
+		}
+	}
+	if usesJumpTable {
+		for _, target := range analysis.JumpTableTargets() {
+			addEdge(JumpTableNode, blockOfPC[target], EdgeDynamic)
+		}
+	}
+	for _, e := range cfg.Edges {
+		if e.From != JumpTableNode {
+			cfg.Blocks[e.From].Succs = append(cfg.Blocks[e.From].Succs, e.To)
+		}
+		if e.To != JumpTableNode {
+			cfg.Blocks[e.To].Preds = append(cfg.Blocks[e.To].Preds, e.From)
+		}
+	}
+	return cfg
+}
+
+// the mnemonic of an instruction
+func instrName(instr *Instruction) string {
+	op := instr.OpCode
+	if op == NOP {
+		op = instr.Number
+	}
+	if op == OPX_BEGINBLOCK {
+		return "JUMPDEST"
+	}
+	if op < 0 || op > 255 || len(TraitsTable[op].Name) == 0 {
+		return fmt.Sprintf("UNDEFINED(0x%02x)", op)
+	}
+	return TraitsTable[op].Name
+}
+
+func (cfg *CFG) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(cfg)
+}
+
+// Write the graph in Graphviz's DOT language
+func (cfg *CFG) WriteDOT(w io.Writer, name string) error {
+	ew := newErrWriter(w)
+	w = ew
+	wr(w, "digraph %q {\n", name)
+	wr(w, "  node [shape=box fontname=monospace];\n")
+	for _, b := range cfg.Blocks {
+		label := fmt.Sprintf("#%d pc=[%d,%d)\\lgas=%d req=%d growth=%d\\llast=%s\\l",
+			b.Index, b.StartPC, b.EndPC, b.GasCost, b.StackReq, b.StackMaxGrowth, b.Last)
+		style := ""
+		if b.Jumpdest {
+			style = " style=bold"
+		}
+		if b.Dead {
+			style = " style=dotted color=gray"
+		}
+		wr(w, "  b%d [label=\"%s\"%s];\n", b.Index, label, style)
+	}
+	for _, e := range cfg.Edges {
+		if e.From == JumpTableNode || e.To == JumpTableNode {
+			wr(w, "  JUMPTABLE [shape=diamond];\n")
+			break
+		}
+	}
+	for _, e := range cfg.Edges {
+		var attr string
+		switch e.Kind {
+		case EdgeFallThrough:
+			attr = "color=black"
+		case EdgeFused:
+			attr = "color=blue"
+		case EdgeResolved:
+			attr = "color=darkgreen"
+		default:
+			attr = "color=gray style=dashed"
+		}
+		wr(w, "  %s -> %s [%s label=%q];\n", dotNode(e.From), dotNode(e.To), attr, e.Kind)
+	}
+	wr(w, "}\n")
+	return ew.err
+}
+
+func dotNode(index int) string {
+	if index == JumpTableNode {
+		return "JUMPTABLE"
+	}
+	return fmt.Sprintf("b%d", index)
+}
+
+// Summarize the graph in one line
+func (cfg *CFG) String() string {
+	counts := make([]string, len(edgeKindNames))
+	for k := range edgeKindNames {
+		n := 0
+		for _, e := range cfg.Edges {
+			if int(e.Kind) == k {
+				n++
+			}
+		}
+		counts[k] = fmt.Sprintf("%s=%d", edgeKindNames[k], n)
+	}
+	return fmt.Sprintf("%d blocks, edges: %s", len(cfg.Blocks), strings.Join(counts, " "))
+}
@@ -0,0 +1,168 @@
+package maot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The kinds of lines in a disassembly
+const (
+	DisasmBlock    = "block"    // the beginning of a basic block
+	DisasmInstr    = "instr"    // an instruction
+	DisasmData     = "data"     // unreachable bytes, which are not compiled
+	DisasmMetadata = "metadata" // the CBOR metadata appended by solc
+)
+
+// One line of a disassembly. Only the fields relevant to its Kind are filled.
+type DisasmLine struct {
+	Kind string `json:"kind"`
+	PC   int    `json:"pc"`
+	// for instructions
+	Op             string `json:"op,omitempty"`
+	OpCode         int    `json:"opcode,omitempty"`
+	SmallPushValue uint64 `json:"small_push_value,omitempty"` // for PUSH1~PUSH8
+	PushValue      string `json:"push_value,omitempty"`       // the immediate of PUSH1~PUSH32, in hex
+	Fused          bool   `json:"fused,omitempty"`            // a PUSH which is fused into the following JUMP/JUMPI
+	Target         int    `json:"target,omitempty"`           // the fused target of a JUMP/JUMPI
+	Targets        []int  `json:"targets,omitempty"`          // the resolved targets of a JUMP/JUMPI
+	Dynamic        bool   `json:"dynamic,omitempty"`          // a JUMP/JUMPI which may use the JUMPTABLE
+	// for blocks
+	Jumpdest       bool   `json:"jumpdest,omitempty"`
+	GasCost        uint32 `json:"gas_cost,omitempty"`
+	StackReq       int16  `json:"stack_req,omitempty"`
+	StackMaxGrowth int16  `json:"stack_max_growth,omitempty"`
+	// for data and metadata, whose bytes are [PC, End)
+	End int `json:"end,omitempty"`
+}
+
+type Disassembly struct {
+	Revision string       `json:"revision"`
+	Jumps    JumpStats    `json:"jumps"`
+	Lines    []DisasmLine `json:"lines"`
+}
+
+// Disassemble the analysis of a contract, such that the generated code can be lined up with the bytecode
+func Disassemble(analysis AdvancedCodeAnalysis) *Disassembly {
+	d := &Disassembly{Revision: RevisionNames[analysis.Rev], Jumps: analysis.JumpStats()}
+	dataRanges := analysis.DataRanges
+	if analysis.Metadata.Len() != 0 && len(dataRanges) != 0 &&
+		dataRanges[len(dataRanges)-1].End == analysis.Metadata.End {
+		// the metadata is a part of the last data range, show them separately
+		last := dataRanges[len(dataRanges)-1]
+		dataRanges = append(dataRanges[:len(dataRanges)-1:len(dataRanges)-1],
+			CodeRange{Start: last.Start, End: analysis.Metadata.Start})
+		if dataRanges[len(dataRanges)-1].Len() <= 0 {
+			dataRanges = dataRanges[:len(dataRanges)-1]
+		}
+	}
+	flushData := func(pc int) { // add the data ranges before pc
+		for len(dataRanges) != 0 && dataRanges[0].Start < pc {
+			r := dataRanges[0]
+			d.Lines = append(d.Lines, DisasmLine{Kind: DisasmData, PC: r.Start, End: r.End})
+			dataRanges = dataRanges[1:]
+		}
+	}
+	for _, instr := range analysis.InstrList[:len(analysis.InstrList)-1] { // skip the last STOP
+		pc := instr.PC
+		if pc < 0 {
+			pc = 0
+		}
+		flushData(pc + 1)
+		if instr.OpCode == OPX_BEGINBLOCK {
+			d.Lines = append(d.Lines, DisasmLine{
+				Kind:           DisasmBlock,
+				PC:             pc,
+				Jumpdest:       analysis.isJumpdest(instr),
+				GasCost:        instr.Block.GasCost,
+				StackReq:       instr.Block.StackReq,
+				StackMaxGrowth: instr.Block.StackMaxGrowth,
+			})
+			continue
+		}
+		line := DisasmLine{Kind: DisasmInstr, PC: pc, Op: instrName(instr), OpCode: instr.OpCode}
+		op := instr.OpCode
+		if op == NOP {
+			op = instr.Number
+			line.OpCode = op
+			line.Fused = true
+		}
+		switch {
+		case OP_PUSH1 <= op && op <= OP_PUSH8:
+			line.SmallPushValue = instr.SmallPushValue
+			line.PushValue = fmt.Sprintf("0x%0*x", 2*(op-OP_PUSH1+1), instr.SmallPushValue)
+		case OP_PUSH9 <= op && op <= OP_PUSH32:
+			line.PushValue = pushWordsHex(instr.PushWords, op-OP_PUSH1+1)
+		case op == OP_JUMP || op == OP_JUMPI:
+			if instr.Number != 0 {
+				line.Target = instr.Number
+			} else {
+				line.Targets = instr.Targets
+				line.Dynamic = true
+			}
+		}
+		d.Lines = append(d.Lines, line)
+	}
+	flushData(int(^uint(0) >> 1))
+	if analysis.Metadata.Len() != 0 {
+		d.Lines = append(d.Lines, DisasmLine{Kind: DisasmMetadata, PC: analysis.Metadata.Start, End: analysis.Metadata.End})
+	}
+	return d
+}
+
+// the hex string of a size-byte value
+func pushWordsHex(words [4]uint64, size int) string {
+	s := fmt.Sprintf("%016x%016x%016x%016x", words[0], words[1], words[2], words[3])
+	return "0x" + s[len(s)-2*size:]
+}
+
+func (d *Disassembly) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Write a human-readable listing, one instruction per line
+func (d *Disassembly) WriteText(w io.Writer) error {
+	ew := newErrWriter(w)
+	w = ew
+	wr(w, "; revision %s, jumps: %s\n", d.Revision, d.Jumps)
+	for _, line := range d.Lines {
+		switch line.Kind {
+		case DisasmBlock:
+			jumpdest := ""
+			if line.Jumpdest {
+				jumpdest = " jumpdest"
+			}
+			wr(w, "\n; block pc=%d gas=%d req=%d growth=%d%s\n",
+				line.PC, line.GasCost, line.StackReq, line.StackMaxGrowth, jumpdest)
+			if line.Jumpdest {
+				wr(w, "%05d  JUMPDEST\n", line.PC)
+			}
+		case DisasmData, DisasmMetadata:
+			wr(w, "\n; %s [%d, %d) %d bytes\n", line.Kind, line.PC, line.End, line.End-line.PC)
+		default:
+			var sb strings.Builder
+			fmt.Fprintf(&sb, "%05d  %-14s", line.PC, line.Op)
+			if len(line.PushValue) != 0 {
+				sb.WriteString(" " + line.PushValue)
+			}
+			if line.Fused {
+				sb.WriteString(" ; fused")
+			}
+			if line.Target != 0 {
+				fmt.Fprintf(&sb, " ; -> %d", line.Target)
+			} else if line.Dynamic {
+				targets := make([]string, 0, len(line.Targets)+1)
+				for _, t := range line.Targets {
+					targets = append(targets, fmt.Sprint(t))
+				}
+				targets = append(targets, "JUMPTABLE")
+				fmt.Fprintf(&sb, " ; -> %s", strings.Join(targets, ","))
+			}
+			wr(w, "%s\n", strings.TrimRight(sb.String(), " "))
+		}
+	}
+	return ew.err
+}
@@ -0,0 +1,84 @@
+package maot
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CompileError reports a failure while reading a bytecode file or writing a generated file
+type CompileError struct {
+	File   string // the file being read or written
+	Addr   string // the contract's address, empty if unknown
+	Offset int    // byte offset of the offending data in File, -1 if not applicable
+	Err    error  // the underlying cause
+}
+
+func (e *CompileError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.File)
+	if e.Offset >= 0 {
+		fmt.Fprintf(&sb, " (offset %d)", e.Offset)
+	}
+	if len(e.Addr) != 0 {
+		fmt.Fprintf(&sb, " [contract %s]", e.Addr)
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// errWriter remembers the first error during writing, and ignores all the following writes.
+// So code generators can call wr without checking errors after each line.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func newErrWriter(w io.Writer) *errWriter {
+	if ew, ok := w.(*errWriter); ok {
+		return ew
+	}
+	return &errWriter{w: w}
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	ew.err = err
+	return n, err
+}
+
+// decode a hex string, returning the offset of the first offending character on failure
+func decodeHex(s string) ([]byte, int, error) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return nil, i, fmt.Errorf("invalid hex character %q", c)
+		}
+	}
+	if len(s)%2 != 0 {
+		return nil, len(s), fmt.Errorf("odd-length hex string")
+	}
+	bz := make([]byte, len(s)/2)
+	for i := range bz {
+		bz[i] = unhex(s[2*i])<<4 | unhex(s[2*i+1])
+	}
+	return bz, -1, nil
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,261 @@
+package maot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Solidity's output is dominated by a few short sequences of instructions. The fusion pass finds them
+// in each basic block and marks them with Instruction.Fusion, and DumpAllInstr emits one call to a
+// super-instruction maotF_<Name> for each of them. The instructions are not removed from InstrList, so
+// the analyses and the Go interpreter still see the original ones. The gas and stack requirements are
+// checked at the beginning of the basic block, so a super-instruction only needs to do the work.
+
+// match one instruction of a pattern
+type instrMatcher func(instr *Instruction) bool
+
+// A sequence of instructions and the super-instruction replacing it
+type FusionPattern struct {
+	Name  string
+	Match []instrMatcher
+	// the arguments passed to the super-instruction before the state, which depend on the immediates
+	Args func(instrs []*Instruction) string
+	// the last instruction is a JUMPI whose target is fused, and the super-instruction returns the condition
+	Jumpi bool
+	Impl  string // the C++ definition of maotF_<Name> in instrexe.hpp, which takes Args and the state
+}
+
+func opIs(ops ...int) instrMatcher {
+	return func(instr *Instruction) bool {
+		for _, op := range ops {
+			if instr.OpCode == op {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// PUSH1~PUSH8, whose value is in SmallPushValue
+func smallPush(instr *Instruction) bool {
+	return OP_PUSH1 <= instr.OpCode && instr.OpCode <= OP_PUSH8
+}
+
+// PUSH1~PUSH31 with an all-ones immediate, such as the mask of an address
+func maskPush(instr *Instruction) bool {
+	return MaskBits(instr) != 0
+}
+
+// MaskBits is the number of ones in an all-ones PUSH1~PUSH31 immediate, 0 if it is not such a push
+func MaskBits(instr *Instruction) int {
+	op := instr.OpCode
+	if op < OP_PUSH1 || op > OP_PUSH31 {
+		return 0
+	}
+	bits := (op - OP_PUSH1 + 1) * 8
+	if op <= OP_PUSH8 {
+		if instr.SmallPushValue != ^uint64(0)>>(64-bits) {
+			return 0
+		}
+		return bits
+	}
+	for i, word := range instr.PushWords { // the most significant word first
+		wordBits := min(64, max(0, bits-(3-i)*64))
+		if word != ^uint64(0)>>(64-wordBits) { // 0 for wordBits == 0
+			return 0
+		}
+	}
+	return bits
+}
+
+// the PUSH1~PUSH3 fused into the following JUMPI by Analyze
+func fusedPush(instr *Instruction) bool {
+	return instr.OpCode == NOP
+}
+
+func fusedJumpi(instr *Instruction) bool {
+	return instr.OpCode == OP_JUMPI && instr.Number != 0
+}
+
+// FusionPatterns are tried in order at each instruction, so a longer pattern should come before its prefixes
+var FusionPatterns = []FusionPattern{
+	{
+		Name:  "SELECTOR_JUMPI", // PUSH4 selector EQ PUSH2 target JUMPI
+		Match: []instrMatcher{opIs(OP_PUSH4), opIs(OP_EQ), fusedPush, fusedJumpi},
+		Args:  func(instrs []*Instruction) string { return fmt.Sprintf("0x%x, ", instrs[0].SmallPushValue) },
+		Jumpi: true,
+		Impl: `inline bool maotF_SELECTOR_JUMPI(uint64_t selector, evmone::AdvancedExecutionState& state) noexcept
+{
+    return state.stack.pop() == intx::uint256{selector};
+}
+`,
+	},
+	{
+		Name:  "DUP2_DUP2_LT_ISZERO",
+		Match: []instrMatcher{opIs(OP_DUP2), opIs(OP_DUP2), opIs(OP_LT), opIs(OP_ISZERO)},
+		Args:  func(instrs []*Instruction) string { return "" },
+		Impl: `inline void maotF_DUP2_DUP2_LT_ISZERO(evmone::AdvancedExecutionState& state) noexcept
+{
+    const bool ge = state.stack[0] >= state.stack[1];
+    state.stack.push(ge ? 1 : 0);
+}
+`,
+	},
+	{
+		Name:  "PUSH_ADD", // such as PUSH1 0x20 ADD
+		Match: []instrMatcher{smallPush, opIs(OP_ADD)},
+		Args:  func(instrs []*Instruction) string { return fmt.Sprintf("%d, ", instrs[0].SmallPushValue) },
+		Impl: `inline void maotF_PUSH_ADD(uint64_t v, evmone::AdvancedExecutionState& state) noexcept
+{
+    state.stack.top() += intx::uint256{v};
+}
+`,
+	},
+	{
+		Name:  "MASK", // such as PUSH20 0xffffffffffffffffffffffffffffffffffffffff AND
+		Match: []instrMatcher{maskPush, opIs(OP_AND)},
+		Args:  func(instrs []*Instruction) string { return fmt.Sprintf("%d, ", MaskBits(instrs[0])) },
+		Impl: `inline void maotF_MASK(unsigned bits, evmone::AdvancedExecutionState& state) noexcept
+{
+    state.stack.top() &= (intx::uint256{1} << bits) - 1;
+}
+`,
+	},
+	{
+		Name:  "SWAP1_POP",
+		Match: []instrMatcher{opIs(OP_SWAP1), opIs(OP_POP)},
+		Args:  func(instrs []*Instruction) string { return "" },
+		Impl: `inline void maotF_SWAP1_POP(evmone::AdvancedExecutionState& state) noexcept
+{
+    state.stack[1] = state.stack[0];
+    state.stack.pop();
+}
+`,
+	},
+}
+
+// does the pattern match InstrList[i:]?
+func (analysis AdvancedCodeAnalysis) matchFusion(p *FusionPattern, i int) bool {
+	if i+len(p.Match) > len(analysis.InstrList) {
+		return false
+	}
+	for j, match := range p.Match {
+		instr := analysis.InstrList[i+j]
+		if instr.Fusion != 0 || !match(instr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Mark the sequences of instructions which match FusionPatterns. A super-instruction starts at the instruction
+// whose Fusion is the pattern's index plus one, and the following instructions of it have Fusion -1.
+// The super-instructions only appear in release mode, since the other modes report every instruction.
+func (analysis AdvancedCodeAnalysis) fuseInstructions() {
+	if !analysis.Options.Fusion || analysis.Options.Mode != EmitRelease {
+		return
+	}
+	opTbl := OpTables[analysis.Rev]
+	for i := 0; i < len(analysis.InstrList); i++ {
+		for k := range FusionPatterns {
+			p := &FusionPatterns[k]
+			if !analysis.matchFusion(p, i) {
+				continue
+			}
+			defined := true // never fuse the instructions undefined in this revision
+			for _, instr := range analysis.InstrList[i : i+len(p.Match)] {
+				defined = defined && (instr.OpCode == NOP || opTbl[instr.OpCode].FuncName != "op_undefined")
+			}
+			if !defined {
+				continue
+			}
+			analysis.InstrList[i].Fusion = k + 1
+			for j := 1; j < len(p.Match); j++ {
+				analysis.InstrList[i+j].Fusion = -1
+			}
+			i += len(p.Match) - 1
+			break
+		}
+	}
+}
+
+// the pattern of the super-instruction starting at instr, nil if none starts there
+func fusionOf(instr *Instruction) *FusionPattern {
+	if instr.Fusion <= 0 {
+		return nil
+	}
+	return &FusionPatterns[instr.Fusion-1]
+}
+
+// Emit the call of the super-instruction starting at InstrList[i], rest is the gas given back by
+// a taken JUMPI, see dumpSuperBlockExit
+func (analysis AdvancedCodeAnalysis) dumpFused(fout io.Writer, i int, rest uint32) {
+	p := fusionOf(analysis.InstrList[i])
+	instrs := analysis.InstrList[i : i+len(p.Match)]
+	call := fmt.Sprintf("maotF_%s(%s*state)", p.Name, p.Args(instrs))
+	if !p.Jumpi {
+		wr(fout, "%s;\n", call)
+		return
+	}
+	target := instrs[len(instrs)-1].Number
+	wr(fout, "if(%s) {\n", call)
+	dumpSuperBlockExit(fout, rest)
+	if _, ok := analysis.TargetsSet[target]; ok {
+		wr(fout, "  goto L%05d;\n", target)
+	} else {
+		wr(fout, "  state->exit(EVMC_BAD_JUMP_DESTINATION); goto ENDING;//%05d\n", target)
+	}
+	wr(fout, "}\n")
+}
+
+// How many instructions are replaced by super-instructions
+type FusionStats struct {
+	Instrs      int            `json:"instrs"`       // the original instructions in super-instructions
+	SuperInstrs int            `json:"super_instrs"` // the super-instructions emitted
+	ByPattern   map[string]int `json:"by_pattern,omitempty"`
+}
+
+func (s FusionStats) String() string {
+	names := make([]string, 0, len(s.ByPattern))
+	for name := range s.ByPattern {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, len(names))
+	for i, name := range names {
+		items[i] = fmt.Sprintf("%s=%d", name, s.ByPattern[name])
+	}
+	res := fmt.Sprintf("%d instrs into %d", s.Instrs, s.SuperInstrs)
+	if len(items) != 0 {
+		res += " (" + strings.Join(items, " ") + ")"
+	}
+	return res
+}
+
+// add the numbers in other to s
+func (s *FusionStats) Add(other FusionStats) {
+	s.Instrs += other.Instrs
+	s.SuperInstrs += other.SuperInstrs
+	for name, n := range other.ByPattern {
+		if s.ByPattern == nil {
+			s.ByPattern = make(map[string]int)
+		}
+		s.ByPattern[name] += n
+	}
+}
+
+func (analysis AdvancedCodeAnalysis) FusionStats() (stats FusionStats) {
+	for _, instr := range analysis.InstrList {
+		if p := fusionOf(instr); p != nil {
+			if stats.ByPattern == nil {
+				stats.ByPattern = make(map[string]int)
+			}
+			stats.Instrs += len(p.Match)
+			stats.SuperInstrs++
+			stats.ByPattern[p.Name]++
+		}
+	}
+	return
+}
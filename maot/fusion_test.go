@@ -0,0 +1,124 @@
+package maot_test
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/smartbch/moeingaot/difftest"
+	"github.com/smartbch/moeingaot/interp"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// PUSHn with n bytes of b
+func pushBytes(n int, b byte) []byte {
+	return append([]byte{byte(maot.OP_PUSH1 + n - 1)}, bytes.Repeat([]byte{b}, n)...)
+}
+
+// the i-th word of calldata
+func argCode(i int) []byte {
+	return []byte{maot.OP_PUSH1, byte(32 * i), maot.OP_CALLDATALOAD}
+}
+
+func concat(parts ...[]byte) []byte {
+	var code []byte
+	for _, part := range parts {
+		code = append(code, part...)
+	}
+	return code
+}
+
+// return the top of the stack
+var returnTop = []byte{maot.OP_PUSH1, 0, maot.OP_MSTORE, maot.OP_PUSH1, 32, maot.OP_PUSH1, 0, maot.OP_RETURN}
+
+func calldata(ws ...*big.Int) []byte {
+	var res []byte
+	for _, w := range ws {
+		var b [32]byte
+		w.FillBytes(b[:])
+		res = append(res, b[:]...)
+	}
+	return res
+}
+
+// Each super-instruction must compute what the instructions it replaces compute, so the code is run
+// through interp with and without the fusion pass, and the outcomes must be the same.
+func TestFusionPatterns(t *testing.T) {
+	max256 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	small, big5 := big.NewInt(3), big.NewInt(5)
+	selector := big.NewInt(0x65372147)
+	// PUSH4 selector EQ PUSH2 23 JUMPI, which returns 1 if not jumping and 2 at the JUMPDEST at 23
+	selectorCode := concat(argCode(0), []byte{maot.OP_PUSH4, 0x65, 0x37, 0x21, 0x47, maot.OP_EQ,
+		maot.OP_PUSH2, 0, 23, maot.OP_JUMPI, maot.OP_PUSH1, 1}, returnTop,
+		[]byte{maot.OP_JUMPDEST, maot.OP_PUSH1, 2}, returnTop)
+
+	cases := []struct {
+		name    string
+		code    []byte
+		inputs  [][]byte
+		pattern string // the only super-instruction expected, none if empty
+	}{
+		{"selector-jumpi", selectorCode,
+			[][]byte{calldata(selector), calldata(big.NewInt(0x65372148)), calldata(max256)}, "SELECTOR_JUMPI"},
+		{"dup2-dup2-lt-iszero", concat(argCode(1), argCode(0),
+			[]byte{maot.OP_DUP2, maot.OP_DUP2, maot.OP_LT, maot.OP_ISZERO, maot.OP_ADD, maot.OP_ADD}, returnTop),
+			[][]byte{calldata(small, big5), calldata(big5, small), calldata(big5, big5), calldata(max256, big.NewInt(0))},
+			"DUP2_DUP2_LT_ISZERO"},
+		{"push1-add", concat(argCode(0), pushBytes(1, 0x20), []byte{maot.OP_ADD}, returnTop),
+			[][]byte{calldata(small), calldata(max256), calldata(new(big.Int).Sub(max256, big.NewInt(0x1f)))}, "PUSH_ADD"},
+		{"push8-add-wraps", concat(argCode(0), pushBytes(8, 0xff), []byte{maot.OP_ADD}, returnTop),
+			[][]byte{calldata(big5), calldata(max256), calldata(new(big.Int).Sub(max256, big5))}, "PUSH_ADD"},
+		{"mask-push1", concat(argCode(0), pushBytes(1, 0xff), []byte{maot.OP_AND}, returnTop),
+			[][]byte{calldata(max256), calldata(big.NewInt(0x1234))}, "MASK"},
+		{"mask-push20", concat(argCode(0), pushBytes(20, 0xff), []byte{maot.OP_AND}, returnTop),
+			[][]byte{calldata(max256), calldata(selector)}, "MASK"},
+		{"mask-push31", concat(argCode(0), pushBytes(31, 0xff), []byte{maot.OP_AND}, returnTop),
+			[][]byte{calldata(max256), calldata(new(big.Int).Lsh(big.NewInt(0xab), 240))}, "MASK"},
+		{"not-a-mask", concat(argCode(0), []byte{maot.OP_PUSH2, 0xff, 0x00, maot.OP_AND}, returnTop),
+			[][]byte{calldata(max256)}, ""},
+		{"swap1-pop", concat(argCode(2), argCode(0), argCode(1), []byte{maot.OP_SWAP1, maot.OP_POP, maot.OP_SUB}, returnTop),
+			[][]byte{calldata(small, big5, big.NewInt(1)), calldata(big5, max256, max256)}, "SWAP1_POP"},
+		// a JUMPDEST starts a new basic block, so no pattern crosses it
+		{"push-add-across-jumpdest", concat(argCode(0), pushBytes(1, 0x20), []byte{maot.OP_JUMPDEST, maot.OP_ADD}, returnTop),
+			[][]byte{calldata(max256)}, ""},
+		{"swap1-pop-across-jumpdest", concat(argCode(0), argCode(1), []byte{maot.OP_SWAP1, maot.OP_JUMPDEST, maot.OP_POP}, returnTop),
+			[][]byte{calldata(small, big5)}, ""},
+	}
+	const rev = maot.EVMC_LONDON
+	unfusedOpts := maot.DefaultOptions()
+	unfusedOpts.Fusion = false
+	for _, c := range cases {
+		fused := maot.Analyze(rev, c.code, maot.DefaultOptions())
+		unfused := maot.Analyze(rev, c.code, unfusedOpts)
+		stats := fused.FusionStats()
+		if c.pattern == "" && stats.SuperInstrs != 0 || c.pattern != "" && stats.ByPattern[c.pattern] != stats.SuperInstrs {
+			t.Errorf("%s: fused %s, want only %q", c.name, stats, c.pattern)
+		}
+		if c.pattern != "" && stats.SuperInstrs != 1 {
+			t.Errorf("%s: fused %s, want one %s", c.name, stats, c.pattern)
+		}
+		if n := unfused.FusionStats().SuperInstrs; n != 0 {
+			t.Errorf("%s: %d super-instructions without fusion", c.name, n)
+		}
+		for _, input := range c.inputs {
+			var results [2]interp.Result
+			for i, analysis := range []maot.AdvancedCodeAnalysis{unfused, fused} {
+				in := &interp.Interpreter{Host: difftest.NewMockHost(rev, nil)}
+				res, err := in.Execute(analysis, &interp.Message{Gas: 100000, Input: input}, c.code)
+				if err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+				results[i] = res
+			}
+			if results[0].Status != interp.Success {
+				t.Errorf("%s(%x): status %v", c.name, input, results[0].Status)
+			}
+			if results[0].Status != results[1].Status || results[0].GasLeft != results[1].GasLeft ||
+				!bytes.Equal(results[0].Output, results[1].Output) {
+				t.Errorf("%s(%x): fused %v %d %x, unfused %v %d %x", c.name, input,
+					results[1].Status, results[1].GasLeft, results[1].Output,
+					results[0].Status, results[0].GasLeft, results[0].Output)
+			}
+		}
+	}
+}
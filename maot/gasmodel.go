@@ -0,0 +1,377 @@
+package maot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The gas of an instruction has two parts:
+//
+//   - The static part is GasCostTable[rev][op]. It is summed into BlockInfo.GasCost and charged once
+//     when entering a basic block, before any instruction of the block is executed.
+//   - The dynamic part is charged by evmone's instruction implementations at run time, and it never
+//     appears in BlockInfo.GasCost. It includes memory expansion, per-word and per-byte costs, the
+//     cold access surcharges of EIP-2929, SSTORE's cost (which depends on the original, current and
+//     new values) and the costs of CALL/CREATE (value transfer, new account, forwarded gas).
+//
+// Since Berlin, the static part of SLOAD, BALANCE, EXT* and CALL* is the warm cost (100), and the
+// difference between the cold and warm costs is charged dynamically when the account or the slot is
+// accessed for the first time in a transaction. SSTORE's static part is 0 in all the revisions, and
+// SELFDESTRUCT's static part does not include its cold surcharge. Refunds are never charged by the
+// executors: the host accumulates them and applies them at the end of a transaction.
+
+// EIP-2929 costs
+const (
+	WarmStorageReadCost   = 100
+	ColdSloadCost         = 2100
+	ColdAccountAccessCost = 2600
+)
+
+// DynamicGas is a set of the dynamic gas components of an instruction
+type DynamicGas uint32
+
+const (
+	DynMemory      DynamicGas = 1 << iota // memory expansion
+	DynCopy                               // 3 per word copied
+	DynHash                               // 6 per word hashed
+	DynExpByte                            // per byte of the exponent
+	DynLogData                            // 8 per byte of log data
+	DynColdAccount                        // the cold account surcharge of EIP-2929
+	DynColdSlot                           // the cold storage slot surcharge of EIP-2929
+	DynStorage                            // SSTORE, depending on the original/current/new values
+	DynCall                               // value transfer, new account and the forwarded gas
+	DynCreate                             // the forwarded gas, CREATE2's hashing and EIP-3860's initcode words
+	DynNewAccount                         // SELFDESTRUCT to a new account
+	DynRefund                             // may make the host add a refund
+)
+
+var dynamicGasNames = []string{"memory", "copy", "hash", "exp-byte", "log-data", "cold-account",
+	"cold-slot", "storage", "call", "create", "new-account", "refund"}
+
+func (d DynamicGas) String() string {
+	var names []string
+	for i, name := range dynamicGasNames {
+		if d&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// The gas model of an instruction in a revision
+type GasModel struct {
+	Static        int        // charged per basic block, -1 if the instruction is undefined
+	ColdSurcharge int        // charged at run time when the account or slot is cold, 0 if never
+	Dynamic       DynamicGas // the other costs charged at run time
+}
+
+// GasModelOf describes the gas of op in revision rev
+func GasModelOf(rev, op int) GasModel {
+	m := GasModel{Static: GasCostTable[rev][op]}
+	if m.Static == Undefined {
+		return m
+	}
+	switch {
+	case OP_LOG0 <= op && op <= OP_LOG4:
+		m.Dynamic = DynMemory | DynLogData
+	}
+	switch op {
+	case OP_KECCAK256:
+		m.Dynamic = DynMemory | DynHash
+	case OP_EXP:
+		m.Dynamic = DynExpByte
+	case OP_CALLDATACOPY, OP_CODECOPY, OP_RETURNDATACOPY, OP_MCOPY:
+		m.Dynamic = DynMemory | DynCopy
+	case OP_MLOAD, OP_MSTORE, OP_MSTORE8, OP_RETURN, OP_REVERT:
+		m.Dynamic = DynMemory
+	case OP_BALANCE, OP_EXTCODESIZE, OP_EXTCODEHASH:
+		m.Dynamic = DynColdAccount
+	case OP_EXTCODECOPY:
+		m.Dynamic = DynMemory | DynCopy | DynColdAccount
+	case OP_SLOAD:
+		m.Dynamic = DynColdSlot
+	case OP_SSTORE:
+		m.Dynamic = DynStorage | DynColdSlot | DynRefund
+	case OP_CALL, OP_CALLCODE, OP_DELEGATECALL, OP_STATICCALL:
+		m.Dynamic = DynMemory | DynCall | DynColdAccount
+	case OP_CREATE, OP_CREATE2:
+		m.Dynamic = DynMemory | DynCreate
+	case OP_SELFDESTRUCT:
+		m.Dynamic = DynNewAccount | DynColdAccount
+		if rev < EVMC_LONDON {
+			m.Dynamic |= DynRefund
+		}
+	}
+	if rev < EVMC_BERLIN {
+		m.Dynamic &^= DynColdAccount | DynColdSlot
+	}
+	switch {
+	case op == OP_SSTORE && m.Dynamic&DynColdSlot != 0:
+		m.ColdSurcharge = ColdSloadCost // SSTORE has no warm cost
+	case m.Dynamic&DynColdSlot != 0:
+		m.ColdSurcharge = ColdSloadCost - WarmStorageReadCost
+	case op == OP_SELFDESTRUCT && m.Dynamic&DynColdAccount != 0:
+		m.ColdSurcharge = ColdAccountAccessCost // SELFDESTRUCT has no warm cost
+	case m.Dynamic&DynColdAccount != 0:
+		m.ColdSurcharge = ColdAccountAccessCost - WarmStorageReadCost
+	}
+	return m
+}
+
+// The refunds which a host applies at the end of a transaction
+type RefundModel struct {
+	SstoreClears int // for resetting a slot to zero
+	Selfdestruct int
+	MaxQuotient  int // the refund is at most gasUsed/MaxQuotient
+}
+
+func RefundModelOf(rev int) RefundModel {
+	if rev >= EVMC_LONDON { // EIP-3529
+		return RefundModel{SstoreClears: 4800, Selfdestruct: 0, MaxQuotient: 5}
+	}
+	return RefundModel{SstoreClears: 15000, Selfdestruct: 24000, MaxQuotient: 2}
+}
+
+// Print the gas model of a revision as a table
+func PrintGasModel(rev int, w io.Writer) error {
+	ew := newErrWriter(w)
+	w = ew
+	refund := RefundModelOf(rev)
+	wr(w, "# %s: BlockInfo.GasCost sums the static column; the other columns are charged at run time\n", RevisionNames[rev])
+	wr(w, "# refunds: sstore-clears=%d selfdestruct=%d at-most=gas-used/%d\n",
+		refund.SstoreClears, refund.Selfdestruct, refund.MaxQuotient)
+	wr(w, "%-14s %6s %6s  %s\n", "opcode", "static", "cold+", "dynamic")
+	for op := 0; op < 256; op++ {
+		m := GasModelOf(rev, op)
+		if m.Static == Undefined {
+			continue
+		}
+		wr(w, "%-14s %6d %6d  %s\n", TraitsTable[op].Name, m.Static, m.ColdSurcharge, m.Dynamic)
+	}
+	return ew.err
+}
+
+// A difference between GasCostTable/TraitsTable and evmone's tables
+type TableMismatch struct {
+	Rev    int // -1 for the traits, which are independent to revisions
+	Op     int
+	Field  string
+	Go     int
+	Evmone int
+}
+
+func (m TableMismatch) String() string {
+	rev := "traits"
+	if m.Rev >= 0 {
+		rev = RevisionNames[m.Rev]
+	}
+	return fmt.Sprintf("%s %s %s: go=%d evmone=%d", rev, TraitsTable[m.Op].Name, m.Field, m.Go, m.Evmone)
+}
+
+type TableReport struct {
+	File       string
+	Revisions  []int // the revisions found in File
+	Mismatches []TableMismatch
+}
+
+// FindInstructionTraits looks for evmone's instruction_traits.hpp under dir, such as
+// $MOEINGEVM/evmwrap/evmone.release
+func FindInstructionTraits(dir string) (string, error) {
+	var found string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() == "instruction_traits.hpp" && len(found) == 0 {
+			found = path
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("instruction_traits.hpp is not found under %s", dir)
+	}
+	return found, nil
+}
+
+// the names used by evmone for some opcodes
+var evmoneOpAliases = map[string]string{"SHA3": "KECCAK256", "PREVRANDAO": "DIFFICULTY"}
+
+// the named constants used in evmone's tables
+var evmoneConstants = map[string]int{
+	"undefined":                Undefined,
+	"warm_storage_read_cost":   WarmStorageReadCost,
+	"cold_sload_cost":          ColdSloadCost,
+	"cold_account_access_cost": ColdAccountAccessCost,
+}
+
+var (
+	reGasCosts  = regexp.MustCompile(`gas_costs\s*<\s*EVMC_(\w+)\s*>\s*=`)
+	reInherit   = regexp.MustCompile(`=\s*gas_costs\s*<\s*EVMC_(\w+)\s*>\s*;`)
+	reGasAssign = regexp.MustCompile(`table\s*\[\s*OP_(\w+)\s*\]\s*=\s*([^;{]+);`)
+	reTraits    = regexp.MustCompile(`table\s*\[\s*OP_(\w+)\s*\]\s*=\s*\{\s*"\w+"\s*,([^}]*)\}`)
+	reFillAll   = regexp.MustCompile(`(=\s*|fill\s*\().*undefined\s*\)?\s*;`)
+)
+
+func opcodeByName(name string) (int, bool) {
+	if alias, ok := evmoneOpAliases[name]; ok {
+		name = alias
+	}
+	for op := 0; op < 256; op++ {
+		if TraitsTable[op].Name == name || (op == OP_JUMPDEST && name == "JUMPDEST") {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// evaluate the expressions in evmone's tables, such as "2 * 375" and "instr::cold_sload_cost"
+func evalGasCost(expr string) (int, error) {
+	sum := 0
+	for _, term := range strings.Split(expr, "+") {
+		product := 1
+		for _, factor := range strings.Split(term, "*") {
+			factor = strings.TrimSpace(factor)
+			if i := strings.LastIndex(factor, "::"); i >= 0 {
+				factor = factor[i+2:]
+			}
+			n, err := strconv.Atoi(factor)
+			if err != nil {
+				c, ok := evmoneConstants[factor]
+				if !ok {
+					return 0, fmt.Errorf("unknown gas cost %q", expr)
+				}
+				n = c
+			}
+			product *= n
+		}
+		sum += product
+	}
+	return sum, nil
+}
+
+// VerifyInstructionTraits parses evmone's instruction_traits.hpp, which defines the gas cost
+// tables as gas_costs<EVMC_XXX> and the stack requirements as traits, and compares them with
+// GasCostTable and TraitsTable. The revisions missing in the file are skipped.
+func VerifyInstructionTraits(fname string) (*TableReport, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	defer f.Close()
+	report := &TableReport{File: fname}
+	tables := make(map[int]*[256]int)
+	var cur *[256]int // the gas table being parsed, nil when parsing the traits or other code
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		lineErr := func(format string, args ...interface{}) error {
+			return &CompileError{File: fname, Offset: -1, Err: fmt.Errorf("line %d: "+format, append([]interface{}{lineNo}, args...)...)}
+		}
+		if m := reGasCosts.FindStringSubmatch(line); m != nil {
+			rev, err := ParseRevision(m[1])
+			if err != nil {
+				cur = nil // a revision unknown to us
+				continue
+			}
+			cur = new([256]int)
+			tables[rev] = cur
+			report.Revisions = append(report.Revisions, rev)
+			if m := reInherit.FindStringSubmatch(line); m != nil {
+				base, err := ParseRevision(m[1])
+				if err != nil || tables[base] == nil {
+					return nil, lineErr("gas_costs<EVMC_%s> is inherited before being defined", m[1])
+				}
+				*cur = *tables[base]
+			}
+			continue
+		}
+		if strings.Contains(line, "}();") ||
+			(strings.Contains(line, "traits") && strings.Contains(line, "=") && !strings.Contains(line, "table[")) {
+			cur = nil // the end of a gas_costs table
+			continue
+		}
+		if cur != nil {
+			if m := reInherit.FindStringSubmatch(line); m != nil {
+				base, err := ParseRevision(m[1])
+				if err != nil || tables[base] == nil {
+					return nil, lineErr("gas_costs<EVMC_%s> is inherited before being defined", m[1])
+				}
+				*cur = *tables[base]
+				continue
+			}
+			if reFillAll.MatchString(line) && !strings.Contains(line, "table[") {
+				for i := range cur {
+					cur[i] = Undefined
+				}
+				continue
+			}
+			if m := reGasAssign.FindStringSubmatch(line); m != nil {
+				op, ok := opcodeByName(m[1])
+				if !ok {
+					continue // an opcode unknown to us, which remains undefined in GasCostTable
+				}
+				cost, err := evalGasCost(m[2])
+				if err != nil {
+					return nil, lineErr("%w", err)
+				}
+				cur[op] = cost
+			}
+			continue
+		}
+		if m := reTraits.FindStringSubmatch(line); m != nil {
+			op, ok := opcodeByName(m[1])
+			if !ok {
+				continue
+			}
+			// {"NAME", req, change} in old evmone, and the stack fields are the last two integers
+			// in the newer layouts such as {"NAME", immediate_size, is_terminating, req, change, since}
+			var ints []int
+			for _, field := range strings.Split(m[2], ",") {
+				if n, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+					ints = append(ints, n)
+				}
+			}
+			if len(ints) < 2 {
+				return nil, lineErr("cannot parse the traits of OP_%s", m[1])
+			}
+			req, change := ints[len(ints)-2], ints[len(ints)-1]
+			if t := TraitsTable[op]; int(t.StackReq) != req {
+				report.Mismatches = append(report.Mismatches, TableMismatch{-1, op, "stack_req", int(t.StackReq), req})
+			} else if int(t.StackChange) != change {
+				report.Mismatches = append(report.Mismatches, TableMismatch{-1, op, "stack_change", int(t.StackChange), change})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	if len(tables) == 0 {
+		return nil, &CompileError{File: fname, Offset: -1, Err: fmt.Errorf("no gas_costs<EVMC_...> table is found")}
+	}
+	for _, rev := range report.Revisions {
+		for op := 0; op < 256; op++ {
+			if goCost, cost := GasCostTable[rev][op], tables[rev][op]; goCost != cost {
+				report.Mismatches = append(report.Mismatches, TableMismatch{rev, op, "gas", goCost, cost})
+			}
+		}
+	}
+	return report, nil
+}
+
+func (r *TableReport) Print(w io.Writer) {
+	names := make([]string, len(r.Revisions))
+	for i, rev := range r.Revisions {
+		names[i] = RevisionNames[rev]
+	}
+	fmt.Fprintf(w, "%s: revisions %s\n", r.File, strings.Join(names, ","))
+	for _, m := range r.Mismatches {
+		fmt.Fprintf(w, "  %s\n", m)
+	}
+	fmt.Fprintf(w, "%d mismatches\n", len(r.Mismatches))
+}
@@ -0,0 +1,134 @@
+package maot
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const benchCodeSize = 24576 // the limit of EIP-170
+
+// DumpJumpTableBenchmark writes a C++ benchmark to dir, which compares the JUMPTABLE implementations
+// emitted by dumpJumpDispatch: switch(PC), and the computed-goto tables indexed by PC and hashed. The
+// targets are the JUMPDESTs of code, or n random PCs in a 24KB contract if code is empty, and they are
+// visited in a random order, with some bad destinations. It only needs a C++ compiler. Run bench.sh in
+// dir to build and run it.
+func DumpJumpTableBenchmark(n int, code []byte, dir string) error {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	var targets []int
+	if len(code) != 0 {
+		targets = Analyze(EVMC_MAX_REVISION, code, DefaultOptions()).JumpdestTargets
+	} else {
+		seen := make(map[int]bool, n)
+		for len(targets) < n && len(targets) < benchCodeSize {
+			pc := rnd.Intn(benchCodeSize)
+			if !seen[pc] {
+				seen[pc] = true
+				targets = append(targets, pc)
+			}
+		}
+		sort.Ints(targets)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no JUMPDEST to benchmark")
+	}
+	files := map[string]string{
+		"bench.cpp": getJumpBenchmarkSrc(targets, rnd),
+		"bench.sh": `#!/bin/bash
+g++ -O3 -std=c++17 -o jump_bench bench.cpp && ./jump_bench
+`,
+	}
+	for name, src := range files {
+		fname := path.Join(dir, name)
+		if err := os.WriteFile(fname, []byte(src), 0644); err != nil {
+			return &CompileError{File: fname, Offset: -1, Err: err}
+		}
+	}
+	return nil
+}
+
+// the benchmark's source, with one function for each implementation of the JUMPTABLE
+func getJumpBenchmarkSrc(targets []int, rnd *rand.Rand) string {
+	const traceLen = 4096
+	trace := make([]string, traceLen)
+	for i := range trace {
+		pc := targets[rnd.Intn(len(targets))]
+		if rnd.Intn(16) == 0 {
+			pc = rnd.Intn(targets[len(targets)-1] + 2) // may be a bad destination
+		}
+		trace[i] = fmt.Sprint(pc)
+	}
+	var buf bytes.Buffer
+	wr(&buf, `#include <chrono>
+#include <cstddef>
+#include <cstdint>
+#include <cstdio>
+
+%s
+// the PCs jumped to, in order
+static const uint32_t trace[] = {
+`, computedGotoMacro)
+	for i := 0; i < traceLen; i += 16 {
+		wr(&buf, "\t%s,\n", strings.Join(trace[i:i+16], ", "))
+	}
+	wr(&buf, "};\n\nstatic constexpr size_t trace_len = %d;\nstatic constexpr int rounds = 1000;\n", traceLen)
+	variants := []struct {
+		fn    string
+		kind  JumpTableKind
+		dense bool
+	}{
+		{"jump_switch", JumpTableSwitch, false},
+		{"jump_goto_dense", JumpTableGoto, true},
+		{"jump_goto_hashed", JumpTableGoto, false},
+	}
+	for _, v := range variants {
+		wr(&buf, `
+// jump to the label of each PC in pcs, which mixes the PC into the result
+__attribute__((noinline)) static uint64_t %s(const uint32_t* pcs, size_t count) {
+	uint64_t acc = 0;
+	size_t i = 0;
+	size_t PC = 0;
+NEXT:
+	if(i == count) return acc;
+	PC = pcs[i++];
+	goto JUMPTABLE;
+`, v.fn)
+		for _, target := range targets {
+			wr(&buf, "L%05d: acc = acc * 31 + %d; goto NEXT;\n", target, target)
+		}
+		wr(&buf, "JUMPTABLE:\n")
+		dumpJumpDispatch(&buf, targets, v.kind, v.dense)
+		wr(&buf, "\tacc = acc * 31 + 1; // a bad jump destination\n\tgoto NEXT;\n}\n")
+	}
+	wr(&buf, `
+// returns the average latency in nanoseconds
+static double bench(const char* name, uint64_t (*fn)(const uint32_t*, size_t), uint64_t& checksum) {
+	checksum = fn(trace, trace_len); // warm up
+	uint64_t sum = 0;
+	auto start = std::chrono::steady_clock::now();
+	for(int r = 0; r < rounds; r++) {
+		sum += fn(trace, trace_len);
+	}
+	auto end = std::chrono::steady_clock::now();
+	double ns = std::chrono::duration<double, std::nano>(end - start).count() / (double(rounds) * trace_len);
+	std::printf("%%-18s %%6.2f ns/jump (%%llx)\n", name, ns, (unsigned long long)(sum));
+	return ns;
+}
+
+int main() {
+	std::printf("%d JUMPDESTs up to PC %d, computed goto %%s\n", MAOT_COMPUTED_GOTO ? "enabled" : "disabled");
+	uint64_t expected, got;
+	bench("switch", jump_switch, expected);
+	bench("goto, indexed", jump_goto_dense, got);
+	if(got != expected) { std::printf("wrong result\n"); return 1; }
+	bench("goto, hashed", jump_goto_hashed, got);
+	if(got != expected) { std::printf("wrong result\n"); return 1; }
+	return 0;
+}
+`, len(targets), targets[len(targets)-1])
+	return buf.String()
+}
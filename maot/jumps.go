@@ -0,0 +1,312 @@
+package maot
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// At most so many possible targets are tracked for a value on the abstract stack
+	MaxJumpTargets = 8
+	// At most so many different entry stacks are analyzed for a basic block
+	MaxJumpContexts = 16
+	// Only so many items near the top of the abstract stack are tracked
+	maxTrackedDepth = 64
+)
+
+// The basic block which spans InstrList[Begin:End], InstrList[Begin] is its OPX_BEGINBLOCK
+type blockSpan struct {
+	Begin int
+	End   int
+}
+
+// split InstrList into basic blocks
+func (analysis AdvancedCodeAnalysis) blockSpans() []blockSpan {
+	spans := make([]blockSpan, 0, len(analysis.JumpdestTargets)+1)
+	for i, instr := range analysis.InstrList {
+		if instr.OpCode != OPX_BEGINBLOCK {
+			continue
+		}
+		if len(spans) != 0 {
+			spans[len(spans)-1].End = i
+		}
+		spans = append(spans, blockSpan{Begin: i})
+	}
+	spans[len(spans)-1].End = len(analysis.InstrList) - 1 // the last STOP is not in any block
+	return spans
+}
+
+// the PC of a basic block's first instruction, which is where a jump lands
+func (analysis AdvancedCodeAnalysis) blockPC(span blockSpan) int {
+	if pc := analysis.InstrList[span.Begin].PC; pc >= 0 {
+		return pc
+	}
+	return 0
+}
+
+// An abstract value is either unknown (nil) or one of a few constants
+type absValue []int
+
+// union of two abstract values
+func (a absValue) merge(b absValue) absValue {
+	if a == nil || b == nil {
+		return nil
+	}
+	res := append(absValue{}, a...)
+	for _, v := range b {
+		i := sort.SearchInts(res, v)
+		if i < len(res) && res[i] == v {
+			continue
+		}
+		res = append(res, 0)
+		copy(res[i+1:], res[i:])
+		res[i] = v
+	}
+	if len(res) > MaxJumpTargets {
+		return nil
+	}
+	return res
+}
+
+// An abstract stack only tracks some items near the top, all the items below them are unknown
+type absStack []absValue
+
+func (s absStack) clone() absStack {
+	return append(absStack{}, s...)
+}
+
+func (s *absStack) push(v absValue) {
+	*s = append(*s, v)
+}
+
+func (s *absStack) pop() absValue {
+	if len(*s) == 0 {
+		return nil
+	}
+	v := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return v
+}
+
+// get the n-th item from the top (n=0 means the top)
+func (s absStack) peek(n int) absValue {
+	if n >= len(s) {
+		return nil
+	}
+	return s[len(s)-1-n]
+}
+
+// make sure the n-th item from the top is tracked, such that it can be overwritten
+func (s *absStack) expose(n int) {
+	if n < len(*s) {
+		return
+	}
+	pad := make(absStack, n+1-len(*s))
+	*s = append(pad, *s...)
+}
+
+func (s absStack) equal(other absStack) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i, a := range s {
+		b := other[i]
+		if len(a) != len(b) || (a == nil) != (b == nil) {
+			return false
+		}
+		for j := range a {
+			if a[j] != b[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// merge two abstract stacks with their tops aligned, returning whether "s" is changed
+func (s *absStack) mergeFrom(other absStack) bool {
+	n := min(len(*s), len(other))
+	res := make(absStack, n)
+	changed := n != len(*s)
+	for i := 1; i <= n; i++ {
+		a, b := (*s)[len(*s)-i], other[len(other)-i]
+		res[n-i] = a.merge(b)
+		if len(res[n-i]) != len(a) || (a == nil) != (res[n-i] == nil) {
+			changed = true
+		}
+	}
+	*s = res
+	return changed
+}
+
+// simulate one instruction on the abstract stack
+func (s *absStack) exec(instr *Instruction) {
+	op := instr.OpCode
+	switch {
+	case op == NOP || op == OPX_BEGINBLOCK:
+	case op == OP_PUSH0:
+		s.push(absValue{0})
+	case OP_PUSH1 <= op && op <= OP_PUSH8:
+		if instr.SmallPushValue <= uint64(^uint32(0)) {
+			s.push(absValue{int(instr.SmallPushValue)})
+		} else {
+			s.push(nil) // too large to be a jump target
+		}
+	case OP_DUP1 <= op && op <= OP_DUP16:
+		s.push(s.peek(op - OP_DUP1))
+	case OP_SWAP1 <= op && op <= OP_SWAP16:
+		n := op - OP_SWAP1 + 1
+		s.expose(n)
+		top, nth := len(*s)-1, len(*s)-1-n
+		(*s)[top], (*s)[nth] = (*s)[nth], (*s)[top]
+	case op == OP_JUMP && instr.Number != 0: // the target was pushed by a fused NOP
+	case op == OP_JUMPI && instr.Number != 0:
+		s.pop() // the condition
+	case op < 0 || op > 255: // a fused instruction with unknown stack effect
+		*s = (*s)[:0]
+	default:
+		traits := TraitsTable[op]
+		for i := 0; i < int(traits.StackReq); i++ {
+			s.pop()
+		}
+		for i := 0; i < int(traits.StackReq+traits.StackChange); i++ {
+			s.push(nil)
+		}
+	}
+}
+
+// Statistics about the JUMP and JUMPI instructions in a contract
+type JumpStats struct {
+	Fused      int `json:"fused"`      // the target is pushed right before the jump
+	Resolved   int `json:"resolved"`   // the possible targets are found by abstract interpretation
+	Unresolved int `json:"unresolved"` // must use the JUMPTABLE
+}
+
+// the ratio of jumps whose target is known at compile time
+func (s JumpStats) StaticRatio() float64 {
+	total := s.Fused + s.Resolved + s.Unresolved
+	if total == 0 {
+		return 1
+	}
+	return float64(s.Fused+s.Resolved) / float64(total)
+}
+
+func (s JumpStats) String() string {
+	return fmt.Sprintf("fused=%d resolved=%d unresolved=%d static=%.1f%%",
+		s.Fused, s.Resolved, s.Unresolved, 100*s.StaticRatio())
+}
+
+func (analysis AdvancedCodeAnalysis) JumpStats() (stats JumpStats) {
+	for _, instr := range analysis.InstrList {
+		if instr.OpCode != OP_JUMP && instr.OpCode != OP_JUMPI {
+			continue
+		}
+		if instr.Number != 0 {
+			stats.Fused++
+		} else if len(instr.Targets) != 0 {
+			stats.Resolved++
+		} else {
+			stats.Unresolved++
+		}
+	}
+	return
+}
+
+// Find the possible targets of the JUMP/JUMPI instructions whose targets are not fused, by tracking
+// constants on the stack across DUP/SWAP/POP and across basic blocks. Each block is analyzed with
+// up to MaxJumpContexts different entry stacks, such that a function's return address is not mixed
+// up with the ones of other call sites. The jumps from unresolved JUMP/JUMPI are ignored, so the
+// results are only hints: the generated code still falls back to the JUMPTABLE when the target is
+// not in Instruction.Targets.
+func (analysis AdvancedCodeAnalysis) resolveJumps() {
+	spans := analysis.blockSpans()
+	blockOfPC := make(map[int]int, len(spans))
+	for i, span := range spans {
+		blockOfPC[analysis.blockPC(span)] = i
+	}
+	type context struct {
+		block int
+		index int
+	}
+	contexts := make([][]absStack, len(spans)) // the entry stacks of each block
+	var frozen []bool                          // the blocks whose entry stacks can no longer change
+	var queue []context
+	enqueue := func(i int, stack absStack) {
+		if frozen != nil && frozen[i] {
+			return
+		}
+		if len(stack) > maxTrackedDepth {
+			stack = stack[len(stack)-maxTrackedDepth:]
+		}
+		for _, c := range contexts[i] {
+			if c.equal(stack) {
+				return
+			}
+		}
+		if n := len(contexts[i]); n < MaxJumpContexts {
+			contexts[i] = append(contexts[i], stack.clone())
+			queue = append(queue, context{i, n})
+		} else if contexts[i][n-1].mergeFrom(stack) { // too many contexts, merge into the last one
+			queue = append(queue, context{i, n - 1})
+		}
+	}
+	targets := make(map[*Instruction]absValue)
+	resolve := func() {
+		for len(queue) != 0 {
+			ctx := queue[0]
+			queue = queue[1:]
+			stack := contexts[ctx.block][ctx.index].clone()
+			span := spans[ctx.block]
+			for _, instr := range analysis.InstrList[span.Begin:span.End] {
+				var target absValue
+				if instr.OpCode == OP_JUMP || instr.OpCode == OP_JUMPI {
+					target = absValue{instr.Number}
+					if instr.Number == 0 {
+						target = stack.peek(0)
+						if old, ok := targets[instr]; ok {
+							targets[instr] = old.merge(target)
+						} else {
+							targets[instr] = target
+						}
+					}
+				}
+				stack.exec(instr)
+				for _, pc := range target {
+					if _, ok := analysis.TargetsSet[pc]; ok {
+						enqueue(blockOfPC[pc], stack)
+					}
+				}
+			}
+			i := ctx.block
+			if i+1 < len(spans) && analysis.fallsThrough(analysis.InstrList[span.End-1]) {
+				enqueue(i+1, stack)
+			}
+		}
+	}
+	enqueue(0, absStack{})
+	resolve()
+	// the blocks only reachable from the JUMPTABLE start with an unknown stack, and they must not
+	// make the results of the blocks reachable from PC 0 less precise
+	frozen = make([]bool, len(spans))
+	for i := range spans {
+		frozen[i] = len(contexts[i]) != 0
+	}
+	for i := range spans {
+		if !frozen[i] {
+			enqueue(i, absStack{})
+		}
+	}
+	resolve()
+	for instr, target := range targets {
+		instr.Targets = append([]int(nil), target...) // do not share with the abstract stacks
+	}
+}
+
+// can the execution fall through to the next basic block after executing "last"?
+func (analysis AdvancedCodeAnalysis) fallsThrough(last *Instruction) bool {
+	switch last.OpCode {
+	case OP_JUMP, OP_STOP, OP_RETURN, OP_REVERT, OP_SELFDESTRUCT, OP_INVALID:
+		return false
+	}
+	return last.OpCode < 0 || OpTables[analysis.Rev][last.OpCode].FuncName != "op_undefined"
+}
@@ -0,0 +1,193 @@
+package maot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The JUMPTABLE dispatches the dynamic jumps whose targets are not found by resolveJumps. A switch over
+// sparse PCs may be lowered to a binary search, so it can also be a table of label addresses (a GNU
+// extension supported by GCC and Clang), indexed by PC when the JUMPDESTs are dense enough, or else
+// an open-addressing hash table keyed by PC. The table is guarded by MAOT_COMPUTED_GOTO, which is
+// defined in instrexe.hpp, and the switch is still used with the compilers lacking the extension.
+
+// JumpTableKind selects how the JUMPTABLE of a contract is implemented
+type JumpTableKind int
+
+const (
+	JumpTableAuto   JumpTableKind = iota // JumpTableGoto for the contracts with many dynamic targets
+	JumpTableSwitch                      // switch(PC)
+	JumpTableGoto                        // a table of label addresses, falling back to switch(PC)
+)
+
+var jumpTableNames = []string{"auto", "switch", "goto"}
+
+func (k JumpTableKind) String() string {
+	if int(k) < 0 || int(k) >= len(jumpTableNames) {
+		return fmt.Sprintf("JumpTableKind(%d)", int(k))
+	}
+	return jumpTableNames[k]
+}
+
+// ParseJumpTableKind converts a name such as "goto" to a JumpTableKind
+func ParseJumpTableKind(s string) (JumpTableKind, error) {
+	for i, name := range jumpTableNames {
+		if strings.EqualFold(s, name) {
+			return JumpTableKind(i), nil
+		}
+	}
+	return JumpTableAuto, fmt.Errorf("unknown jump table %q (want one of %s)", s, strings.Join(jumpTableNames, ", "))
+}
+
+const (
+	// JumpTableAuto uses the label table for the contracts with at least so many JUMPDESTs. With fewer
+	// targets, the switch compiled by GCC is as fast or faster in the benchmark of DumpJumpTableBenchmark.
+	// The medians of 5 runs of runaot jumpbench, in ns/jump, with g++ 12.2.0 -O3 on one vCPU of an
+	// Intel Xeon (AVX-512) VM under Linux 6.18:
+	//
+	//	JUMPDESTs        16    32    64   100   500  2000  babylon (47)
+	//	switch          9.2  10.2  19.2  23.1  46.3  53.3  11.8
+	//	goto, indexed  13.7  12.0  13.0  13.7  16.1  18.2  12.8
+	//	goto, hashed   13.8  13.7  13.0  12.9  18.8  18.3  14.4
+	autoGotoTargets = 64
+	// the label table is indexed by PC if it has at most so many slots per JUMPDEST
+	maxDenseSlots = 8
+)
+
+// defines MAOT_COMPUTED_GOTO in instrexe.hpp, which can be overridden with -DMAOT_COMPUTED_GOTO=0
+const computedGotoMacro = `// labels as values are supported by GCC and Clang, and used by the computed-goto jump tables
+#ifndef MAOT_COMPUTED_GOTO
+#if defined(__GNUC__)
+#define MAOT_COMPUTED_GOTO 1
+#else
+#define MAOT_COMPUTED_GOTO 0
+#endif
+#endif
+`
+
+// the kind of the JUMPTABLE of the contract named so, never JumpTableAuto
+func (analysis AdvancedCodeAnalysis) jumpTableKind(name string) JumpTableKind {
+	kind, ok := analysis.Options.ContractJumpTables[name]
+	if !ok {
+		kind = analysis.Options.JumpTable
+	}
+	if kind != JumpTableAuto {
+		return kind
+	}
+	if len(analysis.JumpTableTargets()) >= autoGotoTargets {
+		return JumpTableGoto
+	}
+	return JumpTableSwitch // the JUMPTABLE is never used or small
+}
+
+// JumpTableTargets returns the sorted PCs which the JUMPTABLE jumps to, empty if no reachable JUMP/JUMPI
+// uses it
+func (analysis AdvancedCodeAnalysis) JumpTableTargets() []int {
+	dynamic := analysis.dynamicTargets()
+	targets := make([]int, 0, len(dynamic))
+	for _, pc := range analysis.JumpdestTargets {
+		if _, ok := dynamic[pc]; ok {
+			targets = append(targets, pc)
+		}
+	}
+	return targets
+}
+
+// can the label table of targets be indexed by PC?
+func denseJumpTable(targets []int) bool {
+	return len(targets) != 0 && targets[len(targets)-1]+1 <= maxDenseSlots*len(targets)
+}
+
+// the slot of pc in a hash table with mask+1 slots, the same as in the generated code
+func jumpHash(pc int, mask uint32) uint32 {
+	return (uint32(pc) * 2654435761) & mask
+}
+
+// Emit the code jumping to L<PC> for each PC in targets, which are sorted. For the other PCs the
+// execution continues after the emitted code.
+func dumpJumpDispatch(fout io.Writer, targets []int, kind JumpTableKind, dense bool) {
+	if kind != JumpTableGoto || len(targets) == 0 {
+		dumpJumpSwitch(fout, targets)
+		return
+	}
+	wr(fout, "#if MAOT_COMPUTED_GOTO\n{\n")
+	if dense {
+		size := targets[len(targets)-1] + 1
+		labels := make([]string, size)
+		for i := range labels {
+			labels[i] = "&&JUMPTABLE_MISS"
+		}
+		for _, target := range targets {
+			labels[target] = fmt.Sprintf("&&L%05d", target)
+		}
+		wr(fout, "static void* const jump_labels[%d] = {\n", size)
+		for i := 0; i < size; i += 8 {
+			wr(fout, "  %s,\n", strings.Join(labels[i:min(i+8, size)], ", "))
+		}
+		wr(fout, "};\n")
+		wr(fout, "if(PC < %d) goto *jump_labels[PC];\n", size)
+	} else {
+		size := 1
+		for size < 2*len(targets) { // at least half of the slots are empty
+			size *= 2
+		}
+		mask := uint32(size - 1)
+		const empty = "{0xffffffffu, &&JUMPTABLE_MISS}"
+		entries := make([]string, size)
+		for i := range entries {
+			entries[i] = empty
+		}
+		for _, target := range targets {
+			i := jumpHash(target, mask)
+			for entries[i] != empty { // linear probing
+				i = (i + 1) & mask
+			}
+			entries[i] = fmt.Sprintf("{%d, &&L%05d}", target, target)
+		}
+		wr(fout, "struct jump_entry { uint32_t pc; void* label; };\n")
+		wr(fout, "static const jump_entry jump_entries[%d] = {\n", size)
+		for i := 0; i < size; i += 4 {
+			wr(fout, "  %s,\n", strings.Join(entries[i:min(i+4, size)], ", "))
+		}
+		wr(fout, "};\n")
+		wr(fout, "for(uint32_t i = (static_cast<uint32_t>(PC) * 2654435761u) & %du;; i = (i + 1) & %du) {\n", mask, mask)
+		wr(fout, "  if(jump_entries[i].pc == PC) goto *jump_entries[i].label;\n")
+		wr(fout, "  if(jump_entries[i].pc == 0xffffffffu) break; // an empty slot\n")
+		wr(fout, "}\n")
+	}
+	wr(fout, "}\nJUMPTABLE_MISS:\n#else\n")
+	dumpJumpSwitch(fout, targets)
+	wr(fout, "#endif\n")
+}
+
+func dumpJumpSwitch(fout io.Writer, targets []int) {
+	wr(fout, "switch(PC){\n")
+	for _, target := range targets {
+		wr(fout, "  case %d: goto L%05d;\n", target, target)
+	}
+	wr(fout, "}\n")
+}
+
+// describe the JUMPTABLE of the contract named so
+func (analysis AdvancedCodeAnalysis) jumpTableDesc(name string) string {
+	targets := analysis.JumpTableTargets()
+	if analysis.jumpTableKind(name) == JumpTableSwitch || len(targets) == 0 {
+		return fmt.Sprintf("switch with %d cases", len(targets))
+	}
+	if denseJumpTable(targets) {
+		return fmt.Sprintf("goto, indexed by PC with %d slots", targets[len(targets)-1]+1)
+	}
+	return fmt.Sprintf("goto, hashed for %d targets", len(targets))
+}
+
+// the per-contract kinds in the settings of the manifest, sorted by the contract names
+func contractJumpTablesDesc(m map[string]JumpTableKind) string {
+	items := make([]string, 0, len(m))
+	for name, kind := range m {
+		items = append(items, name+":"+kind.String())
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,294 @@
+package maot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// A library built from the output of AotCompile exports evmaot_info(), which returns a pointer to
+// evmaot_info_data, an evmaot_info_t struct defined in evmaot_info.h. Except the contracts pointer,
+// the struct has no pointers and is constant-initialized, so ReadLibraryInfo can find it in the file
+// through the dynamic symbol table, without loading the library. The layout only changes together
+// with EVMAOT_ABI_VERSION.
+
+const evmaotABIVersion = 1
+
+// the file included by query_executor.cpp, which hosts can also include
+const evmaotInfoHeader = "evmaot_info.h"
+
+const evmaotInfoHeaderSrc = `#pragma once
+#include <stdint.h>
+
+#define EVMAOT_ABI_VERSION 1
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct evmaot_contract {
+    uint8_t address[20];
+    uint8_t code_hash[32]; // keccak256 of the bytecode
+} evmaot_contract;
+
+typedef struct evmaot_info_t {
+    uint32_t abi_version;       // EVMAOT_ABI_VERSION
+    uint32_t generator_version; // bumped when moeingaot's generated code changes
+    uint64_t revisions;         // bit i is set if the contracts are compiled for evmc_revision i
+    uint32_t emit_mode;         // 0: release, 1: trace, 2: stackdump
+    uint32_t contract_count;
+    int64_t build_timestamp;    // when the dispatcher is generated, in seconds since the Unix epoch
+    char moeingaot_version[32]; // the following strings are NUL-terminated, and truncated if too long
+    char evmone_version[32];
+    char compiler[128];
+    char compile_flags[256];
+    const evmaot_contract* contracts; // contract_count entries, sorted by address
+    char cxx_namespace[64];     // the namespace of the executors, "maot" or "maot_<libid>"
+    char lib_id[64];            // the library id given to AotCompile, empty if none
+} evmaot_info_t;
+
+// the type of evmaot_info() or evmaot_info_<libid>()
+typedef const evmaot_info_t* (*evmaot_info_fn)(void);
+
+#ifdef __cplusplus
+}
+#endif
+`
+
+// the offsets in evmaot_info_t, which are checked by static_assert in the generated code
+const (
+	infoOffRevisions      = 8
+	infoOffEmitMode       = 16
+	infoOffContractCount  = 20
+	infoOffTimestamp      = 24
+	infoOffMoeingaot      = 32
+	infoOffEvmone         = 64
+	infoOffCompiler       = 96
+	infoOffCompileFlags   = 224
+	infoOffContracts      = 480
+	infoOffNamespace      = 488
+	infoOffLibID          = 552
+	infoSize              = 616
+	infoContractEntrySize = 52
+)
+
+// the version of the moeingaot module which is running, "(devel)" if unknown
+func moduleVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == "github.com/smartbch/moeingaot" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/smartbch/moeingaot" {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+// define evmaot_contracts, evmaot_info_data and evmaot_info for the contracts in desc
+func libraryInfoLines(syms symbolNames, desc libraryDesc) []string {
+	var revisions uint64
+	for _, rev := range desc.Revs {
+		revisions |= 1 << uint(rev)
+	}
+	contracts := syms.exported("evmaot_contracts")
+	infoData := syms.exported("evmaot_info_data")
+	lines := []string{fmt.Sprintf(`#ifndef EVMAOT_EVMONE_VERSION
+#define EVMAOT_EVMONE_VERSION "unknown"
+#endif
+#ifndef EVMAOT_COMPILE_FLAGS
+#define EVMAOT_COMPILE_FLAGS ""
+#endif
+
+static_assert(offsetof(evmaot_info_t, revisions) == %d && offsetof(evmaot_info_t, compile_flags) == %d &&
+    offsetof(evmaot_info_t, contracts) == %d && offsetof(evmaot_info_t, lib_id) == %d &&
+    sizeof(evmaot_info_t) == %d && sizeof(evmaot_contract) == %d, "unexpected layout of evmaot_info_t");
+
+extern "C" {
+__attribute__ ((visibility ("default"))) extern const evmaot_contract %s[%d];
+__attribute__ ((visibility ("default"))) extern const evmaot_info_t %s;
+__attribute__ ((visibility ("default"))) const evmaot_info_t* %s();
+}
+
+const evmaot_contract %s[%d] = {`, infoOffRevisions, infoOffCompileFlags, infoOffContracts, infoOffLibID, infoSize,
+		infoContractEntrySize,
+		contracts, max(1, len(desc.AddrList)), infoData, syms.exported("evmaot_info"),
+		contracts, max(1, len(desc.AddrList)))}
+	for _, addr := range desc.AddrList {
+		key, _ := hex.DecodeString(addr) // checked by getQueryExecutorSrc
+		hash := desc.CodeHashes[addr]
+		lines = append(lines, fmt.Sprintf("\t{%s, %s},", bytesInitializer(key), bytesInitializer(hash[:])))
+	}
+	lines = append(lines, fmt.Sprintf(`};
+
+template <size_t N, size_t M>
+static constexpr void copy_info_str(char (&dst)[N], const char (&src)[M]) {
+	for(size_t i = 0; i + 1 < N && i + 1 < M; i++) dst[i] = src[i]; // the rest are zeros
+}
+
+static constexpr evmaot_info_t make_info() {
+	evmaot_info_t info{};
+	info.abi_version = EVMAOT_ABI_VERSION;
+	info.generator_version = %d;
+	info.revisions = 0x%xull;
+	info.emit_mode = %d;
+	info.contract_count = %d;
+	info.build_timestamp = %d;
+	copy_info_str(info.moeingaot_version, %s);
+	copy_info_str(info.evmone_version, EVMAOT_EVMONE_VERSION);
+	copy_info_str(info.compiler, __VERSION__);
+	copy_info_str(info.compile_flags, EVMAOT_COMPILE_FLAGS);
+	info.contracts = %s;
+	copy_info_str(info.cxx_namespace, %s);
+	copy_info_str(info.lib_id, %s);
+	return info;
+}
+
+const evmaot_info_t %s = make_info();
+
+const evmaot_info_t* %s() {
+	return &%s;
+}
+`, generatorVersion, revisions, int(desc.Opts.Mode), len(desc.AddrList), desc.Timestamp,
+		cStringLiteral(moduleVersion()), contracts, cStringLiteral(syms.ns), cStringLiteral(desc.Opts.LibID), infoData, syms.exported("evmaot_info"), infoData))
+	return lines
+}
+
+// What a library built from the output of AotCompile says about itself
+type LibraryInfo struct {
+	ABIVersion       uint32
+	GeneratorVersion uint32
+	Revisions        []int
+	Mode             EmitMode
+	BuildTime        time.Time
+	MoeingaotVersion string
+	EvmoneVersion    string
+	Compiler         string
+	CompileFlags     string
+	Namespace        string // the C++ namespace of the executors
+	LibID            string
+	Contracts        []LibraryContract
+}
+
+type LibraryContract struct {
+	Addr     string // 40 hex digits in lowercase
+	CodeHash [32]byte
+}
+
+// ReadLibraryInfo reads what evmaot_info() would return from an ELF shared library, without loading it.
+// libID must be the one used by AotCompile, and can be empty.
+func ReadLibraryInfo(fname string, libID string) (*LibraryInfo, error) {
+	f, err := elf.Open(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	defer f.Close()
+	syms := Options{LibID: libID}.symbols()
+	infoName := syms.exported("evmaot_info_data")
+	data, err := readSymbol(f, infoName)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	if len(data) < infoSize {
+		return nil, &CompileError{File: fname, Offset: -1, Err: fmt.Errorf("%s is too small", infoName)}
+	}
+	order := f.ByteOrder
+	info := &LibraryInfo{
+		ABIVersion:       order.Uint32(data[0:]),
+		GeneratorVersion: order.Uint32(data[4:]),
+		Mode:             EmitMode(order.Uint32(data[infoOffEmitMode:])),
+		BuildTime:        time.Unix(int64(order.Uint64(data[infoOffTimestamp:])), 0),
+		MoeingaotVersion: cString(data[infoOffMoeingaot:infoOffEvmone]),
+		EvmoneVersion:    cString(data[infoOffEvmone:infoOffCompiler]),
+		Compiler:         cString(data[infoOffCompiler:infoOffCompileFlags]),
+		CompileFlags:     cString(data[infoOffCompileFlags:infoOffContracts]),
+		Namespace:        cString(data[infoOffNamespace:infoOffLibID]),
+		LibID:            cString(data[infoOffLibID:infoSize]),
+	}
+	if info.ABIVersion != evmaotABIVersion {
+		return nil, &CompileError{File: fname, Offset: -1,
+			Err: fmt.Errorf("unsupported ABI version %d of %s", info.ABIVersion, infoName)}
+	}
+	revisions := order.Uint64(data[infoOffRevisions:])
+	for rev := range RevisionNames {
+		if revisions&(1<<uint(rev)) != 0 {
+			info.Revisions = append(info.Revisions, rev)
+		}
+	}
+	count := int(order.Uint32(data[infoOffContractCount:]))
+	table, err := readSymbol(f, syms.exported("evmaot_contracts"))
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	if len(table) < count*infoContractEntrySize {
+		return nil, &CompileError{File: fname, Offset: -1,
+			Err: fmt.Errorf("the contract table has less than %d entries", count)}
+	}
+	info.Contracts = make([]LibraryContract, count)
+	for i := range info.Contracts {
+		entry := table[i*infoContractEntrySize:]
+		info.Contracts[i].Addr = hex.EncodeToString(entry[:20])
+		copy(info.Contracts[i].CodeHash[:], entry[20:52])
+	}
+	return info, nil
+}
+
+// the content of a data symbol, looked up in the dynamic symbol table and then in the full one
+func readSymbol(f *elf.File, name string) ([]byte, error) {
+	for _, getSymbols := range []func() ([]elf.Symbol, error){f.DynamicSymbols, f.Symbols} {
+		symbols, _ := getSymbols()
+		for _, sym := range symbols {
+			if sym.Name != name || sym.Section == elf.SHN_UNDEF || int(sym.Section) >= len(f.Sections) {
+				continue
+			}
+			sec := f.Sections[sym.Section]
+			if sec.Type == elf.SHT_NOBITS {
+				return make([]byte, sym.Size), nil // all zeros
+			}
+			data := make([]byte, sym.Size)
+			if _, err := sec.ReadAt(data, int64(sym.Value-sec.Addr)); err != nil {
+				return nil, fmt.Errorf("cannot read %s: %w", name, err)
+			}
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("symbol %s is not found, is it built by moeingaot with the same library id?", name)
+}
+
+// a NUL-terminated string in a fixed-size buffer
+func cString(bz []byte) string {
+	if i := bytes.IndexByte(bz, 0); i >= 0 {
+		bz = bz[:i]
+	}
+	return string(bz)
+}
+
+// Print the information in a human-readable form
+func (info *LibraryInfo) Print(w io.Writer) {
+	revs := make([]string, len(info.Revisions))
+	for i, rev := range info.Revisions {
+		revs[i] = RevisionNames[rev]
+	}
+	fmt.Fprintf(w, "abi version:       %d\n", info.ABIVersion)
+	fmt.Fprintf(w, "generator version: %d\n", info.GeneratorVersion)
+	fmt.Fprintf(w, "moeingaot version: %s\n", info.MoeingaotVersion)
+	fmt.Fprintf(w, "evmone version:    %s\n", info.EvmoneVersion)
+	fmt.Fprintf(w, "compiler:          %s\n", info.Compiler)
+	fmt.Fprintf(w, "compile flags:     %s\n", info.CompileFlags)
+	fmt.Fprintf(w, "namespace:         %s\n", info.Namespace)
+	fmt.Fprintf(w, "library id:        %s\n", info.LibID)
+	fmt.Fprintf(w, "revisions:         %s\n", strings.Join(revs, ","))
+	fmt.Fprintf(w, "mode:              %s\n", info.Mode)
+	fmt.Fprintf(w, "generated at:      %s\n", info.BuildTime.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "contracts:         %d\n", len(info.Contracts))
+	for _, c := range info.Contracts {
+		fmt.Fprintf(w, "  %s %s\n", c.Addr, codeHashHex(c.CodeHash))
+	}
+}
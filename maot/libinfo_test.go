@@ -0,0 +1,60 @@
+package maot
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/smartbch/moeingaot/keccak"
+)
+
+// compile query_executor.cpp into a library and read back what evmaot_info describes
+func TestReadLibraryInfo(t *testing.T) {
+	cfg := DefaultBuildConfig()
+	if _, err := exec.LookPath(cfg.Compiler); err != nil {
+		t.Skipf("%s is not found", cfg.Compiler)
+	}
+	if !fileExists(path.Join(os.Getenv("MOEINGEVM"), "evmwrap/evmc/include/evmc/evmc.h")) {
+		t.Skip("the evmc headers are not found under $MOEINGEVM")
+	}
+	outDir := t.TempDir()
+	opts := DefaultOptions()
+	opts.LibID = "test"
+	in := ContractInput{Addr: "00000000000000000000000000000000000000aa", Code: []byte{OP_PUSH1, 1, OP_STOP}, Source: "test"}
+	if _, err := AotCompileContracts([]int{EVMC_BERLIN, EVMC_LONDON}, []ContractInput{in}, outDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	lib := path.Join(outDir, "libtest.so")
+	args := append([]string{"-shared", "-o", lib}, cfg.Flags...)
+	for _, dir := range cfg.IncludeDirs {
+		args = append(args, "-I", dir)
+	}
+	args = append(args, "-fvisibility=hidden", path.Join(outDir, "query_executor.cpp"))
+	if out, err := exec.Command(cfg.Compiler, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+
+	info, err := ReadLibraryInfo(lib, opts.LibID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ABIVersion != evmaotABIVersion || info.GeneratorVersion != generatorVersion || info.Mode != opts.Mode {
+		t.Errorf("ABIVersion=%d GeneratorVersion=%d Mode=%s", info.ABIVersion, info.GeneratorVersion, info.Mode)
+	}
+	if info.Namespace != "maot_test" || info.LibID != "test" {
+		t.Errorf("Namespace=%q LibID=%q", info.Namespace, info.LibID)
+	}
+	if len(info.Revisions) != 2 || info.Revisions[0] != EVMC_BERLIN || info.Revisions[1] != EVMC_LONDON {
+		t.Errorf("Revisions=%v", info.Revisions)
+	}
+	if len(info.Contracts) != 1 || info.Contracts[0].Addr != in.Addr || info.Contracts[0].CodeHash != keccak.Sum256(in.Code) {
+		t.Errorf("Contracts=%v", info.Contracts)
+	}
+	if len(info.Compiler) == 0 {
+		t.Error("the compiler is not recorded")
+	}
+	if _, err := ReadLibraryInfo(lib, ""); err == nil {
+		t.Error("the library is read with another library id")
+	}
+}
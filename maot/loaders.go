@@ -0,0 +1,368 @@
+package maot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/smartbch/moeingaot/keccak"
+)
+
+// A contract read by a Loader, before its address is validated
+type ContractInput struct {
+	Addr   string // as written in the input, maybe with 0x or in EIP-55 mixed case
+	Code   []byte
+	Source string // where it is read from, for error messages, such as "a.jsonl:3"
+}
+
+// LoadOptions controls how LoadContracts reads the contracts
+type LoadOptions struct {
+	Format string // one of the registered formats, detected from the input if empty
+	// for the output of solc, which has no address: the contract's name (such as "Token" or
+	// "src/Token.sol:Token") to its address, which must not be empty. The contracts not listed here are
+	// ignored.
+	Addresses map[string]string
+}
+
+// A Loader reads the contracts from input, which is a file or a directory
+type Loader func(input string, opts LoadOptions) ([]ContractInput, error)
+
+var loaders = map[string]Loader{
+	"dir":   loadDir,
+	"json":  loadJSON,
+	"jsonl": loadJSONL,
+	"solc":  loadSolc,
+}
+
+// RegisterLoader adds a format for LoadContracts, or replaces an existing one
+func RegisterLoader(format string, loader Loader) {
+	loaders[format] = loader
+}
+
+// the format of input, which is detected from its type, its extension and its content
+func detectFormat(input string) (string, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "dir", nil
+	}
+	if strings.HasSuffix(input, ".jsonl") {
+		return "jsonl", nil
+	}
+	content, err := os.ReadFile(input)
+	if err != nil {
+		return "", err
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(content, &obj) == nil {
+		if _, ok := obj["contracts"]; ok {
+			return "solc", nil
+		}
+	}
+	return "json", nil
+}
+
+// LoadInputs runs the loader of opts.Format, or of the detected format, without validating the addresses
+func LoadInputs(input string, opts LoadOptions) ([]ContractInput, error) {
+	format := opts.Format
+	if len(format) == 0 {
+		var err error
+		if format, err = detectFormat(input); err != nil {
+			return nil, &CompileError{File: input, Offset: -1, Err: err}
+		}
+	}
+	loader, ok := loaders[format]
+	if !ok {
+		names := make([]string, 0, len(loaders))
+		for name := range loaders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown input format %q (want one of %s)", format, strings.Join(names, ", "))
+	}
+	return loader(input, opts)
+}
+
+// LoadContracts reads the contracts in input, and returns a map from the canonical address (40 lowercase
+// hex digits, see ParseAddress) to the bytecode. The addresses must be valid and unique, and the bytecodes
+// must not be empty.
+func LoadContracts(input string, opts LoadOptions) (map[string][]byte, error) {
+	inputs, err := LoadInputs(input, opts)
+	if err != nil {
+		return nil, err
+	}
+	codeMap, rejected, err := normalizeAddresses(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rejected) != 0 {
+		return nil, &CompileError{File: rejected[0].Source, Addr: rejected[0].Name, Offset: -1,
+			Err: errors.New(rejected[0].Reason)}
+	}
+	return codeMap, nil
+}
+
+// Convert the addresses of inputs to the canonical form, which is also used in the C++ identifiers
+// and the file names. The invalid ones are rejected, such as a file named README, and it is an error
+// if two inputs have the same address, even if in different cases or prefixes.
+func normalizeAddresses(inputs []ContractInput) (map[string][]byte, []RejectedInput, error) {
+	codeMap := make(map[string][]byte, len(inputs))
+	sources := make(map[string]string, len(inputs))
+	var rejected []RejectedInput
+	for _, in := range inputs {
+		addr, err := validateInput(in.Addr, in.Code)
+		if err != nil {
+			rejected = append(rejected, RejectedInput{Name: in.Addr, Source: in.Source, Reason: err.Error()})
+			continue
+		}
+		if prev, ok := sources[addr]; ok {
+			return nil, nil, &CompileError{File: in.Source, Addr: addr, Offset: -1,
+				Err: fmt.Errorf("duplicated address, which is also in %s", prev)}
+		}
+		sources[addr] = in.Source
+		codeMap[addr] = in.Code
+	}
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].Source < rejected[j].Source })
+	return codeMap, rejected, nil
+}
+
+// returns the canonical address if the contract can be compiled
+func validateInput(name string, code []byte) (string, error) {
+	addr, err := ParseAddress(name)
+	if err == nil && len(code) == 0 {
+		err = fmt.Errorf("empty bytecode")
+	}
+	return addr, err
+}
+
+// ParseAddress accepts 40 hex digits with an optional 0x prefix, and returns them in lowercase without
+// the prefix. If the digits are in mixed case, they must have the right EIP-55 checksum.
+func ParseAddress(s string) (string, error) {
+	hexStr := strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if len(hexStr) != 40 {
+		return "", fmt.Errorf("invalid address %q: want 40 hex digits, got %d characters", s, len(hexStr))
+	}
+	if _, offset, err := decodeHex(hexStr); err != nil {
+		return "", fmt.Errorf("invalid address %q at %d: %w", s, offset, err)
+	}
+	lower := strings.ToLower(hexStr)
+	if hexStr != lower && hexStr != strings.ToUpper(hexStr) && hexStr != checksumAddress(lower) {
+		return "", fmt.Errorf("invalid address %q: wrong EIP-55 checksum, want 0x%s", s, checksumAddress(lower))
+	}
+	return lower, nil
+}
+
+// the EIP-55 mixed-case form of a lowercase address, without 0x
+func checksumAddress(lower string) string {
+	hash := keccak.Sum256([]byte(lower))
+	res := []byte(lower)
+	for i, c := range res {
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0xf
+		}
+		if c >= 'a' && nibble >= 8 {
+			res[i] = c - 'a' + 'A'
+		}
+	}
+	return string(res)
+}
+
+// decode bytecode in hex, with an optional 0x prefix and surrounding white spaces, returning the
+// offset of the first offending character on failure
+func decodeCodeHex(s string) ([]byte, int, error) {
+	trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+	leading := len(s) - len(trimmed)
+	if strings.HasPrefix(trimmed, "0x") || strings.HasPrefix(trimmed, "0X") {
+		trimmed = trimmed[2:]
+		leading += 2
+	}
+	code, offset, err := decodeHex(strings.TrimRightFunc(trimmed, unicode.IsSpace))
+	return code, leading + offset, err
+}
+
+// a directory of files named by the addresses, optionally with the extension .hex or .bin,
+// the .bin files contain raw bytecode, and the others contain bytecode in hex
+func loadDir(dir string, opts LoadOptions) ([]ContractInput, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, &CompileError{File: dir, Offset: -1, Err: err}
+	}
+	inputs := make([]ContractInput, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fname := path.Join(dir, entry.Name())
+		addr := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".hex"), ".bin")
+		var code []byte
+		if _, err := ParseAddress(addr); err != nil { // such as README, reported when validating the address
+			inputs = append(inputs, ContractInput{Addr: entry.Name(), Source: fname})
+			continue
+		}
+		if strings.HasSuffix(entry.Name(), ".bin") {
+			code, err = os.ReadFile(fname)
+			if err != nil {
+				return nil, &CompileError{File: fname, Addr: addr, Offset: -1, Err: err}
+			}
+		} else {
+			code, err = ReadHexFile(fname)
+			if err != nil {
+				err.(*CompileError).Addr = addr
+				return nil, err
+			}
+		}
+		inputs = append(inputs, ContractInput{Addr: addr, Code: code, Source: fname})
+	}
+	return inputs, nil
+}
+
+// a record in the json or jsonl formats
+type contractRecord struct {
+	Address string `json:"address"`
+	Code    string `json:"code"`
+}
+
+func (r contractRecord) toInput(source string) (ContractInput, error) {
+	code, offset, err := decodeCodeHex(r.Code)
+	if err != nil {
+		return ContractInput{}, &CompileError{File: source, Addr: r.Address, Offset: -1,
+			Err: fmt.Errorf("code at %d: %w", offset, err)}
+	}
+	return ContractInput{Addr: r.Address, Code: code, Source: source}, nil
+}
+
+// a JSON array of {"address": ..., "code": ...}
+func loadJSON(fname string, opts LoadOptions) ([]ContractInput, error) {
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	var records []contractRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	inputs := make([]ContractInput, len(records))
+	for i, r := range records {
+		if inputs[i], err = r.toInput(fmt.Sprintf("%s[%d]", fname, i)); err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
+
+// one {"address": ..., "code": ...} per line, and the empty lines are ignored
+func loadJSONL(fname string, opts LoadOptions) ([]ContractInput, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	defer f.Close()
+	var inputs []ContractInput
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<26) // a line contains a whole bytecode
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", fname, lineNo)
+		var r contractRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, &CompileError{File: source, Offset: -1, Err: err}
+		}
+		in, err := r.toInput(source)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	return inputs, nil
+}
+
+// the output of solc --combined-json bin-runtime, or of solc --standard-json, whose contracts
+// are given addresses by opts.Addresses
+func loadSolc(fname string, opts LoadOptions) ([]ContractInput, error) {
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	var output struct {
+		Contracts map[string]json.RawMessage `json:"contracts"`
+	}
+	if err := json.Unmarshal(content, &output); err != nil {
+		return nil, &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	deployed := make(map[string]string) // "file:Name" -> the runtime bytecode in hex
+	for key, raw := range output.Contracts {
+		var combined struct {
+			BinRuntime *string `json:"bin-runtime"`
+		}
+		if json.Unmarshal(raw, &combined) == nil && combined.BinRuntime != nil { // --combined-json
+			deployed[key] = *combined.BinRuntime
+			continue
+		}
+		var standard map[string]struct { // --standard-json, key is the source file
+			EVM struct {
+				DeployedBytecode struct {
+					Object string `json:"object"`
+				} `json:"deployedBytecode"`
+			} `json:"evm"`
+		}
+		if err := json.Unmarshal(raw, &standard); err != nil {
+			return nil, &CompileError{File: fname, Offset: -1,
+				Err: fmt.Errorf("contracts[%q] has neither bin-runtime nor evm.deployedBytecode", key)}
+		}
+		for name, c := range standard {
+			deployed[key+":"+name] = c.EVM.DeployedBytecode.Object
+		}
+	}
+
+	if len(opts.Addresses) == 0 { // nothing would be compiled
+		keys := make([]string, 0, len(deployed))
+		for key := range deployed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return nil, &CompileError{File: fname, Offset: -1,
+			Err: fmt.Errorf("no addresses are given for the contracts %v", keys)}
+	}
+	names := make([]string, 0, len(opts.Addresses))
+	for name := range opts.Addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	inputs := make([]ContractInput, 0, len(names))
+	for _, name := range names {
+		var matches []string
+		for key := range deployed {
+			if key == name || strings.HasSuffix(key, ":"+name) {
+				matches = append(matches, key)
+			}
+		}
+		if len(matches) != 1 {
+			sort.Strings(matches)
+			return nil, &CompileError{File: fname, Addr: opts.Addresses[name], Offset: -1,
+				Err: fmt.Errorf("contract %q matches %d contracts %v, want exactly one", name, len(matches), matches)}
+		}
+		source := fname + ":" + matches[0]
+		in, err := contractRecord{Address: opts.Addresses[name], Code: deployed[matches[0]]}.toInput(source)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
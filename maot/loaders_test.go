@@ -0,0 +1,38 @@
+package maot
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoadContracts(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		fname := path.Join(dir, name)
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	jsonl := write("a.jsonl", `{"address":"0x00000000000000000000000000000000000000AA","code":"0x6001"}`+"\n"+
+		`{"address":"bad","code":"0x6001"}`+"\n")
+	if _, err := LoadContracts(jsonl, LoadOptions{}); err == nil || !strings.Contains(err.Error(), "invalid address") {
+		t.Errorf("LoadContracts with an invalid address: %v", err)
+	}
+	// the same address as the first line, in lowercase
+	dup := write("b.jsonl", `{"address":"00000000000000000000000000000000000000aa","code":"0x6001"}`+"\n"+
+		`{"address":"0x00000000000000000000000000000000000000AA","code":"0x6002"}`+"\n")
+	if _, err := LoadContracts(dup, LoadOptions{}); err == nil || !strings.Contains(err.Error(), "duplicated address") {
+		t.Errorf("LoadContracts with a duplicated address: %v", err)
+	}
+	solc := write("solc.json", `{"contracts":{"a.sol:A":{"bin-runtime":"6001"}}}`)
+	if _, err := LoadContracts(solc, LoadOptions{}); err == nil || !strings.Contains(err.Error(), "a.sol:A") {
+		t.Errorf("LoadContracts of solc without addresses: %v", err)
+	}
+	codeMap, err := LoadContracts(solc, LoadOptions{Addresses: map[string]string{"A": "0x00000000000000000000000000000000000000aa"}})
+	if err != nil || len(codeMap["00000000000000000000000000000000000000aa"]) != 2 {
+		t.Errorf("LoadContracts of solc=%x, %v", codeMap, err)
+	}
+}
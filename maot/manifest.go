@@ -0,0 +1,89 @@
+package maot
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// bump it when the generated code changes, so that the contracts compiled before are regenerated
+const generatorVersion = 3
+
+// The manifest in the output directory of AotCompile, which remembers what each file is generated from
+type aotManifest struct {
+	Settings  string                      `json:"settings"` // the generator version, revisions and Options
+	Contracts map[string]manifestContract `json:"contracts"`
+}
+
+type manifestContract struct {
+	CodeHash string      `json:"code_hash"`
+	File     string      `json:"file"`
+	Jumps    JumpStats   `json:"jumps"` // for reporting the contracts which are not regenerated
+	Fusion   FusionStats `json:"fusion"`
+}
+
+const aotManifestFile = "aot_manifest.json"
+
+func aotSettings(revs []int, opts Options) string {
+	names := make([]string, len(revs))
+	for i, rev := range revs {
+		names[i] = RevisionNames[rev]
+	}
+	return fmt.Sprintf("v%d revs=%s mode=%s ns=%s lib=%s fusion=%t stackcache=%t stackheights=%t merge=%t solc=%t jumptable=%s(%s)",
+		generatorVersion, strings.Join(names, ","), opts.Mode, opts.symbols().ns, opts.LibID, opts.Fusion,
+		opts.StackCache, opts.StackHeights, opts.MergeBlocks, opts.SolcAssumptions, opts.JumpTable, contractJumpTablesDesc(opts.ContractJumpTables))
+}
+
+// the file generated for a contract in the output directory, addr must be normalized
+func contractFileName(addr string) string {
+	return addr + ".cpp"
+}
+
+// A missing or broken manifest is treated as an empty one, so everything is regenerated. The same
+// goes for the entries which are not named after a normalized address, or whose file is not the one
+// generated for it, so that an edited manifest can never remove the files outside the output directory.
+func readAotManifest(fname string) *aotManifest {
+	m := &aotManifest{}
+	if content, err := os.ReadFile(fname); err == nil {
+		json.Unmarshal(content, m)
+	}
+	if m.Contracts == nil {
+		m.Contracts = make(map[string]manifestContract)
+	}
+	for addr, c := range m.Contracts {
+		if norm, err := ParseAddress(addr); err != nil || norm != addr || c.File != contractFileName(addr) {
+			delete(m.Contracts, addr)
+		}
+	}
+	return m
+}
+
+func (m *aotManifest) write(fname string) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = os.WriteFile(fname, content, 0644)
+	}
+	if err != nil {
+		return &CompileError{File: fname, Offset: -1, Err: err}
+	}
+	return nil
+}
+
+// remove the files generated for a contract which is no longer in the input directory
+func removeContractFiles(outDir, addr string) error {
+	obj := addr + ".o" // written by Build
+	for _, fname := range []string{contractFileName(addr), obj} {
+		fname = path.Join(outDir, fname)
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return &CompileError{File: fname, Offset: -1, Err: err}
+		}
+	}
+	return nil
+}
+
+func codeHashHex(hash [32]byte) string {
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,57 @@
+package maot
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifestRemovesOnlyOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	outDir := path.Join(dir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(fname string) {
+		if err := os.WriteFile(fname, []byte("// keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const kept = "00000000000000000000000000000000000000aa"
+	const removed = "00000000000000000000000000000000000000bb"
+	victim, victim2 := path.Join(dir, "victim.cpp"), path.Join(dir, "victim2.cpp")
+	write(victim)
+	write(victim2)
+	write(path.Join(outDir, contractFileName(removed)))
+	// an edited manifest which points outside outDir
+	m := &aotManifest{Contracts: map[string]manifestContract{
+		"../victim": {File: "../victim.cpp"},
+		kept:        {File: "../victim2.cpp"},
+		removed:     {File: contractFileName(removed)},
+	}}
+	content, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(outDir, aotManifestFile), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in := ContractInput{Addr: kept, Code: []byte{OP_PUSH1, 1, OP_STOP}, Source: "test"}
+	report, err := AotCompileContracts([]int{EVMC_LONDON}, []ContractInput{in}, outDir, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{victim, victim2, path.Join(outDir, contractFileName(kept))} {
+		if !fileExists(fname) {
+			t.Errorf("%s is removed", fname)
+		}
+	}
+	if fileExists(path.Join(outDir, contractFileName(removed))) {
+		t.Errorf("the file of %s is not removed", removed)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != removed {
+		t.Errorf("Removed=%v, want [%s]", report.Removed, removed)
+	}
+}
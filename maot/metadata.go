@@ -0,0 +1,85 @@
+package maot
+
+import (
+	"encoding/binary"
+)
+
+// Solidity and Vyper append CBOR-encoded metadata and its length (as a big-endian uint16) to the
+// runtime bytecode. MetadataSize returns the size of this trailer including the length suffix,
+// or 0 if the bytecode has no such trailer.
+func MetadataSize(code []byte) int {
+	if len(code) < 2 {
+		return 0
+	}
+	n := int(binary.BigEndian.Uint16(code[len(code)-2:]))
+	if isCborTrailer(code[:len(code)-2], n) {
+		return n + 2
+	}
+	if n >= 2 && isCborTrailer(code[:len(code)-2], n-2) { // some Vyper versions count the suffix in the length
+		return n
+	}
+	return 0
+}
+
+// does "code" end with a CBOR map or array whose encoded size is n?
+func isCborTrailer(code []byte, n int) bool {
+	if n == 0 || n > len(code) {
+		return false
+	}
+	item := code[len(code)-n:]
+	if major := item[0] >> 5; major != 4 && major != 5 { // Solidity uses a map, Vyper an array
+		return false
+	}
+	return cborItemSize(item, 0) == n
+}
+
+// returns the encoded size of the CBOR data item at the beginning of bz, or -1 if it is malformed
+func cborItemSize(bz []byte, depth int) int {
+	if len(bz) == 0 || depth > 16 {
+		return -1
+	}
+	major, info := bz[0]>>5, bz[0]&0x1f
+	pos := 1
+	arg := uint64(info)
+	if info >= 24 {
+		if info > 27 { // indefinite lengths are never used by compilers
+			return -1
+		}
+		n := 1 << (info - 24)
+		if len(bz) < 1+n {
+			return -1
+		}
+		arg = 0
+		for _, b := range bz[1 : 1+n] {
+			arg = arg<<8 | uint64(b)
+		}
+		pos += n
+	}
+	switch major {
+	case 0, 1, 7: // integers, simple values and floats
+		return pos
+	case 2, 3: // byte strings and text strings
+		if arg > uint64(len(bz)-pos) {
+			return -1
+		}
+		return pos + int(arg)
+	case 6: // tagged item
+		size := cborItemSize(bz[pos:], depth+1)
+		if size < 0 {
+			return -1
+		}
+		return pos + size
+	}
+	count := arg // an array has "arg" items and a map has "arg" pairs
+	if major == 5 {
+		count *= 2
+	}
+	for i := uint64(0); i < count; i++ {
+		size := cborItemSize(bz[pos:], depth+1)
+		if size < 0 {
+			return -1
+		}
+		pos += size
+	}
+	return pos
+}
@@ -0,0 +1,109 @@
+package maot
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// {"ipfs": <34 bytes>, "solc": <3 bytes>} as appended by solc 0.8, whose hash contains a 0x5b byte
+func solcTrailer() []byte {
+	var b bytes.Buffer
+	b.WriteByte(0xa2)
+	b.WriteString("\x64ipfs\x58\x22")
+	hash := bytes.Repeat([]byte{0x12}, 34)
+	hash[5], hash[6] = OP_JUMPDEST, OP_STOP
+	b.Write(hash)
+	b.WriteString("\x64solc\x43\x00\x08\x0d")
+	b.Write([]byte{0x00, byte(b.Len())}) // 51 bytes, without the suffix
+	return b.Bytes()
+}
+
+// {"vyper": [0, 3, 10]}, whose length counts the 2-byte suffix as some Vyper versions do
+func vyperTrailer() []byte {
+	item := []byte("\xa1\x65vyper\x83\x00\x03\x0a")
+	return append(item, 0x00, byte(len(item)+2))
+}
+
+// [<32 bytes>, 5, [], {"vyper": [0, 4, 0]}] as appended by Vyper 0.4, without the suffix in the length
+func vyperArrayTrailer() []byte {
+	var b bytes.Buffer
+	b.WriteString("\x84\x58\x20")
+	b.Write(bytes.Repeat([]byte{OP_JUMPDEST}, 32))
+	b.WriteString("\x05\x80\xa1\x65vyper\x83\x00\x04\x00")
+	b.Write([]byte{0x00, byte(b.Len())})
+	return b.Bytes()
+}
+
+// PUSH1 1 PUSH1 0 SSTORE STOP INVALID
+var runtimeCode = []byte{OP_PUSH1, 1, OP_PUSH1, 0, OP_SSTORE, OP_STOP, OP_INVALID}
+
+func TestMetadataSize(t *testing.T) {
+	cases := []struct {
+		name    string
+		trailer []byte
+	}{
+		{"solc", solcTrailer()},
+		{"vyper", vyperTrailer()},
+		{"vyper-array", vyperArrayTrailer()},
+	}
+	for _, c := range cases {
+		code := append(append([]byte(nil), runtimeCode...), c.trailer...)
+		if got := MetadataSize(code); got != len(c.trailer) {
+			t.Errorf("%s: MetadataSize=%d, want %d", c.name, got, len(c.trailer))
+		}
+	}
+	for _, code := range [][]byte{nil, {0x00}, runtimeCode, append(append([]byte(nil), runtimeCode...), 0x00, 0x10)} {
+		if got := MetadataSize(code); got != 0 {
+			t.Errorf("MetadataSize(%x)=%d, want 0", code, got)
+		}
+	}
+}
+
+func TestAnalyzeMetadata(t *testing.T) {
+	cases := []struct {
+		name      string
+		trailer   []byte
+		jumpdests []int // the offsets of the JUMPDESTs in trailer
+	}{
+		// "ipfs" and "solc" are the data of PUSH5, and the 0x5b in the hash is a JUMPDEST
+		{"solc", solcTrailer(), []int{8 + 5}},
+		// the JUMPDESTs fill the byte string, and "vyper\x83" is the data of PUSH6
+		{"vyper-array", vyperArrayTrailer(), func() (pcs []int) {
+			for i := 0; i < 32; i++ {
+				pcs = append(pcs, 3+i)
+			}
+			return
+		}()},
+	}
+	for _, c := range cases {
+		code := append(append([]byte(nil), runtimeCode...), c.trailer...)
+		analysis := Analyze(EVMC_LONDON, code, DefaultOptions())
+		if analysis.Metadata.Start != len(runtimeCode) || analysis.Metadata.End != len(code) {
+			t.Fatalf("%s: Metadata=%+v, want [%d,%d)", c.name, analysis.Metadata, len(runtimeCode), len(code))
+		}
+		// a jump to a 0x5b byte in the metadata is valid in evmone, so it must stay a JUMPDEST
+		var want []int
+		for _, off := range c.jumpdests {
+			want = append(want, len(runtimeCode)+off)
+		}
+		if fmt.Sprint(analysis.JumpdestTargets) != fmt.Sprint(want) {
+			t.Errorf("%s: JUMPDESTs %v, want %v", c.name, analysis.JumpdestTargets, want)
+		}
+		// but the bytes before the first of them are data
+		for _, instr := range analysis.InstrList[:len(analysis.InstrList)-1] { // but the STOP appended at the end
+			if instr.PC >= analysis.Metadata.Start && instr.PC < want[0] {
+				t.Errorf("%s: instruction %d at pc %d in the metadata", c.name, instr.OpCode, instr.PC)
+			}
+		}
+	}
+}
+
+func TestAnalyzeFallsIntoMetadata(t *testing.T) {
+	// without the terminator, the execution really runs the metadata as code
+	code := append([]byte{OP_PUSH1, 1, OP_POP}, solcTrailer()...)
+	analysis := Analyze(EVMC_LONDON, code, DefaultOptions())
+	if len(analysis.JumpdestTargets) == 0 {
+		t.Errorf("the JUMPDEST in the metadata is not found")
+	}
+}
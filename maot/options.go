@@ -0,0 +1,64 @@
+package maot
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EmitMode selects which kind of instrumentation is emitted into the generated C++ code
+type EmitMode int
+
+const (
+	EmitRelease   EmitMode = iota // no instrumentation at all
+	EmitTrace                     // one EIP-3155-style JSON line per instruction, sent to the trace sink
+	EmitStackDump                 // print PC, opcode, gas and the whole stack before each instruction
+)
+
+var emitModeNames = []string{"release", "trace", "stackdump"}
+
+func (m EmitMode) String() string {
+	if int(m) < 0 || int(m) >= len(emitModeNames) {
+		return fmt.Sprintf("EmitMode(%d)", int(m))
+	}
+	return emitModeNames[m]
+}
+
+// ParseEmitMode converts a mode name such as "release" to an EmitMode
+func ParseEmitMode(s string) (EmitMode, error) {
+	for i, name := range emitModeNames {
+		if strings.EqualFold(s, name) {
+			return EmitMode(i), nil
+		}
+	}
+	return EmitRelease, fmt.Errorf("unknown emit mode %q (want one of %s)", s, strings.Join(emitModeNames, ", "))
+}
+
+// Options controls how bytecodes are analyzed and how C++ code is generated from them
+type Options struct {
+	Mode EmitMode
+	// the C++ namespace of the generated symbols, "maot" or "maot_<LibID>" if empty
+	Namespace string
+	// if not empty, the exported entry points are suffixed with it, such as query_executor_<LibID>,
+	// so that several libraries can be linked into one process
+	LibID string
+	// replace the common sequences of instructions with super-instructions, see FusionPatterns
+	Fusion bool
+	// keep the values of the pure stack instructions in C++ locals inside basic blocks
+	StackCache bool
+	// skip the stack checks of the basic blocks whose stack heights are proven at compile time
+	StackHeights bool
+	// merge the basic blocks which are only entered by falling through into super-blocks
+	MergeBlocks bool
+	// only jump to the JUMPDESTs whose PCs are pushed by some PUSH through the JUMPTABLE, which holds
+	// for the code generated by Solidity but not for all the valid bytecode, see markReachable
+	SolcAssumptions bool
+	// how the JUMPTABLE is implemented, and the exceptions for some contracts, by the names passed to
+	// DumpExecutors (the addresses in lowercase hex for AotCompile)
+	JumpTable          JumpTableKind
+	ContractJumpTables map[string]JumpTableKind
+}
+
+// DefaultOptions returns the options for a production build
+func DefaultOptions() Options {
+	return Options{Mode: EmitRelease, Fusion: true, StackCache: true, StackHeights: true, MergeBlocks: true}
+}
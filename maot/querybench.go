@@ -0,0 +1,148 @@
+package maot
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+)
+
+// DumpQueryBenchmark writes a C++ benchmark to dir, which compares the lookup latency of the
+// generated query_executor against the lazily-filled std::unordered_map used before, for n contracts.
+// The executors are stubs, so it only needs evmc's headers. Run bench.sh in dir to build and run it.
+func DumpQueryBenchmark(n int, dir string) error {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	addrList := make([]string, n)
+	codeHashes := make(map[string][32]byte, n)
+	var keys []byte // the addresses followed by the code hashes
+	for i := range addrList {
+		var addr [20]byte
+		var hash [32]byte
+		rnd.Read(addr[:])
+		rnd.Read(hash[:])
+		addrList[i] = hex.EncodeToString(addr[:])
+		codeHashes[addrList[i]] = hash
+		keys = append(keys, addr[:]...)
+	}
+	for _, addr := range addrList {
+		hash := codeHashes[addr]
+		keys = append(keys, hash[:]...)
+	}
+
+	querySrc, err := getQueryExecutorSrc(libraryDesc{AddrList: addrList, CodeHashes: codeHashes, Opts: DefaultOptions()})
+	if err != nil {
+		return err
+	}
+	files := map[string]string{
+		"query_executor.cpp": querySrc,
+		evmaotInfoHeader:     evmaotInfoHeaderSrc,
+		"executors.cpp":      getStubExecutorsSrc(addrList, DefaultOptions().symbols()),
+		"bench.cpp":          getQueryBenchmarkSrc(n, keys, rnd),
+		"bench.sh": `#!/bin/bash
+g++ -O3 -std=c++17 -I $MOEINGEVM/evmwrap/evmc/include/ -o query_bench bench.cpp query_executor.cpp executors.cpp && ./query_bench
+`,
+	}
+	for name, src := range files {
+		fname := path.Join(dir, name)
+		if err := os.WriteFile(fname, []byte(src), 0644); err != nil {
+			return &CompileError{File: fname, Offset: -1, Err: err}
+		}
+	}
+	return nil
+}
+
+// an execute_<addr> for each address, which does nothing
+func getStubExecutorsSrc(addrList []string, syms symbolNames) string {
+	lines := []string{`#include "evmc/evmc.h"
+`, syms.open()}
+	for _, addr := range addrList {
+		lines = append(lines, fmt.Sprintf(`evmc_result %s(evmc_vm*, const evmc_host_interface*, evmc_host_context*,
+    evmc_revision, const evmc_message*, const uint8_t*, size_t) noexcept { return evmc_result{}; }`, syms.executor(addr)))
+	}
+	lines = append(lines, syms.close())
+	return strings.Join(lines, "\n")
+}
+
+// the benchmark's main function, which looks up the n compiled addresses and as many unknown addresses
+func getQueryBenchmarkSrc(n int, keys []byte, rnd *rand.Rand) string {
+	lines := []string{`#include <chrono>
+#include <cstdio>
+#include <string>
+#include <unordered_map>
+#include "evmc/evmc.h"
+
+extern "C" evmc_execute_fn query_executor(const evmc_address* destination);
+extern "C" evmc_execute_fn query_executor_by_codehash(const evmc_bytes32* code_hash);
+
+// the implementation used before, which is filled on the first call
+static evmc_execute_fn query_executor_hashmap(const evmc_address* destination);
+
+static const evmc_address compiled[] = {`}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("\t{%s},", bytesInitializer(keys[i*20:i*20+20])))
+	}
+	lines = append(lines, "};\n\nstatic const evmc_bytes32 code_hashes[] = {")
+	for i := 0; i < n; i++ {
+		start := n*20 + i*32
+		lines = append(lines, fmt.Sprintf("\t{%s},", bytesInitializer(keys[start:start+32])))
+	}
+	lines = append(lines, "};\n\nstatic const evmc_address unknown[] = {")
+	for i := 0; i < n; i++ {
+		var addr [20]byte
+		rnd.Read(addr[:])
+		lines = append(lines, fmt.Sprintf("\t{%s},", bytesInitializer(addr[:])))
+	}
+	lines = append(lines, fmt.Sprintf(`};
+
+static constexpr size_t count = %d;
+static constexpr int rounds = 100;
+
+static evmc_execute_fn query_executor_hashmap(const evmc_address* destination) {
+	static std::unordered_map<std::string, evmc_execute_fn> m;
+	if(m.size() == 0) {
+		m.reserve(count);
+		for(size_t i = 0; i < count; i++) {
+			m.emplace(std::string((const char*)(compiled[i].bytes), 20), query_executor(&compiled[i]));
+		}
+	}
+	std::string key((const char*)(destination->bytes), 20);
+	auto got = m.find(key);
+	if(got == m.end()) return nullptr;
+	return got->second;
+}
+
+// returns the average latency in nanoseconds
+static double bench(const char* name, evmc_execute_fn (*query)(const evmc_address*)) {
+	size_t found = 0;
+	query(&compiled[0]); // warm up
+	auto start = std::chrono::steady_clock::now();
+	for(int r = 0; r < rounds; r++) {
+		for(size_t i = 0; i < count; i++) {
+			found += query(&compiled[i]) != nullptr;
+			found += query(&unknown[i]) != nullptr;
+		}
+	}
+	auto end = std::chrono::steady_clock::now();
+	double ns = std::chrono::duration<double, std::nano>(end - start).count() / (2.0 * rounds * count);
+	std::printf("%%-16s %%8.1f ns/lookup, %%zu found\n", name, ns, found / rounds);
+	return ns;
+}
+
+int main() {
+	for(size_t i = 0; i < count; i++) {
+		evmc_execute_fn fn = query_executor(&compiled[i]);
+		if(fn == nullptr || query_executor(&unknown[i]) != nullptr || query_executor_by_codehash(&code_hashes[i]) != fn) {
+			std::printf("wrong result for the %%zu-th address\n", i);
+			return 1;
+		}
+	}
+	std::printf("%%zu contracts, half of the lookups miss\n", count);
+	bench("perfect-hash", query_executor);
+	bench("unordered_map", query_executor_hashmap);
+	return 0;
+}
+`, n))
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,134 @@
+package maot
+
+import (
+	"fmt"
+)
+
+// Analyze skips the bytes after a terminator up to the next JUMPDEST, but InstrList may still contain
+// blocks which no execution can enter, such as the JUMPDESTs of a contract without any dynamic jump
+// which are never the targets of the fused jumps. markReachable walks the basic blocks from PC 0
+// through the fall-throughs, the fused jumps, the targets found by resolveJumps, and from each JUMP/JUMPI
+// using the JUMPTABLE, every JUMPDEST the JUMPTABLE may jump to. No code is emitted for the others.
+//
+// Options.SolcAssumptions narrows the JUMPTABLE down to the JUMPDESTs whose PCs are pushed by some
+// PUSH instruction. Solidity always pushes the jump targets and return addresses as constants, but
+// in general the EVM allows computing them, so a jump to any other JUMPDEST fails with
+// EVMC_BAD_JUMP_DESTINATION under this assumption.
+
+// the value pushed by a PUSH instruction if it may be a PC, or else -1
+func pushedPC(instr *Instruction) int {
+	op := instr.OpCode
+	if op == NOP {
+		op = instr.Number // the PUSH fused into the following JUMP/JUMPI
+	}
+	switch {
+	case op == OP_PUSH0:
+		return 0
+	case OP_PUSH1 <= op && op <= OP_PUSH8:
+		if instr.SmallPushValue <= uint64(^uint32(0)) {
+			return int(instr.SmallPushValue)
+		}
+	case OP_PUSH9 <= op && op <= OP_PUSH32:
+		w := instr.PushWords
+		if w[0] == 0 && w[1] == 0 && w[2] == 0 && w[3] <= uint64(^uint32(0)) {
+			return int(w[3])
+		}
+	}
+	return -1
+}
+
+// the JUMPDESTs whose PCs are pushed by some PUSH instruction
+func (analysis AdvancedCodeAnalysis) pushedTargets() map[int]struct{} {
+	pushed := make(map[int]struct{})
+	for _, instr := range analysis.InstrList {
+		pc := pushedPC(instr)
+		if _, ok := analysis.TargetsSet[pc]; ok {
+			pushed[pc] = struct{}{}
+		}
+	}
+	return pushed
+}
+
+// the JUMPDESTs which the JUMPTABLE jumps to if any JUMP/JUMPI uses it
+func (analysis AdvancedCodeAnalysis) jumpTableCandidates() map[int]struct{} {
+	if analysis.Options.SolcAssumptions {
+		return analysis.pushedTargets()
+	}
+	return analysis.TargetsSet
+}
+
+// Mark the basic blocks which can not be reached from PC 0 as dead
+func (analysis AdvancedCodeAnalysis) markReachable() {
+	spans := analysis.blockSpans()
+	blockOfPC := make(map[int]int, len(spans))
+	for i, span := range spans {
+		blockOfPC[analysis.blockPC(span)] = i
+	}
+	reached := make([]bool, len(spans))
+	var stack []int
+	visit := func(i int) {
+		if !reached[i] {
+			reached[i] = true
+			stack = append(stack, i)
+		}
+	}
+	jump := func(target int) {
+		if _, ok := analysis.TargetsSet[target]; ok {
+			visit(blockOfPC[target])
+		}
+	}
+	candidates := analysis.jumpTableCandidates()
+	jumpTableUsed := false
+	visit(0)
+	for len(stack) != 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		last := analysis.InstrList[spans[i].End-1]
+		if last.OpCode == OP_JUMP || last.OpCode == OP_JUMPI {
+			if last.Number != 0 {
+				jump(last.Number)
+			} else {
+				for _, target := range last.Targets {
+					jump(target)
+				}
+				if !jumpTableUsed {
+					jumpTableUsed = true
+					for pc := range candidates {
+						jump(pc)
+					}
+				}
+			}
+		}
+		if i+1 < len(spans) && analysis.fallsThrough(last) {
+			visit(i + 1)
+		}
+	}
+	for i, span := range spans {
+		analysis.InstrList[span.Begin].Block.Dead = !reached[i]
+	}
+}
+
+// How many basic blocks and instructions are omitted from the generated code
+type ReachStats struct {
+	Blocks      int `json:"blocks"`
+	DeadBlocks  int `json:"dead_blocks"`
+	DeadInstrs  int `json:"dead_instrs"`  // the instructions in the dead blocks, not counting OPX_BEGINBLOCK
+	JumpTargets int `json:"jump_targets"` // the JUMPDESTs which the JUMPTABLE jumps to
+}
+
+func (s ReachStats) String() string {
+	return fmt.Sprintf("%d of %d blocks unreachable (%d instructions), %d targets in the JUMPTABLE",
+		s.DeadBlocks, s.Blocks, s.DeadInstrs, s.JumpTargets)
+}
+
+func (analysis AdvancedCodeAnalysis) ReachStats() (stats ReachStats) {
+	for _, span := range analysis.blockSpans() {
+		stats.Blocks++
+		if analysis.InstrList[span.Begin].Block.Dead {
+			stats.DeadBlocks++
+			stats.DeadInstrs += span.End - span.Begin - 1
+		}
+	}
+	stats.JumpTargets = len(analysis.JumpTableTargets())
+	return
+}
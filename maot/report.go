@@ -0,0 +1,64 @@
+package maot
+
+import (
+	"fmt"
+	"io"
+)
+
+// Statistics about one compiled contract
+type ContractReport struct {
+	Addr        string
+	Jumps       JumpStats   // of the latest compiled revision
+	Fusion      FusionStats // of the latest compiled revision
+	Regenerated bool        // false if the generated file is up to date
+}
+
+// Statistics about all the contracts compiled by AotCompile
+type CompileReport struct {
+	Contracts []ContractReport
+	Removed   []string // the contracts whose generated files are deleted
+	Rejected  []RejectedInput
+}
+
+// An input which is not compiled
+type RejectedInput struct {
+	Name   string
+	Source string
+	Reason string
+}
+
+func newContractReport(addr string, analyses []AdvancedCodeAnalysis) ContractReport {
+	latest := analyses[len(analyses)-1]
+	return ContractReport{
+		Addr:   addr,
+		Jumps:  latest.JumpStats(),
+		Fusion: latest.FusionStats(),
+	}
+}
+
+// Print one line for each contract, and a summary line
+func (r *CompileReport) Print(w io.Writer) {
+	var total JumpStats
+	var totalFusion FusionStats
+	regenerated := 0
+	for _, c := range r.Contracts {
+		status := "up to date"
+		if c.Regenerated {
+			status = "generated"
+			regenerated++
+		}
+		fmt.Fprintf(w, "%s %s, jumps: %s, fusion: %s\n", c.Addr, status, c.Jumps, c.Fusion)
+		totalFusion.Add(c.Fusion)
+		total.Fused += c.Jumps.Fused
+		total.Resolved += c.Jumps.Resolved
+		total.Unresolved += c.Jumps.Unresolved
+	}
+	for _, addr := range r.Removed {
+		fmt.Fprintf(w, "%s removed\n", addr)
+	}
+	for _, in := range r.Rejected {
+		fmt.Fprintf(w, "%s rejected: %s\n", in.Source, in.Reason)
+	}
+	fmt.Fprintf(w, "total %d contracts (%d generated, %d removed, %d rejected), jumps: %s, fusion: %s\n",
+		len(r.Contracts), regenerated, len(r.Removed), len(r.Rejected), total, totalFusion)
+}
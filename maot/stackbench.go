@@ -0,0 +1,155 @@
+package maot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// the address which the contract of DumpStackCacheBenchmark is compiled for
+const benchContractAddr = "00000000000000000000000000000000000000c0"
+
+// DumpStackCacheBenchmark writes a C++ benchmark to dir, which compares the executors generated from
+// code for rev with and without Options.StackCache, calling them with each of inputs. The two
+// executors are generated into dir/plain and dir/cached, and linked into two programs. They need the
+// headers at $MOEINGEVM and evmone's instructions, which bench.sh links with $EVMAOT_LDFLAGS. The
+// host has empty storage and forgets the writes, so each call costs the same.
+func DumpStackCacheBenchmark(rev int, code []byte, inputs [][]byte, dir string) error {
+	if len(inputs) == 0 {
+		inputs = [][]byte{nil}
+	}
+	for _, cached := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.StackCache = cached
+		subDir := path.Join(dir, stackBenchVariant(cached))
+		if err := os.MkdirAll(subDir, 0755); err != nil {
+			return &CompileError{File: subDir, Offset: -1, Err: err}
+		}
+		in := ContractInput{Addr: benchContractAddr, Code: code, Source: "stackbench"}
+		if _, err := AotCompileContracts([]int{rev}, []ContractInput{in}, subDir, opts); err != nil {
+			return err
+		}
+	}
+	var includes []string
+	for _, inc := range MoeingevmIncludeDirs("$MOEINGEVM") {
+		includes = append(includes, "-I "+inc)
+	}
+	files := map[string]string{
+		"bench.cpp": getStackBenchmarkSrc(rev, code, inputs),
+		"bench.sh": fmt.Sprintf(`#!/bin/bash
+# EVMAOT_LDFLAGS links evmone's instructions, such as "-L/path/to/evmone/lib -levmone"
+set -e
+for v in plain cached; do
+	g++ -O3 -std=c++17 %s -o bench_$v bench.cpp $v/*.cpp $EVMAOT_LDFLAGS
+done
+./bench_plain plain && ./bench_cached cached
+`, strings.Join(includes, " ")),
+	}
+	for name, src := range files {
+		fname := path.Join(dir, name)
+		if err := os.WriteFile(fname, []byte(src), 0644); err != nil {
+			return &CompileError{File: fname, Offset: -1, Err: err}
+		}
+	}
+	return nil
+}
+
+func stackBenchVariant(cached bool) string {
+	if cached {
+		return "cached"
+	}
+	return "plain"
+}
+
+// bytes as the elements of a C array
+func cArrayElements(b []byte) string {
+	elems := make([]string, len(b))
+	for i, x := range b {
+		elems[i] = fmt.Sprintf("0x%02x", x)
+	}
+	return strings.Join(elems, ",")
+}
+
+// the benchmark's main function, which times the calls to the executor with each input
+func getStackBenchmarkSrc(rev int, code []byte, inputs [][]byte) string {
+	var buf bytes.Buffer
+	wr(&buf, `#include <chrono>
+#include <cstdio>
+#include "evmc/evmc.h"
+
+extern "C" evmc_execute_fn query_executor(const evmc_address* destination);
+
+static const uint8_t code[] = {%s};
+static constexpr int64_t gas_limit = 10000000;
+static constexpr int calls = 10000;
+
+struct input {
+	const uint8_t* data;
+	size_t size;
+};
+`, cArrayElements(code))
+	var names []string
+	for i, in := range inputs {
+		// a zero-length array is not allowed, so the empty input has one byte which is not passed
+		wr(&buf, "static const uint8_t input%d[] = {%s};\n", i, cArrayElements(append(append([]byte(nil), in...), 0)))
+		names = append(names, fmt.Sprintf("{input%d, %d}", i, len(in)))
+	}
+	wr(&buf, "static const input inputs[] = {%s};\n", strings.Join(names, ", "))
+	wr(&buf, `
+// a world with empty accounts and storage, in which nothing is written
+static const evmc_host_interface host = {
+	[](evmc_host_context*, const evmc_address*) { return false; },
+	[](evmc_host_context*, const evmc_address*, const evmc_bytes32*) { return evmc_bytes32{}; },
+	[](evmc_host_context*, const evmc_address*, const evmc_bytes32*, const evmc_bytes32*) { return EVMC_STORAGE_ADDED; },
+	[](evmc_host_context*, const evmc_address*) { return evmc_uint256be{}; },
+	[](evmc_host_context*, const evmc_address*) { return size_t(0); },
+	[](evmc_host_context*, const evmc_address*) { return evmc_bytes32{}; },
+	[](evmc_host_context*, const evmc_address*, size_t, uint8_t*, size_t) { return size_t(0); },
+	[](evmc_host_context*, const evmc_address*, const evmc_address*) { return true; },
+	[](evmc_host_context*, const evmc_message*) { evmc_result res{}; res.status_code = EVMC_FAILURE; return res; },
+	[](evmc_host_context*) { return evmc_tx_context{}; },
+	[](evmc_host_context*, int64_t) { return evmc_bytes32{}; },
+	[](evmc_host_context*, const evmc_address*, const uint8_t*, size_t, const evmc_bytes32[], size_t) {},
+	[](evmc_host_context*, const evmc_address*) { return EVMC_ACCESS_COLD; },
+	[](evmc_host_context*, const evmc_address*, const evmc_bytes32*) { return EVMC_ACCESS_COLD; },
+	[](evmc_host_context*, const evmc_address*, const evmc_bytes32*) { return evmc_bytes32{}; },
+	[](evmc_host_context*, const evmc_address*, const evmc_bytes32*, const evmc_bytes32*) {},
+};
+
+static evmc_result call(evmc_execute_fn fn, const evmc_message& msg) {
+	return fn(nullptr, &host, nullptr, evmc_revision(%d), &msg, code, sizeof(code));
+}
+
+int main(int argc, char** argv) {
+	evmc_address addr{};
+	addr.bytes[19] = 0xc0;
+	evmc_execute_fn fn = query_executor(&addr);
+	if(fn == nullptr) { std::printf("no executor\n"); return 1; }
+	for(size_t i = 0; i < sizeof(inputs) / sizeof(inputs[0]); i++) {
+		evmc_message msg{};
+		msg.kind = EVMC_CALL;
+		msg.gas = gas_limit;
+		msg.recipient = msg.code_address = addr;
+		msg.input_data = inputs[i].data;
+		msg.input_size = inputs[i].size;
+		evmc_result res = call(fn, msg); // warm up, and the result to print
+		uint64_t checksum = 0;
+		for(size_t j = 0; j < res.output_size; j++) checksum = checksum * 31 + res.output_data[j];
+		std::printf("%%-8s input #%%zu: status %%d, %%lld gas, output %%llx, ", argc > 1 ? argv[1] : "",
+			i, res.status_code, (long long)(gas_limit - res.gas_left), (unsigned long long)(checksum));
+		if(res.release) res.release(&res);
+		auto start = std::chrono::steady_clock::now();
+		for(int r = 0; r < calls; r++) {
+			res = call(fn, msg);
+			if(res.release) res.release(&res);
+		}
+		auto end = std::chrono::steady_clock::now();
+		std::printf("%%.1f ns/call\n", std::chrono::duration<double, std::nano>(end - start).count() / calls);
+	}
+	return 0;
+}
+`, rev)
+	return buf.String()
+}
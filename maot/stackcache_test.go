@@ -0,0 +1,130 @@
+package maot
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The stack cache keeps the values in locals and remaps DUP/SWAP, and spills the locals before a host
+// operation (SSTORE, CALL), an instruction which needs state->stack (CALLDATALOAD, a SWAP reaching
+// below the locals), a jump and a label.
+const stackCacheGolden = `L00000:
+// pc=-1 op=91 (BEGINBLOCK)
+instr=instr_from_block(174, 0, 10);
+if(next_instr!=maotBEGINBLOCK(&instr, *state)) goto ENDING;
+// pc=0 op=96 (PUSH1)
+{
+const intx::uint256 s0 = 2ull;
+// pc=2 op=96 (PUSH1)
+const intx::uint256 s1 = 3ull;
+// pc=4 op=129 (DUP2)
+// pc=5 op=144 (SWAP1)
+// pc=6 op=3 (SUB)
+const intx::uint256 s2 = s1 - s0;
+// pc=7 op=1 (ADD)
+const intx::uint256 s3 = s2 + s0;
+// pc=8 op=96 (PUSH1)
+const intx::uint256 s4 = 0ull;
+state->stack.push(s3);
+state->stack.push(s4);
+}
+// pc=10 op=85 (SSTORE)
+instr=instr_from_num(21);
+if(next_instr!=maotSSTORE(&instr, *state)) goto ENDING;
+// pc=11 op=96 (PUSH1)
+{
+const intx::uint256 s5 = 0ull;
+state->stack.push(s5);
+}
+// pc=13 op=53 (CALLDATALOAD)
+maotCALLDATALOAD(&instr, *state);
+// pc=14 op=96 (PUSH1)
+{
+const intx::uint256 s6 = 1ull;
+// pc=16 op=129 (DUP2)
+const intx::uint256 s7 = state->stack[0];
+state->stack.push(s6);
+state->stack.push(s7);
+}
+// pc=17 op=145 (SWAP2)
+maotSWAP2(&instr, *state);
+// pc=18 op=96 (PUSH1)
+{
+const intx::uint256 s8 = 0ull;
+// pc=20 op=96 (PUSH1)
+const intx::uint256 s9 = 0ull;
+// pc=22 op=96 (PUSH1)
+const intx::uint256 s10 = 0ull;
+// pc=24 op=96 (PUSH1)
+const intx::uint256 s11 = 0ull;
+// pc=26 op=96 (PUSH1)
+const intx::uint256 s12 = 0ull;
+state->stack.push(s8);
+state->stack.push(s9);
+state->stack.push(s10);
+state->stack.push(s11);
+state->stack.push(s12);
+}
+// pc=28 op=48 (ADDRESS)
+maotADDRESS(&instr, *state);
+// pc=29 op=97 (PUSH2)
+{
+const intx::uint256 s13 = 65535ull;
+state->stack.push(s13);
+}
+// pc=32 op=241 (CALL)
+instr=instr_from_num(156);
+if(next_instr!=maotCALL(&instr, *state)) goto ENDING;
+// pc=33 op=80 (POP)
+maotPOP(&instr, *state);
+// pc=34 op=96 (PUSH1)
+{
+const intx::uint256 s14 = 1ull;
+// pc=36 NOP
+state->stack.push(s14);
+}
+// pc=38 op=87 (JUMPI)
+if(test_jump_cond(*state)) {
+  goto L00041;
+}
+L00039:
+// pc=39 op=91 (BEGINBLOCK)
+instr=instr_from_block(3, 0, 1);
+if(next_instr!=maotBEGINBLOCK(&instr, *state)) goto ENDING;
+// pc=39 op=96 (PUSH1)
+{
+const intx::uint256 s15 = 9ull;
+state->stack.push(s15);
+}
+L00041:
+// pc=41 op=91 (BEGINBLOCK)
+instr=instr_from_block(3, 1, 0);
+if(next_instr!=maotBEGINBLOCK(&instr, *state)) goto ENDING;
+// pc=42 op=80 (POP)
+maotPOP(&instr, *state);
+// pc=43 op=0 (STOP)
+if(next_instr!=maotSTOP(&instr, *state)) goto ENDING;
+// pc=44 op=0 (STOP)
+if(next_instr!=maotSTOP(&instr, *state)) goto ENDING;
+`
+
+func TestStackCacheEmission(t *testing.T) {
+	code := []byte{
+		OP_PUSH1, 2, OP_PUSH1, 3, OP_DUP2, OP_SWAP1, OP_SUB, OP_ADD, OP_PUSH1, 0, OP_SSTORE,
+		OP_PUSH1, 0, OP_CALLDATALOAD, OP_PUSH1, 1, OP_DUP2, OP_SWAP2,
+		OP_PUSH1, 0, OP_PUSH1, 0, OP_PUSH1, 0, OP_PUSH1, 0, OP_PUSH1, 0, OP_ADDRESS, OP_PUSH2, 0xff, 0xff, OP_CALL,
+		OP_POP, OP_PUSH1, 1, OP_PUSH1, 41, OP_JUMPI, OP_PUSH1, 9, OP_JUMPDEST, OP_POP, OP_STOP,
+	}
+	analysis := Analyze(EVMC_LONDON, code, Options{Mode: EmitRelease, StackCache: true})
+	var buf bytes.Buffer
+	var stats StackCacheStats
+	if err := analysis.dumpAllInstr(&buf, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != stackCacheGolden {
+		t.Errorf("emitted:\n%s\nwant:\n%s", got, stackCacheGolden)
+	}
+	if want := (StackCacheStats{Instrs: 18, Spills: 7, Pushes: 13}); stats != want {
+		t.Errorf("stats %v, want %v", stats, want)
+	}
+}
@@ -0,0 +1,158 @@
+package maot
+
+import (
+	"fmt"
+)
+
+// The prologue of a basic block checks the gas, StackReq and StackMaxGrowth at run time. The inference
+// tracks the range of the stack height at the entry of each block, from PC 0 through the fall-throughs
+// and the fused jumps. A block entered through the JUMPTABLE may see any height, but after its prologue
+// the height is known to satisfy its checks, which often proves the checks of the following blocks.
+// The blocks whose ranges satisfy their own checks only need a gas-only prologue.
+
+const stackLimit = 1024 // evmone's Stack::limit
+
+// a range of stack heights, [Lo, Hi]
+type heightRange struct {
+	Lo int
+	Hi int
+}
+
+func (r heightRange) empty() bool {
+	return r.Lo > r.Hi
+}
+
+// the smallest range containing both
+func (r heightRange) union(other heightRange) heightRange {
+	return heightRange{Lo: min(r.Lo, other.Lo), Hi: max(r.Hi, other.Hi)}
+}
+
+// the heights which pass the stack checks of a block
+func blockHeights(block BlockInfo) heightRange {
+	return heightRange{Lo: int(block.StackReq), Hi: stackLimit - int(block.StackMaxGrowth)}
+}
+
+// the net change of the stack height after executing the block
+func (analysis AdvancedCodeAnalysis) stackChangeOf(span blockSpan) int {
+	opTbl := OpTables[analysis.Rev]
+	change := 0
+	for _, instr := range analysis.InstrList[span.Begin:span.End] {
+		op := instr.OpCode
+		if op == NOP {
+			op = instr.Number // the original PUSH, which is counted to keep the JUMP/JUMPI's pop balanced
+		}
+		change += int(opTbl[op].StackChange)
+	}
+	return change
+}
+
+// does the contract have any reachable JUMP/JUMPI which may go through the JUMPTABLE?
+func (analysis AdvancedCodeAnalysis) hasDynamicJumps() bool {
+	dead := false
+	for _, instr := range analysis.InstrList {
+		if instr.OpCode == OPX_BEGINBLOCK {
+			dead = instr.Block.Dead
+		}
+		if !dead && (instr.OpCode == OP_JUMP || instr.OpCode == OP_JUMPI) && instr.Number == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Infer the range of the stack height at the entry of each basic block, and mark the blocks whose
+// ranges are proven to satisfy their StackReq and StackMaxGrowth.
+func (analysis AdvancedCodeAnalysis) proveStackHeights() {
+	if !analysis.Options.StackHeights {
+		return
+	}
+	spans := analysis.blockSpans()
+	blockOfPC := make(map[int]int, len(spans))
+	for i, span := range spans {
+		blockOfPC[analysis.blockPC(span)] = i
+	}
+	heights := make([]heightRange, len(spans))
+	seen := make([]bool, len(spans)) // is any way into the block found?
+	var queue []int
+	queued := make([]bool, len(spans))
+	enter := func(i int, r heightRange) {
+		if seen[i] {
+			r = r.union(heights[i])
+			if r == heights[i] {
+				return
+			}
+		}
+		heights[i], seen[i] = r, true
+		if !queued[i] {
+			queue = append(queue, i)
+			queued[i] = true
+		}
+	}
+	enter(0, heightRange{0, 0}) // the execution starts with an empty stack
+	dynamic := analysis.dynamicTargets()
+	for i, span := range spans {
+		if _, ok := dynamic[analysis.blockPC(span)]; ok && analysis.isJumpdest(analysis.InstrList[span.Begin]) {
+			enter(i, heightRange{0, stackLimit}) // from the JUMPTABLE, with any height
+		}
+	}
+	for len(queue) != 0 {
+		i := queue[0]
+		queue = queue[1:]
+		queued[i] = false
+		span := spans[i]
+		valid := blockHeights(analysis.InstrList[span.Begin].Block)
+		r := heightRange{Lo: max(heights[i].Lo, valid.Lo), Hi: min(heights[i].Hi, valid.Hi)} // after the checks
+		if r.empty() {
+			continue // the block always fails
+		}
+		change := analysis.stackChangeOf(span)
+		exit := heightRange{Lo: r.Lo + change, Hi: r.Hi + change}
+		last := analysis.InstrList[span.End-1]
+		if (last.OpCode == OP_JUMP || last.OpCode == OP_JUMPI) && last.Number != 0 {
+			if _, ok := analysis.TargetsSet[last.Number]; ok {
+				enter(blockOfPC[last.Number], exit)
+			}
+		}
+		if i+1 < len(spans) && analysis.fallsThrough(last) {
+			enter(i+1, exit)
+		}
+	}
+	for i, span := range spans {
+		block := &analysis.InstrList[span.Begin].Block
+		valid := blockHeights(*block)
+		if seen[i] && valid.Lo <= heights[i].Lo && heights[i].Hi <= valid.Hi {
+			block.Proven = true
+			block.EntryHeight = -1
+			if heights[i].Lo == heights[i].Hi {
+				block.EntryHeight = int16(heights[i].Lo)
+			}
+		}
+	}
+}
+
+// How many basic blocks only check the gas in their prologues
+type StackHeightStats struct {
+	Blocks int `json:"blocks"`
+	Proven int `json:"proven"` // the blocks whose stack checks are proven
+	Exact  int `json:"exact"`  // the proven blocks whose entry heights are exactly known
+}
+
+func (s StackHeightStats) String() string {
+	return fmt.Sprintf("%d of %d blocks proven, %d with exact heights", s.Proven, s.Blocks, s.Exact)
+}
+
+func (analysis AdvancedCodeAnalysis) StackHeightStats() (stats StackHeightStats) {
+	for _, instr := range analysis.InstrList {
+		if instr.OpCode != OPX_BEGINBLOCK {
+			continue
+		}
+		stats.Blocks++
+		if instr.Block.Proven {
+			stats.Proven++
+			if instr.Block.EntryHeight >= 0 {
+				stats.Exact++
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,162 @@
+package maot
+
+import (
+	"fmt"
+	"io"
+)
+
+// A block which is only entered by falling through from the previous one does not need its own label
+// or prologue, so mergeBlocks coalesces such chains into super-blocks. The prologue of a super-block
+// checks the gas and the stack for all its blocks at once, and sets the local "fast" to true. If the
+// check fails, "fast" is false and each block runs its own prologue as before, so the execution ends
+// exactly where it would without merging. In fast mode:
+//
+//   - state->current_block_cost is the static gas charged in advance for the rest of the super-block,
+//     so the corrections of GAS, SSTORE, CALL and CREATE are still right.
+//   - A taken JUMPI leaves the super-block early, and gives back the gas charged for the blocks after
+//     it (BlockInfo.Rest).
+//   - A dynamic gas charge before such a JUMPI could fail for the gas charged in advance while the
+//     original code would have jumped away, so a super-block never merges across a JUMPI after an
+//     instruction with dynamic gas.
+
+// the set of PCs which may be jumped to through the JUMPTABLE, see Options.SolcAssumptions
+func (analysis AdvancedCodeAnalysis) dynamicTargets() map[int]struct{} {
+	if analysis.hasDynamicJumps() {
+		return analysis.jumpTableCandidates()
+	}
+	return nil
+}
+
+// does any instruction in the block have a dynamic gas cost?
+func (analysis AdvancedCodeAnalysis) hasDynamicGas(span blockSpan) bool {
+	for _, instr := range analysis.InstrList[span.Begin:span.End] {
+		if instr.OpCode >= 0 && GasModelOf(analysis.Rev, instr.OpCode).Dynamic != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// can the block only be entered by falling through from the previous one?
+func (analysis AdvancedCodeAnalysis) onlyFallenInto(span blockSpan, dynamic, fused map[int]struct{}) bool {
+	if span.Begin == 0 {
+		return false // the execution starts here
+	}
+	instr := analysis.InstrList[span.Begin]
+	if !analysis.isJumpdest(instr) {
+		return true // the block after a JUMPI
+	}
+	_, isDynamic := dynamic[instr.PC]
+	_, isFused := fused[instr.PC]
+	return !isDynamic && !isFused
+}
+
+// Merge the chains of basic blocks which are only entered by falling through into super-blocks
+func (analysis AdvancedCodeAnalysis) mergeBlocks() {
+	if !analysis.Options.MergeBlocks {
+		return
+	}
+	dynamic := analysis.dynamicTargets()
+	fused := make(map[int]struct{})
+	for _, instr := range analysis.InstrList {
+		if (instr.OpCode == OP_JUMP || instr.OpCode == OP_JUMPI) && instr.Number != 0 {
+			fused[instr.Number] = struct{}{}
+		}
+	}
+	spans := analysis.blockSpans()
+	for i := 0; i < len(spans); {
+		if analysis.InstrList[spans[i].Begin].Block.Dead {
+			i++
+			continue
+		}
+		j := i + 1 // the chain is spans[i:j]
+		dynamicGas := analysis.hasDynamicGas(spans[i])
+		for j < len(spans) {
+			last := analysis.InstrList[spans[j-1].End-1]
+			if !analysis.fallsThrough(last) || !analysis.onlyFallenInto(spans[j], dynamic, fused) ||
+				(last.OpCode == OP_JUMPI && dynamicGas) {
+				break
+			}
+			dynamicGas = dynamicGas || analysis.hasDynamicGas(spans[j])
+			j++
+		}
+		if j-i > 1 {
+			analysis.mergeChain(spans[i:j])
+		}
+		i = j
+	}
+}
+
+// make the blocks in chain a super-block
+func (analysis AdvancedCodeAnalysis) mergeChain(chain []blockSpan) {
+	super := &BlockInfo{}
+	change := 0
+	for _, span := range chain {
+		block := analysis.InstrList[span.Begin].Block
+		super.GasCost += block.GasCost
+		super.StackReq = int16(max(int(super.StackReq), int(block.StackReq)-change))
+		super.StackMaxGrowth = int16(max(int(super.StackMaxGrowth), change+int(block.StackMaxGrowth)))
+		change += analysis.stackChangeOf(span)
+	}
+	rest := super.GasCost
+	for k, span := range chain {
+		block := &analysis.InstrList[span.Begin].Block
+		rest -= block.GasCost
+		block.Rest = rest
+		block.Merged = k != 0
+	}
+	analysis.InstrList[chain[0].Begin].Block.Super = super
+}
+
+// Emit the prologue of a basic block, and the fast path of it if the block is in a super-block
+func (analysis AdvancedCodeAnalysis) dumpPrologue(fout io.Writer, instr *Instruction) {
+	block := instr.Block
+	if super := block.Super; super != nil {
+		wr(fout, "fast=begin_super_block(%d, %d, %d, *state);\nif(!fast) {\n", super.GasCost, super.StackReq,
+			super.StackMaxGrowth)
+	} else if block.Merged {
+		wr(fout, "if(fast) {\n  state->current_block_cost = %d;\n} else {\n", block.GasCost+block.Rest)
+	}
+	if block.Proven {
+		wr(fout, "if(!begin_block_gas(%d, *state)) goto ENDING; // stack checks proven\n", block.GasCost)
+	} else {
+		wr(fout, "instr=instr_from_block(%d, %d, %d);\n", block.GasCost, block.StackReq, block.StackMaxGrowth)
+		wr(fout, "if(next_instr!=maotBEGINBLOCK(&instr, *state)) goto ENDING;\n")
+	}
+	if block.Super != nil || block.Merged {
+		wr(fout, "}\n")
+	}
+}
+
+// Give back the gas charged in advance for the blocks after the current one, before a taken JUMPI
+// leaves the super-block
+func dumpSuperBlockExit(fout io.Writer, rest uint32) {
+	if rest != 0 {
+		wr(fout, "  if(fast) state->gas_left += %d;\n", rest)
+	}
+}
+
+// How many basic blocks are merged into super-blocks
+type MergeStats struct {
+	Blocks      int `json:"blocks"`       // the blocks in super-blocks
+	SuperBlocks int `json:"super_blocks"` // the super-blocks
+}
+
+func (s MergeStats) String() string {
+	return fmt.Sprintf("%d blocks into %d super-blocks", s.Blocks, s.SuperBlocks)
+}
+
+func (analysis AdvancedCodeAnalysis) MergeStats() (stats MergeStats) {
+	for _, instr := range analysis.InstrList {
+		if instr.OpCode != OPX_BEGINBLOCK {
+			continue
+		}
+		if instr.Block.Super != nil {
+			stats.SuperBlocks++
+			stats.Blocks++
+		} else if instr.Block.Merged {
+			stats.Blocks++
+		}
+	}
+	return
+}
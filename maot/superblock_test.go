@@ -0,0 +1,60 @@
+package maot_test
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/smartbch/moeingaot/difftest"
+	"github.com/smartbch/moeingaot/interp"
+	"github.com/smartbch/moeingaot/maot"
+)
+
+// A super-block charges the gas of all its blocks in advance, so the gas seen by GAS and left at the end
+// is compared with the reference interpreter, which charges each instruction by itself. The super-block
+// is left early by either JUMPI, and every gas limit up to the cost of the longest path is tried, so it
+// is also entered with too little gas for the fast path, where each block charges its own gas.
+func TestSuperBlockGas(t *testing.T) {
+	const t1, t2 = 29, 39 // the JUMPDESTs jumped to from the first and the second block
+	code := concat(
+		argCode(0), []byte{maot.OP_PUSH2, 0, t1, maot.OP_JUMPI}, // 0: the first block
+		argCode(1), []byte{maot.OP_PUSH2, 0, t2, maot.OP_JUMPI}, // 7: the second block
+		[]byte{maot.OP_PUSH1, 7, maot.OP_PUSH1, 9, maot.OP_MUL, maot.OP_POP, maot.OP_GAS}, returnTop, // 14: the third
+		[]byte{maot.OP_JUMPDEST, maot.OP_GAS}, returnTop, // t1
+		[]byte{maot.OP_JUMPDEST, maot.OP_GAS}, returnTop, // t2
+	)
+	const rev = maot.EVMC_LONDON
+	analysis := maot.Analyze(rev, code, maot.DefaultOptions())
+	if stats := analysis.MergeStats(); stats != (maot.MergeStats{Blocks: 3, SuperBlocks: 1}) {
+		t.Fatalf("MergeStats=%s, want 3 blocks into 1 super-block", stats)
+	}
+	super := analysis.InstrList[0].Block.Super
+	slow := 0 // the successful runs which enter the super-block with less gas than super.GasCost
+	one, zero := big.NewInt(1), big.NewInt(0)
+	inputs := map[string][]byte{
+		"exit-first":   calldata(one, zero),
+		"exit-second":  calldata(zero, one),
+		"fall-through": calldata(zero, zero),
+	}
+	for name, input := range inputs {
+		for gas := int64(0); gas <= 200; gas++ {
+			msg := &interp.Message{Gas: gas, Input: input}
+			ref := (&interp.Interpreter{Host: difftest.NewMockHost(rev, nil)}).ExecuteBytecode(rev, msg, code)
+			in := &interp.Interpreter{Host: difftest.NewMockHost(rev, nil)}
+			res, err := in.Execute(analysis, msg, code)
+			if err != nil {
+				t.Fatalf("%s with %d gas: %v", name, gas, err)
+			}
+			if res.Status != ref.Status || res.GasLeft != ref.GasLeft || !bytes.Equal(res.Output, ref.Output) {
+				t.Errorf("%s with %d gas: %v %d %x, the reference %v %d %x", name, gas,
+					res.Status, res.GasLeft, res.Output, ref.Status, ref.GasLeft, ref.Output)
+			}
+			if res.Status == interp.Success && gas < int64(super.GasCost) {
+				slow++
+			}
+		}
+	}
+	if slow == 0 {
+		t.Errorf("no run leaves the super-block early with less than %d gas", super.GasCost)
+	}
+}
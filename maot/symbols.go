@@ -0,0 +1,83 @@
+package maot
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The generated C++ code puts all its symbols into a namespace, so that the executors and helpers of
+// two libraries, or of a library and the host, never collide. The definitions which must stay in evmone's
+// namespace (such as op_sstore) go to an inline namespace of evmone with the same name, so they are still
+// found as evmone::op_sstore but are mangled differently. Only the entry points have C linkage, and they
+// are suffixed with _<LibID> when LibID is set, such as query_executor_<LibID>.
+
+const defaultNamespace = "maot"
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// the names of the generated C++ symbols, decided by Options
+type symbolNames struct {
+	ns     string // the C++ namespace
+	suffix string // appended to the exported symbols
+}
+
+func (opts Options) symbols() symbolNames {
+	res := symbolNames{ns: opts.Namespace}
+	if len(opts.LibID) != 0 {
+		res.suffix = "_" + opts.LibID
+		if len(res.ns) == 0 {
+			res.ns = defaultNamespace + res.suffix
+		}
+	}
+	if len(res.ns) == 0 {
+		res.ns = defaultNamespace
+	}
+	return res
+}
+
+// the executor of a contract, which is in the namespace
+func (s symbolNames) executor(name string) string {
+	return "execute_" + name
+}
+
+// an entry point with C linkage, such as query_executor
+func (s symbolNames) exported(base string) string {
+	return base + s.suffix
+}
+
+// the beginning and the end of a block of code in the namespace
+func (s symbolNames) open() string {
+	return fmt.Sprintf("namespace %s\n{\n", s.ns)
+}
+
+func (s symbolNames) close() string {
+	return fmt.Sprintf("} // namespace %s\n", s.ns)
+}
+
+// the beginning and the end of a block of code in evmone's namespace
+func (s symbolNames) openEvmone() string {
+	return fmt.Sprintf("namespace evmone\n{\ninline namespace %s\n{\n", s.ns)
+}
+
+func (s symbolNames) closeEvmone() string {
+	return fmt.Sprintf("} // namespace %s\n} // namespace evmone\n", s.ns)
+}
+
+// make sure the options lead to valid C++ identifiers
+func (opts Options) checkSymbols() error {
+	if len(opts.Namespace) != 0 && !identifierRegexp.MatchString(opts.Namespace) {
+		return fmt.Errorf("invalid namespace %q: not a C++ identifier", opts.Namespace)
+	}
+	if len(opts.LibID) != 0 && !identifierRegexp.MatchString("_"+opts.LibID) {
+		return fmt.Errorf("invalid library id %q: only letters, digits and underscores are allowed", opts.LibID)
+	}
+	return nil
+}
+
+// make sure the executor of a contract named so is a valid C++ identifier
+func checkContractName(name string) error {
+	if !identifierRegexp.MatchString("execute_" + name) {
+		return fmt.Errorf("invalid contract name %q: only letters, digits and underscores are allowed", name)
+	}
+	return nil
+}
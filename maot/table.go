@@ -8,11 +8,11 @@ import (
 )
 
 var (
-	OpTables      [11][256]OpTableEntry
-	GasCostTable  [11][256]int = getGasCostTable()
-	TraitsTable   [256]Traits  = getTraitsTable()
-	FuncNameTable [256]string  = getFuncNameTable()
-	TypeTable     [256]byte    = getInstrTypeTable()
+	OpTables      [EVMC_MAX_REVISION + 1][256]OpTableEntry
+	GasCostTable  [EVMC_MAX_REVISION + 1][256]int = getGasCostTable()
+	TraitsTable   [256]Traits                     = getTraitsTable()
+	FuncNameTable [256]string                     = getFuncNameTable()
+	TypeTable     [256]byte                       = getInstrTypeTable()
 )
 
 const (
@@ -31,6 +31,8 @@ const (
 
 	Inline = byte(128)
 
+	// the same numbers as evmc_revision in EVMC 11 and later, whose evmc_host_interface and
+	// evmc_tx_context have the transient storage, blob_hashes and blob_base_fee used by Cancun
 	EVMC_FRONTIER          = 0
 	EVMC_HOMESTEAD         = 1
 	EVMC_TANGERINE_WHISTLE = 2
@@ -41,7 +43,11 @@ const (
 	EVMC_ISTANBUL          = 7
 	EVMC_BERLIN            = 8
 	EVMC_LONDON            = 9
-	EVMC_SHANGHAI          = 10
+	EVMC_PARIS             = 10
+	EVMC_SHANGHAI          = 11
+	EVMC_CANCUN            = 12
+	EVMC_PRAGUE            = 13
+	EVMC_MAX_REVISION      = EVMC_PRAGUE
 
 	OP_STOP       = 0x00
 	OP_ADD        = 0x01
@@ -99,6 +105,8 @@ const (
 	OP_CHAINID     = 0x46
 	OP_SELFBALANCE = 0x47
 	OP_BASEFEE     = 0x48
+	OP_BLOBHASH    = 0x49
+	OP_BLOBBASEFEE = 0x4a
 
 	OP_POP         = 0x50
 	OP_MLOAD       = 0x51
@@ -113,6 +121,10 @@ const (
 	OP_GAS         = 0x5a
 	OP_JUMPDEST    = 0x5b
 	OPX_BEGINBLOCK = OP_JUMPDEST
+	OP_TLOAD       = 0x5c
+	OP_TSTORE      = 0x5d
+	OP_MCOPY       = 0x5e
+	OP_PUSH0       = 0x5f
 
 	OP_PUSH1  = 0x60
 	OP_PUSH2  = 0x61
@@ -197,6 +209,22 @@ const (
 	OP_SELFDESTRUCT = 0xff
 )
 
+// lower-case names of the revisions, indexed by EVMC_FRONTIER ~ EVMC_MAX_REVISION
+var RevisionNames = []string{"frontier", "homestead", "tangerine_whistle", "spurious_dragon",
+	"byzantium", "constantinople", "petersburg", "istanbul", "berlin", "london", "paris",
+	"shanghai", "cancun", "prague"}
+
+// ParseRevision converts a revision name such as "london" (or "EVMC_LONDON") to its number
+func ParseRevision(s string) (int, error) {
+	name := strings.TrimPrefix(strings.ToLower(s), "evmc_")
+	for rev, revName := range RevisionNames {
+		if name == revName {
+			return rev, nil
+		}
+	}
+	return -1, fmt.Errorf("unknown revision %q (want one of %s)", s, strings.Join(RevisionNames, ", "))
+}
+
 // basic traits of instructions, which are independent to VM versions
 type Traits struct {
 	Name        string
@@ -215,7 +243,7 @@ type OpTableEntry struct {
 }
 
 func init() {
-	for r := EVMC_FRONTIER; r <= EVMC_SHANGHAI; r++ {
+	for r := EVMC_FRONTIER; r <= EVMC_MAX_REVISION; r++ {
 		var table [256]OpTableEntry
 		for i := 0; i < 256; i++ {
 			cost := GasCostTable[r][i]
@@ -233,7 +261,7 @@ func init() {
 }
 
 // For each VM version, build a table show each instruction's gas cost
-func getGasCostTable() (table [11][256]int) {
+func getGasCostTable() (table [EVMC_MAX_REVISION + 1][256]int) {
 	for i := 0; i < 256; i++ {
 		table[EVMC_FRONTIER][i] = Undefined //?
 	}
@@ -362,7 +390,19 @@ func getGasCostTable() (table [11][256]int) {
 	table[EVMC_LONDON] = table[EVMC_BERLIN]
 	table[EVMC_LONDON][OP_BASEFEE] = 2
 
-	table[EVMC_SHANGHAI] = table[EVMC_LONDON]
+	table[EVMC_PARIS] = table[EVMC_LONDON] // DIFFICULTY is PREVRANDAO now, with the same cost
+
+	table[EVMC_SHANGHAI] = table[EVMC_PARIS]
+	table[EVMC_SHANGHAI][OP_PUSH0] = 2
+
+	table[EVMC_CANCUN] = table[EVMC_SHANGHAI]
+	table[EVMC_CANCUN][OP_BLOBHASH] = 3
+	table[EVMC_CANCUN][OP_BLOBBASEFEE] = 2
+	table[EVMC_CANCUN][OP_TLOAD] = 100
+	table[EVMC_CANCUN][OP_TSTORE] = 100
+	table[EVMC_CANCUN][OP_MCOPY] = 3
+
+	table[EVMC_PRAGUE] = table[EVMC_CANCUN]
 	return
 }
 
@@ -423,6 +463,8 @@ func getTraitsTable() (table [256]Traits) {
 	table[OP_CHAINID] = Traits{"CHAINID", 0, 1}
 	table[OP_SELFBALANCE] = Traits{"SELFBALANCE", 0, 1}
 	table[OP_BASEFEE] = Traits{"BASEFEE", 0, 1}
+	table[OP_BLOBHASH] = Traits{"BLOBHASH", 1, 0}
+	table[OP_BLOBBASEFEE] = Traits{"BLOBBASEFEE", 0, 1}
 
 	table[OP_POP] = Traits{"POP", 1, -1}
 	table[OP_MLOAD] = Traits{"MLOAD", 1, 0}
@@ -436,6 +478,11 @@ func getTraitsTable() (table [256]Traits) {
 	table[OP_MSIZE] = Traits{"MSIZE", 0, 1}
 	table[OP_GAS] = Traits{"GAS", 0, 1}
 	table[OP_JUMPDEST] = Traits{"BEGINBLOCK", 0, 0}
+	table[OP_TLOAD] = Traits{"TLOAD", 1, 0}
+	table[OP_TSTORE] = Traits{"TSTORE", 2, -2}
+	table[OP_MCOPY] = Traits{"MCOPY", 3, -3}
+
+	table[OP_PUSH0] = Traits{"PUSH0", 0, 1}
 
 	table[OP_PUSH1] = Traits{"PUSH1", 0, 1}
 	table[OP_PUSH2] = Traits{"PUSH2", 0, 1}
@@ -579,6 +626,8 @@ func getFuncNameTable() (table [256]string) {
 	table[OP_CHAINID] = "op<evmone::chainid>"
 	table[OP_SELFBALANCE] = "op<evmone::selfbalance>"
 	table[OP_BASEFEE] = "op<evmone::basefee>"
+	table[OP_BLOBHASH] = "op_blobhash"
+	table[OP_BLOBBASEFEE] = "op_blobbasefee"
 
 	table[OP_POP] = "op<evmone::pop>"
 	table[OP_MLOAD] = "op<evmone::mload>"
@@ -592,6 +641,11 @@ func getFuncNameTable() (table [256]string) {
 	table[OP_MSIZE] = "op<evmone::msize>"
 	table[OP_GAS] = "op_gas"
 	table[OPX_BEGINBLOCK] = "opx_beginblock"
+	table[OP_TLOAD] = "op_tload"
+	table[OP_TSTORE] = "op_tstore"
+	table[OP_MCOPY] = "op_mcopy"
+
+	table[OP_PUSH0] = "op_push0"
 
 	for op := OP_PUSH1; op <= OP_PUSH8; op++ {
 		table[op] = "op_push_small"
@@ -706,6 +760,8 @@ func getInstrTypeTable() (table [256]byte) {
 	table[OP_CHAINID] = StateOnly | Inline
 	table[OP_SELFBALANCE] = StateOnly
 	table[OP_BASEFEE] = StateOnly
+	table[OP_BLOBHASH] = Full
+	table[OP_BLOBBASEFEE] = Full
 	table[OP_POP] = StackOp | Inline
 	table[OP_MLOAD] = StateWithStatus | Inline
 	table[OP_MSTORE] = StateWithStatus | Inline
@@ -718,6 +774,10 @@ func getInstrTypeTable() (table [256]byte) {
 	table[OP_MSIZE] = StateOnly | Inline
 	table[OP_GAS] = Full
 	table[OP_JUMPDEST] = FullWithBreak
+	table[OP_TLOAD] = Full
+	table[OP_TSTORE] = FullWithBreak
+	table[OP_MCOPY] = FullWithBreak
+	table[OP_PUSH0] = Full | Inline
 	table[OP_LOG0] = StateWithStatus
 	table[OP_LOG1] = StateWithStatus
 	table[OP_LOG2] = StateWithStatus
@@ -739,18 +799,33 @@ func getInstrTypeTable() (table [256]byte) {
 	return
 }
 
-// Dump two files: instrexe.hpp and instrexe.cpp. They have an implementation for each instruction
-func DumpInstrExeFiles(dir string) {
-	opTbl := OpTables[EVMC_ISTANBUL]
+// Dump two files: instrexe.hpp and instrexe.cpp. They have an implementation for each instruction.
+// The instructions undefined in revision "rev" are implemented with op_undefined. These files can be
+// shared by the executors compiled for "rev" and for all the earlier revisions, because undefined
+// instructions never reach these implementations from the executors (see DumpAllInstr).
+// The symbols are put into the namespace selected by opts, which must be the same as the executors'.
+func DumpInstrExeFiles(rev int, dir string, opts Options) error {
+	if err := opts.checkSymbols(); err != nil {
+		return err
+	}
+	syms := opts.symbols()
+	opTbl := OpTables[rev]
 	hF := []string{`#pragma once
 #include "analysis.hpp"
 #include "instructions.hpp"
 
-void show_stack(evmone::AdvancedExecutionState& state);
+` + computedGotoMacro + `
+// a trace sink receives one EIP-3155-style JSON line (without the trailing newline) per instruction
+typedef void (*maot_trace_sink_fn)(void* sink_ctx, const char* line, size_t len);
+extern "C" __attribute__ ((visibility ("default"))) void ` + syms.exported("maot_set_trace_sink") + `(maot_trace_sink_fn fn, void* sink_ctx);
 
-namespace evmone
-{
-template <void InstrFn(Stack&)> // For StackOp
+` + syms.open() + `void show_stack(evmone::AdvancedExecutionState& state);
+
+// report the state before executing an instruction, gas_left+precharged is the gas an interpreter would show
+void trace_step(evmone::AdvancedExecutionState& state, int pc, int op, const char* op_name,
+    int64_t gas_cost, int64_t precharged);
+` + syms.close() + `
+` + syms.openEvmone() + `template <void InstrFn(Stack&)> // For StackOp
 inline const instruction* op(const instruction* instr, AdvancedExecutionState& state) noexcept
 {
     InstrFn(state.stack);
@@ -819,6 +894,32 @@ const instruction* op_create(const instruction* instr, AdvancedExecutionState& s
 const instruction* op_undefined(const instruction*, AdvancedExecutionState& state) noexcept;
 const instruction* op_selfdestruct(const instruction*, AdvancedExecutionState& state) noexcept;
 const instruction* opx_beginblock(const instruction* instr, AdvancedExecutionState& state) noexcept;
+` + syms.closeEvmone() + `
+` + syms.open() + `// the result of a comparison as an EVM word
+inline intx::uint256 word_of(bool b) noexcept {
+	return b ? 1 : 0;
+}
+
+// the prologue of a basic block whose stack height is proven at compile time, which only charges the gas
+inline bool begin_block_gas(uint32_t gas_cost, evmone::AdvancedExecutionState& state) noexcept {
+	if((state.gas_left -= gas_cost) < 0) {
+		state.exit(EVMC_OUT_OF_GAS);
+		return false;
+	}
+	state.current_block_cost = gas_cost;
+	return true;
+}
+
+// the prologue of a super-block, which checks the gas and the stack for all its blocks at once and
+// charges the gas if they pass, see mergeBlocks
+inline bool begin_super_block(uint32_t gas_cost, int16_t stack_req, int16_t stack_max_growth,
+	evmone::AdvancedExecutionState& state) noexcept {
+	const auto size = static_cast<int>(state.stack.size());
+	if(state.gas_left < gas_cost || size < stack_req || size + stack_max_growth > evmone::Stack::limit)
+		return false;
+	state.gas_left -= gas_cost;
+	state.current_block_cost = gas_cost;
+	return true;
 }
 
 // build an evmone::instruction instance by filling its arg.block
@@ -850,20 +951,53 @@ inline evmone::instruction instr_from_num(uint64_t n) {
 	instr.arg.number = n;
 	return instr;
 }
-`}
+` + syms.close()}
 	cF := []string{`
+#include <algorithm>
+#include <cstdio>
+#include <cstring>
 #include <iostream>
+#include <string>
 #include "instrexe.hpp"
 
-void show_stack(evmone::AdvancedExecutionState& state) {
+` + syms.open() + `void show_stack(evmone::AdvancedExecutionState& state) {
     for(int i = state.stack.size() - 1; i >= 0; i--) {
         std::cout<<"0x"<<intx::hex(state.stack[i])<<std::endl;
     }
 }
 
-namespace evmone
-{
-const instruction* op_stop(const instruction*, AdvancedExecutionState& state) noexcept
+static maot_trace_sink_fn trace_sink = nullptr; // nullptr means printing to stderr
+static void* trace_sink_ctx = nullptr;
+
+} // namespace ` + syms.ns + `
+
+void ` + syms.exported("maot_set_trace_sink") + `(maot_trace_sink_fn fn, void* sink_ctx) {
+    ` + syms.ns + `::trace_sink = fn;
+    ` + syms.ns + `::trace_sink_ctx = sink_ctx;
+}
+
+` + syms.open() + `
+void trace_step(evmone::AdvancedExecutionState& state, int pc, int op, const char* op_name,
+    int64_t gas_cost, int64_t precharged) {
+    char buf[160];
+    snprintf(buf, sizeof(buf), "{\"pc\":%d,\"op\":%d,\"gas\":\"0x%llx\",\"gasCost\":\"0x%llx\",\"memSize\":%zu,\"stack\":[",
+        pc, op, (unsigned long long)(state.gas_left + precharged), (unsigned long long)gas_cost, state.memory.size());
+    std::string line(buf);
+    for(int i = state.stack.size() - 1; i >= 0; i--) { // from bottom to top
+        line += "\"0x" + intx::hex(state.stack[i]) + "\"";
+        if(i != 0) line += ",";
+    }
+    snprintf(buf, sizeof(buf), "],\"depth\":%d,\"opName\":\"%s\"}", state.msg->depth + 1, op_name);
+    line += buf;
+    if(trace_sink != nullptr) {
+        trace_sink(trace_sink_ctx, line.data(), line.size());
+    } else {
+        line += "\n";
+        fwrite(line.data(), 1, line.size(), stderr);
+    }
+}
+` + syms.close() + `
+` + syms.openEvmone() + `const instruction* op_stop(const instruction*, AdvancedExecutionState& state) noexcept
 {
     return state.exit(EVMC_SUCCESS);
 }
@@ -910,7 +1044,7 @@ const instruction* op_return(const instruction*, AdvancedExecutionState& state)
     return state.exit(status_code);
 }
 
-template <evmc_call_kind Kind, bool Static = false>
+template <evmc_call_kind Kind, bool Static>
 const instruction* op_call(const instruction* instr, AdvancedExecutionState& state) noexcept
 {
     const auto gas_left_correction = state.current_block_cost - instr->arg.number;
@@ -968,8 +1102,22 @@ const instruction* opx_beginblock(const instruction* instr, AdvancedExecutionSta
     state.current_block_cost = block.gas_cost;
     return ++instr;
 }
-}
-`}
+` + syms.closeEvmone()}
+	for op := 0; op < 256; op++ { // instructions which are unknown to evmone.release
+		impl, ok := extraInstrImpls[op]
+		if !ok || opTbl[op].FuncName == "op_undefined" {
+			continue // only emitted when defined in this revision, to avoid depending on new EVMC APIs
+		}
+		hF = append(hF, syms.openEvmone()+impl[0]+syms.closeEvmone())
+		if len(impl[1]) != 0 {
+			cF = append(cF, syms.openEvmone()+impl[1]+syms.closeEvmone())
+		}
+	}
+	hF = append(hF, syms.open())
+	cF = append(cF, syms.open())
+	for _, p := range FusionPatterns { // super-instructions, which are used only if Options.Fusion is set
+		hF = append(hF, "// super-instruction "+p.Name+"\n"+p.Impl)
+	}
 	fFmt := "const evmone::instruction* maot%s(const evmone::instruction* instr, evmone::AdvancedExecutionState& state) noexcept"
 	for op := 0; op < 256; op++ {
 		if len(TraitsTable[op].Name) == 0 || // undefined instruction
@@ -988,12 +1136,86 @@ const instruction* opx_beginblock(const instruction* instr, AdvancedExecutionSta
 			cF = append(cF, content)
 		}
 	}
-	err := os.WriteFile(path.Join(dir, "instrexe.hpp"), []byte(strings.Join(hF, "")), 0644)
+	hF = append(hF, syms.close())
+	cF = append(cF, syms.close())
+	fname := path.Join(dir, "instrexe.hpp")
+	err := os.WriteFile(fname, []byte(strings.Join(hF, "")), 0644)
 	if err != nil {
-		panic(err)
+		return &CompileError{File: fname, Offset: -1, Err: err}
 	}
-	err = os.WriteFile(path.Join(dir, "instrexe.cpp"), []byte(strings.Join(cF, "")), 0644)
+	fname = path.Join(dir, "instrexe.cpp")
+	err = os.WriteFile(fname, []byte(strings.Join(cF, "")), 0644)
 	if err != nil {
-		panic(err)
+		return &CompileError{File: fname, Offset: -1, Err: err}
 	}
+	return nil
+}
+
+// The implementations of the instructions introduced after evmone.release, as [header, cpp] pairs
+var extraInstrImpls = map[int][2]string{
+	OP_PUSH0: {`inline const instruction* op_push0(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    state.stack.push(0);
+    return ++instr;
+}
+`, ""},
+	OP_TLOAD: {`const instruction* op_tload(const instruction* instr, AdvancedExecutionState& state) noexcept;
+`, `const instruction* op_tload(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    auto& x = state.stack.top();
+    const auto key = intx::be::store<evmc::bytes32>(x);
+    const auto value = state.host.get_transient_storage(state.msg->recipient, key);
+    x = intx::be::load<intx::uint256>(value);
+    return ++instr;
+}
+`},
+	OP_TSTORE: {`const instruction* op_tstore(const instruction* instr, AdvancedExecutionState& state) noexcept;
+`, `const instruction* op_tstore(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    if (state.msg->flags & EVMC_STATIC)
+        return state.exit(EVMC_STATIC_MODE_VIOLATION);
+
+    const auto key = intx::be::store<evmc::bytes32>(state.stack.pop());
+    const auto value = intx::be::store<evmc::bytes32>(state.stack.pop());
+    state.host.set_transient_storage(state.msg->recipient, key, value);
+    return ++instr;
+}
+`},
+	OP_MCOPY: {`const instruction* op_mcopy(const instruction* instr, AdvancedExecutionState& state) noexcept;
+`, `const instruction* op_mcopy(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    const auto dst = state.stack.pop();
+    const auto src = state.stack.pop();
+    const auto size = state.stack.pop();
+
+    if (!check_memory(state, std::max(dst, src), size))
+        return state.exit(EVMC_OUT_OF_GAS);
+
+    const auto n = static_cast<size_t>(size);
+    if ((state.gas_left -= num_words(n) * 3) < 0)
+        return state.exit(EVMC_OUT_OF_GAS);
+
+    if (n != 0)
+        std::memmove(state.memory.data() + static_cast<size_t>(dst),
+            state.memory.data() + static_cast<size_t>(src), n);
+    return ++instr;
+}
+`},
+	OP_BLOBHASH: {`const instruction* op_blobhash(const instruction* instr, AdvancedExecutionState& state) noexcept;
+`, `const instruction* op_blobhash(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    auto& index = state.stack.top();
+    const auto tx = state.host.get_tx_context();
+    index = (index < tx.blob_hashes_count) ?
+        intx::be::load<intx::uint256>(tx.blob_hashes[static_cast<size_t>(index)]) : 0;
+    return ++instr;
+}
+`},
+	OP_BLOBBASEFEE: {`const instruction* op_blobbasefee(const instruction* instr, AdvancedExecutionState& state) noexcept;
+`, `const instruction* op_blobbasefee(const instruction* instr, AdvancedExecutionState& state) noexcept
+{
+    state.stack.push(intx::be::load<intx::uint256>(state.host.get_tx_context().blob_base_fee));
+    return ++instr;
+}
+`},
 }
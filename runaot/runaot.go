@@ -2,9 +2,15 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/smartbch/moeingaot/difftest"
 	"github.com/smartbch/moeingaot/maot"
 )
 
@@ -12,25 +18,382 @@ import (
 // g++ -std=c++17 -fPIC -I ../../moeingevm/evmwrap/evmone.release/ -I ../../moeingevm/evmwrap/evmc/include/ -I ../../moeingevm/evmwrap/intx/include -I ../../moeingevm/evmwrap/keccak/include -c instrexe.cpp
 // g++ -shared -o libaot.so ../util/keccak/src/keccak.o instrexe.o contract.o
 
-var codeHex = "608060405234801561001057600080fd5b50600436106100365760003560e01c8063653721471461003b578063677342ce14610059575b600080fd5b610043610075565b6040516100509190610114565b60405180910390f35b610073600480360381019061006e9190610160565b61007b565b005b60005481565b600060038211156100e2578190506000600160028461009a91906101eb565b6100a4919061021c565b90505b818110156100dc5780915060028182856100c191906101eb565b6100cb919061021c565b6100d591906101eb565b90506100a7565b506100f0565b600082146100ef57600190505b5b806000819055505050565b6000819050919050565b61010e816100fb565b82525050565b60006020820190506101296000830184610105565b92915050565b600080fd5b61013d816100fb565b811461014857600080fd5b50565b60008135905061015a81610134565b92915050565b6000602082840312156101765761017561012f565b5b60006101848482850161014b565b91505092915050565b7f4e487b7100000000000000000000000000000000000000000000000000000000600052601260045260246000fd5b7f4e487b7100000000000000000000000000000000000000000000000000000000600052601160045260246000fd5b60006101f6826100fb565b9150610201836100fb565b9250826102115761021061018d565b5b828204905092915050565b6000610227826100fb565b9150610232836100fb565b9250827fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff03821115610267576102666101bc565b5b82820190509291505056fea26469706673582212200e03c4ad7c4f84434e5637f8f06d34c1debad3c67774e1a0ab6aa3354b5d2a3064736f6c634300080d0033"
+// print the usage and exit with 2, like the flag package does for a bad flag
+func usage() {
+	subUsage("demo|instrexe|gen|cfg|disasm|difftest|gasmodel|querybench|jumpbench|stackbench|build|info [flags]")
+}
+
+func subUsage(args string) {
+	fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], args)
+	os.Exit(2)
+}
+
+// flags shared by the sub-commands which generate C++ code from bytecodes
+type genFlagValues struct {
+	mode      *string
+	rev       *string
+	namespace *string
+	libID     *string
+	fusion    *bool
+	cache     *bool
+	heights   *bool
+	merge     *bool
+	solc      *bool
+	jumpTable *string
+	overrides *string
+}
+
+func genFlags(name string) (*flag.FlagSet, *genFlagValues) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return fs, &genFlagValues{
+		mode:      fs.String("mode", "release", "instrumentation of the generated code: release, trace or stackdump"),
+		rev:       fs.String("rev", "istanbul", "comma-separated EVM revisions to compile for, such as istanbul,london"),
+		namespace: fs.String("namespace", "", "the C++ namespace of the generated symbols, maot or maot_<libid> by default"),
+		libID:     fs.String("libid", "", "suffix the exported entry points with _<libid>, such as query_executor_<libid>"),
+		fusion:    fs.Bool("fusion", true, "replace common sequences of instructions with super-instructions in release mode"),
+		cache:     fs.Bool("stackcache", true, "keep stack values in C++ locals inside basic blocks in release mode"),
+		heights:   fs.Bool("stackheights", true, "skip the stack checks of the basic blocks whose stack heights are proven"),
+		merge:     fs.Bool("mergeblocks", true, "merge the basic blocks only entered by falling through into super-blocks"),
+		solc:      fs.Bool("solc", false, "assume the JUMPTABLE only jumps to the JUMPDESTs pushed by PUSH, as in Solidity's output"),
+		jumpTable: fs.String("jumptable", "auto", "how the JUMPTABLE is implemented: auto, switch or goto"),
+		overrides: fs.String("jumptables", "", "comma-separated <contract>=<kind> which override -jumptable, such as 0xab..cd=goto"),
+	}
+}
+
+func parseRevisions(s string) []int {
+	var revs []int
+	for _, name := range strings.Split(s, ",") {
+		rev, err := maot.ParseRevision(strings.TrimSpace(name))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+		revs = append(revs, rev)
+	}
+	return revs
+}
+
+// parse one revision, for the sub-commands which analyze the code only once
+func parseRevision(s string) int {
+	rev, err := maot.ParseRevision(strings.TrimSpace(s))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	return rev
+}
+
+// the latest one among revs
+func maxRevision(revs []int) int {
+	res := revs[0]
+	for _, rev := range revs {
+		if rev > res {
+			res = rev
+		}
+	}
+	return res
+}
+
+func (v *genFlagValues) options() maot.Options {
+	opts := maot.DefaultOptions()
+	m, err := maot.ParseEmitMode(*v.mode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	opts.Mode = m
+	opts.Namespace = *v.namespace
+	opts.LibID = *v.libID
+	opts.Fusion = *v.fusion
+	opts.StackCache = *v.cache
+	opts.StackHeights = *v.heights
+	opts.MergeBlocks = *v.merge
+	opts.SolcAssumptions = *v.solc
+	if opts.JumpTable, err = maot.ParseJumpTableKind(*v.jumpTable); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	for _, item := range strings.Split(*v.overrides, ",") {
+		if len(item) == 0 {
+			continue
+		}
+		name, kindName, _ := strings.Cut(item, "=")
+		kind, err := maot.ParseJumpTableKind(kindName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+		if opts.ContractJumpTables == nil {
+			opts.ContractJumpTables = make(map[string]maot.JumpTableKind)
+		}
+		// the contracts are named by their addresses in lowercase hex, without 0x
+		opts.ContractJumpTables[strings.ToLower(strings.TrimPrefix(name, "0x"))] = kind
+	}
+	return opts
+}
+
+// print the error and exit with a non-zero code
+// the options for reading the input of gen, with the solc contract names to addresses in the JSON file addresses
+func loadOptions(format, addresses string) maot.LoadOptions {
+	opts := maot.LoadOptions{Format: format}
+	if len(addresses) != 0 {
+		content, err := os.ReadFile(addresses)
+		check(err)
+		check(json.Unmarshal(content, &opts.Addresses))
+	}
+	return opts
+}
+
+func check(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s demo|instrexe|gen\n", os.Args[0])
-		return
+		usage()
 	}
 	if os.Args[1] == "instrexe" {
-		maot.DumpInstrExeFiles(".")
+		fs, v := genFlags("instrexe")
+		fs.Parse(os.Args[2:])
+		check(maot.DumpInstrExeFiles(maxRevision(parseRevisions(*v.rev)), ".", v.options()))
 	} else if os.Args[1] == "demo" {
-		code, _ := hex.DecodeString(codeHex)
-		maot.CodeToFile(maot.EVMC_ISTANBUL, code, "contract", "contract.cpp")
+		fs, v := genFlags("demo")
+		fs.Parse(os.Args[2:])
+		code := difftest.Babylon()
+		check(maot.CodeToFile(parseRevisions(*v.rev), code, "contract", "contract.cpp", v.options()))
 	} else if os.Args[1] == "gen" {
-		if len(os.Args) != 4 {
-			fmt.Printf("Usage: %s gen <input-dir> <output-dir>\n", os.Args[0])
+		fs, v := genFlags("gen")
+		verbose := fs.Bool("v", false, "print statistics about each contract")
+		format := fs.String("format", "", "the input format: dir, json, jsonl or solc, detected if empty")
+		addresses := fs.String("addresses", "", "for solc's output, a JSON file mapping the contract names to addresses")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 2 {
+			subUsage("gen [-mode=release|trace|stackdump] [-rev=istanbul,london] [-namespace=ns] [-libid=id] [-v] [-format=dir|json|jsonl|solc] [-addresses=file] <input> <output-dir>")
+		}
+		inputs, err := maot.LoadInputs(fs.Arg(0), loadOptions(*format, *addresses))
+		check(err)
+		report, err := maot.AotCompileContracts(parseRevisions(*v.rev), inputs, fs.Arg(1), v.options())
+		check(err)
+		if *verbose {
+			report.Print(os.Stdout)
+		} else {
+			for _, in := range report.Rejected {
+				fmt.Fprintf(os.Stderr, "warning: %s is skipped: %s\n", in.Source, in.Reason)
+			}
+		}
+	} else if os.Args[1] == "cfg" {
+		fs := flag.NewFlagSet("cfg", flag.ExitOnError)
+		format := fs.String("format", "dot", "output format: dot or json")
+		rev := fs.String("rev", "istanbul", "the EVM revision to analyze for")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 || (*format != "dot" && *format != "json") {
+			subUsage("cfg [-format=dot|json] [-rev=istanbul] <hexfile>")
+		}
+		code, err := maot.ReadHexFile(fs.Arg(0))
+		check(err)
+		cfg := maot.Analyze(parseRevision(*rev), code, maot.DefaultOptions()).CFG()
+		if *format == "json" {
+			check(cfg.WriteJSON(os.Stdout))
+		} else {
+			check(cfg.WriteDOT(os.Stdout, filepath.Base(fs.Arg(0))))
+		}
+	} else if os.Args[1] == "disasm" {
+		fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+		format := fs.String("format", "text", "output format: text or json")
+		rev := fs.String("rev", "istanbul", "the EVM revision to analyze for")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 || (*format != "text" && *format != "json") {
+			subUsage("disasm [-format=text|json] [-rev=istanbul] <hexfile>")
+		}
+		code, err := maot.ReadHexFile(fs.Arg(0))
+		check(err)
+		d := maot.Disassemble(maot.Analyze(parseRevision(*rev), code, maot.DefaultOptions()))
+		if *format == "json" {
+			check(d.WriteJSON(os.Stdout))
+		} else {
+			check(d.WriteText(os.Stdout))
+		}
+	} else if os.Args[1] == "difftest" {
+		fs := flag.NewFlagSet("difftest", flag.ExitOnError)
+		rev := fs.String("rev", "istanbul", "comma-separated EVM revisions to test")
+		fuzz := fs.Int("fuzz", 64, "the number of random calldata for each contract")
+		seed := fs.Int64("seed", 1, "the seed for generating random calldata")
+		input := fs.String("input", "", "more contracts to test, in any of the input formats of gen")
+		format := fs.String("format", "", "the format of -input: dir, json, jsonl or solc, detected if empty")
+		addresses := fs.String("addresses", "", "for solc's output in -input, a JSON file mapping the contract names to addresses")
+		solc := fs.Bool("solc", false, "test with Options.SolcAssumptions, which the hand-written snippets may break")
+		native := fs.Bool("native", false, "test the C++ code built with the headers at $MOEINGEVM, instead of its Go model")
+		ldflags := fs.String("ldflags", "", "space-separated flags for linking the library of -native, such as -L and -l")
+		fs.Parse(os.Args[2:])
+		opts := maot.DefaultOptions()
+		opts.SolcAssumptions = *solc
+		h := difftest.NewHarness(opts)
+		if *native {
+			cfg := difftest.NativeConfig{Options: opts, Build: maot.DefaultBuildConfig()}
+			cfg.Build.LinkFlags = strings.Fields(*ldflags)
+			var err error
+			h.Target, err = difftest.NativeExecutor(cfg)
+			check(err)
+		}
+		h.Fuzz, h.Seed = *fuzz, *seed
+		contracts := map[string][]byte{"babylon": difftest.Babylon()}
+		if len(*input) != 0 {
+			codeMap, err := maot.LoadContracts(*input, loadOptions(*format, *addresses))
+			check(err)
+			for addr, code := range codeMap {
+				contracts[addr] = code
+			}
+		}
+		os.Exit(runDifftest(h, parseRevisions(*rev), contracts))
+	} else if os.Args[1] == "gasmodel" {
+		fs := flag.NewFlagSet("gasmodel", flag.ExitOnError)
+		rev := fs.String("rev", "istanbul", "comma-separated EVM revisions to print")
+		verify := fs.Bool("verify", false, "cross-check the tables against evmone's instruction_traits.hpp")
+		fs.Parse(os.Args[2:])
+		if *verify {
+			dir := os.Getenv("MOEINGEVM") + "/evmwrap/evmone.release"
+			if fs.NArg() == 1 {
+				dir = fs.Arg(0)
+			}
+			fname, err := maot.FindInstructionTraits(dir)
+			check(err)
+			report, err := maot.VerifyInstructionTraits(fname)
+			check(err)
+			report.Print(os.Stdout)
+			if len(report.Mismatches) != 0 {
+				os.Exit(1)
+			}
 			return
 		}
-		maot.AotCompile(maot.EVMC_ISTANBUL, os.Args[2], os.Args[3])
+		for _, r := range parseRevisions(*rev) {
+			check(maot.PrintGasModel(r, os.Stdout))
+		}
+	} else if os.Args[1] == "querybench" {
+		fs := flag.NewFlagSet("querybench", flag.ExitOnError)
+		n := fs.Int("n", 10000, "the number of compiled contracts")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 || *n <= 0 {
+			subUsage("querybench [-n=10000] <output-dir>")
+		}
+		check(maot.DumpQueryBenchmark(*n, fs.Arg(0)))
+	} else if os.Args[1] == "jumpbench" {
+		fs := flag.NewFlagSet("jumpbench", flag.ExitOnError)
+		n := fs.Int("n", 500, "the number of random JUMPDESTs, if -code is not set")
+		codeFile := fs.String("code", "", "a file with the hex bytecode whose JUMPDESTs are used, babylon for \"babylon\"")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 || *n <= 0 {
+			subUsage("jumpbench [-n=500] [-code=file] <output-dir>")
+		}
+		var code []byte
+		var err error
+		if *codeFile == "babylon" {
+			code = difftest.Babylon()
+		} else if len(*codeFile) != 0 {
+			code, err = maot.ReadHexFile(*codeFile)
+		}
+		check(err)
+		check(maot.DumpJumpTableBenchmark(*n, code, fs.Arg(0)))
+	} else if os.Args[1] == "stackbench" {
+		fs := flag.NewFlagSet("stackbench", flag.ExitOnError)
+		rev := fs.String("rev", "istanbul", "the EVM revision to compile for")
+		codeFile := fs.String("code", "babylon", "a file with the hex bytecode, babylon for \"babylon\"")
+		input := fs.String("input", "", "comma-separated calldata in hex, sqrt(10**18) and sqrt(2**256-1) for babylon")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			subUsage("stackbench [-rev=istanbul] [-code=babylon] [-input=hex1,hex2] <output-dir>")
+		}
+		code, inputs := difftest.Babylon(), *input
+		if *codeFile != "babylon" {
+			var err error
+			code, err = maot.ReadHexFile(*codeFile)
+			check(err)
+		} else if len(inputs) == 0 { // sqrt(uint256) with two words of different sizes
+			inputs = "677342ce0000000000000000000000000000000000000000000000000de0b6b3a7640000," +
+				"677342ce" + strings.Repeat("f", 64)
+		}
+		var calldata [][]byte
+		if len(inputs) != 0 {
+			for _, s := range strings.Split(inputs, ",") {
+				data, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+				check(err)
+				calldata = append(calldata, data)
+			}
+		}
+		check(maot.DumpStackCacheBenchmark(parseRevision(*rev), code, calldata, fs.Arg(0)))
+	} else if os.Args[1] == "build" {
+		def := maot.DefaultBuildConfig()
+		fs := flag.NewFlagSet("build", flag.ExitOnError)
+		compiler := fs.String("cxx", def.Compiler, "the C++ compiler")
+		flags := fs.String("flags", strings.Join(def.Flags, " "), "space-separated compiler flags")
+		moeingevm := fs.String("moeingevm", os.Getenv("MOEINGEVM"), "the moeingevm repository, whose headers are used")
+		includes := fs.String("I", "", "comma-separated include directories, instead of the ones in -moeingevm")
+		jobs := fs.Int("j", 0, "the number of parallel compiler processes, the number of CPUs by default")
+		evmoneVersion := fs.String("evmone-version", "", "the version of evmone, which is recorded in the library")
+		ldflags := fs.String("ldflags", "", "space-separated flags for linking the library, such as -L and -l")
+		objs := fs.String("objs", "", "comma-separated objects or static libraries linked into the library")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			subUsage("build [-cxx=g++] [-flags=...] [-moeingevm=dir] [-I=dir1,dir2] [-j=n] [-evmone-version=v] [-ldflags=...] [-objs=a.o,b.a] <output-dir-of-gen>")
+		}
+		cfg := maot.BuildConfig{Compiler: *compiler, Flags: strings.Fields(*flags), Jobs: *jobs, Library: def.Library,
+			EvmoneVersion: *evmoneVersion, LinkFlags: strings.Fields(*ldflags)}
+		if len(*objs) != 0 {
+			cfg.ExtraObjects = strings.Split(*objs, ",")
+		}
+		if len(*includes) != 0 {
+			cfg.IncludeDirs = strings.Split(*includes, ",")
+		} else {
+			cfg.IncludeDirs = maot.MoeingevmIncludeDirs(*moeingevm)
+		}
+		result, err := maot.Build(fs.Arg(0), cfg)
+		if result != nil {
+			result.Print(os.Stdout)
+		}
+		check(err)
+	} else if os.Args[1] == "info" {
+		fs := flag.NewFlagSet("info", flag.ExitOnError)
+		libID := fs.String("libid", "", "the library id given to gen")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() != 1 {
+			subUsage("info [-libid=id] <libevmaot.so>")
+		}
+		info, err := maot.ReadLibraryInfo(fs.Arg(0), *libID)
+		check(err)
+		info.Print(os.Stdout)
 	} else {
-		fmt.Printf("Usage: %s demo|instrexe|gen\n", os.Args[0])
+		usage()
+	}
+}
+
+// run the differential tests on the snippets and the contracts, returning the exit code
+func runDifftest(h *difftest.Harness, revs []int, contracts map[string][]byte) int {
+	names := make([]string, 0, len(contracts))
+	for name := range contracts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	total, failures := 0, 0
+	for _, rev := range revs {
+		cases := difftest.Snippets(rev)
+		for _, name := range names {
+			cases = append(cases, difftest.Case{Name: name, Rev: rev, Code: contracts[name]})
+		}
+		for _, c := range cases {
+			runs, mismatches := h.Run(c)
+			total += runs
+			failures += len(mismatches)
+			fmt.Printf("%-12s %-10s %4d runs, %d mismatches\n", maot.RevisionNames[rev], c.Name, runs, len(mismatches))
+			for _, m := range mismatches {
+				m.Print(os.Stdout, h.Target.Name)
+			}
+		}
+	}
+	fmt.Printf("total: %d runs, %d mismatches\n", total, failures)
+	if failures != 0 {
+		return 1
 	}
+	return 0
 }